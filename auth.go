@@ -0,0 +1,189 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pkgmirror
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	GITHUB_HOSTS = []string{"github.com", "api.github.com", "codeload.github.com"}
+)
+
+// ResolveSecret returns the value of a credential, the value can reference an environment
+// variable, ie: env:SATIS_PASSWORD, or a file, ie: file:/etc/pkgmirror/satis.token
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := value[4:]
+
+		if secret := os.Getenv(name); len(secret) > 0 {
+			return secret, nil
+		}
+
+		return "", fmt.Errorf("The environment variable %s is empty", name)
+
+	case strings.HasPrefix(value, "file:"):
+		data, err := ioutil.ReadFile(value[5:])
+
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return value, nil
+}
+
+// NewAuthenticator creates an authenticator sending the credentials to the hosts of the
+// provided servers, nil is returned if no credentials are configured.
+func NewAuthenticator(servers []string, conf *CredentialsConfig) (*Authenticator, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	a := &Authenticator{}
+
+	if err := a.Add(servers, conf); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Authenticator adds the credentials to the requests sent to a protected upstream, the
+// credentials are never sent to other hosts.
+type Authenticator struct {
+	Hosts       map[string]*Credentials // credentials of each protected host
+	GithubOAuth string                  // sent to the github hosts
+}
+
+type Credentials struct {
+	Username string // http-basic
+	Password string
+	Token    string // bearer token
+}
+
+// Add registers the credentials of other servers, so each upstream of a mirror only
+// receives its own credentials.
+func (a *Authenticator) Add(servers []string, conf *CredentialsConfig) error {
+	if conf == nil {
+		return nil
+	}
+
+	if a.Hosts == nil {
+		a.Hosts = map[string]*Credentials{}
+	}
+
+	c := &Credentials{}
+	github := ""
+
+	for _, field := range []struct {
+		value  string
+		secret *string
+	}{
+		{conf.Username, &c.Username},
+		{conf.Password, &c.Password},
+		{conf.Token, &c.Token},
+		{conf.GithubOAuth, &github},
+	} {
+		secret, err := ResolveSecret(field.value)
+
+		if err != nil {
+			return err
+		}
+
+		*field.secret = secret
+	}
+
+	if len(github) > 0 {
+		a.GithubOAuth = github
+	}
+
+	for _, server := range servers {
+		u, err := url.Parse(server)
+
+		if err != nil {
+			return err
+		}
+
+		a.Hosts[u.Host] = c
+	}
+
+	return nil
+}
+
+func (a *Authenticator) hasHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *Authenticator) header(u *url.URL) (string, string) {
+	if a == nil {
+		return "", ""
+	}
+
+	if len(a.GithubOAuth) > 0 && a.hasHost(GITHUB_HOSTS, u.Host) {
+		return "Authorization", "token " + a.GithubOAuth
+	}
+
+	c, ok := a.Hosts[u.Host]
+
+	if !ok {
+		return "", ""
+	}
+
+	if len(c.Token) > 0 {
+		return "Authorization", "Bearer " + c.Token
+	}
+
+	if len(c.Username) > 0 {
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(c.Username, c.Password)
+
+		return "Authorization", req.Header.Get("Authorization")
+	}
+
+	return "", ""
+}
+
+// IsProtected returns true if the credentials are sent to the url.
+func (a *Authenticator) IsProtected(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+
+	if err != nil {
+		return false
+	}
+
+	name, _ := a.header(u)
+
+	return len(name) > 0
+}
+
+// Authenticate adds the credentials to the request if the host is protected.
+func (a *Authenticator) Authenticate(req *http.Request) {
+	if name, value := a.header(req.URL); len(name) > 0 {
+		req.Header.Set(name, value)
+	}
+}
+
+// Do sends the request with the credentials, a nil authenticator sends the request as is.
+func (a *Authenticator) Do(req *http.Request) (*http.Response, error) {
+	a.Authenticate(req)
+
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,125 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pkgmirror
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ResolveSecret(t *testing.T) {
+	os.Setenv("PKGMIRROR_TEST_SECRET", "s3cr3t")
+	defer os.Unsetenv("PKGMIRROR_TEST_SECRET")
+
+	v, err := ResolveSecret("env:PKGMIRROR_TEST_SECRET")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", v)
+
+	_, err = ResolveSecret("env:PKGMIRROR_TEST_MISSING")
+	assert.Error(t, err)
+
+	f, _ := ioutil.TempFile("", "pkgmirror-secret-")
+	f.WriteString("token\n")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	v, err = ResolveSecret("file:" + f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "token", v)
+
+	v, err = ResolveSecret("plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", v)
+}
+
+func Test_Authenticator(t *testing.T) {
+	a, err := NewAuthenticator([]string{"https://satis.example.com/composer"}, &CredentialsConfig{
+		Username:    "user",
+		Password:    "pass",
+		GithubOAuth: "gh-token",
+	})
+
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "https://satis.example.com/composer/packages.json", nil)
+	a.Authenticate(req)
+	username, password, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "pass", password)
+
+	req, _ = http.NewRequest("GET", "https://api.github.com/repos/rande/pkgmirror/zipball/master", nil)
+	a.Authenticate(req)
+	assert.Equal(t, "token gh-token", req.Header.Get("Authorization"))
+
+	// the credentials are not sent to other hosts
+	req, _ = http.NewRequest("GET", "https://packagist.org/packages.json", nil)
+	a.Authenticate(req)
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	assert.True(t, a.IsProtected("https://satis.example.com/dist/foo.zip"))
+	assert.False(t, a.IsProtected("https://packagist.org/packages.json"))
+}
+
+func Test_Authenticator_Bearer(t *testing.T) {
+	a, err := NewAuthenticator([]string{"https://gitlab.example.com/api/v4/group/1/-/packages/composer"}, &CredentialsConfig{
+		Token: "bearer-token",
+	})
+
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "https://gitlab.example.com/api/v4/group/1/-/packages/composer/packages.json", nil)
+	a.Authenticate(req)
+	assert.Equal(t, "Bearer bearer-token", req.Header.Get("Authorization"))
+
+	// github hosts are not protected without oauth token
+	assert.False(t, a.IsProtected("https://api.github.com/repos/rande/pkgmirror/zipball/master"))
+}
+
+func Test_Authenticator_Add(t *testing.T) {
+	a, err := NewAuthenticator([]string{"https://satis.example.com"}, &CredentialsConfig{
+		Token: "satis-token",
+	})
+
+	assert.NoError(t, err)
+	assert.NoError(t, a.Add([]string{"https://gitlab.example.com"}, &CredentialsConfig{
+		Username: "user",
+		Password: "pass",
+	}))
+	assert.NoError(t, a.Add([]string{"https://packagist.org"}, nil))
+
+	// each host receives its own credentials
+	req, _ := http.NewRequest("GET", "https://satis.example.com/packages.json", nil)
+	a.Authenticate(req)
+	assert.Equal(t, "Bearer satis-token", req.Header.Get("Authorization"))
+
+	req, _ = http.NewRequest("GET", "https://gitlab.example.com/packages.json", nil)
+	a.Authenticate(req)
+	username, password, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "pass", password)
+
+	req, _ = http.NewRequest("GET", "https://packagist.org/packages.json", nil)
+	a.Authenticate(req)
+	assert.Empty(t, req.Header.Get("Authorization"))
+}
+
+func Test_Authenticator_Nil(t *testing.T) {
+	a, err := NewAuthenticator([]string{"https://packagist.org"}, nil)
+
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+	assert.False(t, a.IsProtected("https://packagist.org/packages.json"))
+
+	req, _ := http.NewRequest("GET", "https://packagist.org/packages.json", nil)
+	a.Authenticate(req)
+	assert.Empty(t, req.Header.Get("Authorization"))
+}
@@ -30,6 +30,11 @@ func main() {
 				Ui: ui,
 			}, nil
 		},
+		"gc": func() (cli.Command, error) {
+			return &commands.GcCommand{
+				Ui: ui,
+			}, nil
+		},
 	}
 
 	exitStatus, _ := c.Run()
@@ -0,0 +1,124 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mitchellh/cli"
+	"github.com/rande/pkgmirror/mirror/composer"
+)
+
+// GcCommand calls the api of the running server, the database cannot be opened by
+// another process.
+type GcCommand struct {
+	Ui      cli.Ui
+	Verbose bool
+	Server  string
+	Code    string
+	Apply   bool
+}
+
+func (c *GcCommand) Run(args []string) int {
+	cmdFlags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	cmdFlags.Usage = func() {
+		c.Ui.Output(c.Help())
+	}
+
+	cmdFlags.BoolVar(&c.Verbose, "verbose", false, "")
+	cmdFlags.StringVar(&c.Server, "server", "http://127.0.0.1:8000", "The internal server")
+	cmdFlags.StringVar(&c.Code, "code", "packagist", "The composer mirror")
+	cmdFlags.BoolVar(&c.Apply, "apply", false, "Delete the keys")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	method := "GET"
+	if c.Apply {
+		method = "POST"
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/api/composer/%s/gc", strings.TrimRight(c.Server, "/"), c.Code), nil)
+
+	if err != nil {
+		c.Ui.Error(err.Error())
+
+		return 1
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		c.Ui.Error(err.Error())
+
+		return 1
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		c.Ui.Error(fmt.Sprintf("Unable to collect the garbage, status: %d", resp.StatusCode))
+
+		return 1
+	}
+
+	report := &composer.GCReport{}
+
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		c.Ui.Error(err.Error())
+
+		return 1
+	}
+
+	if c.Verbose {
+		for _, list := range []struct {
+			name string
+			keys []string
+		}{
+			{"provider", report.Providers},
+			{"package", report.Packages},
+			{"orphan", report.Orphans},
+		} {
+			for _, key := range list.keys {
+				c.Ui.Output(fmt.Sprintf("%-10s %s", list.name, key))
+			}
+		}
+	}
+
+	action := "Would delete"
+	if report.Applied {
+		action = "Deleted"
+	}
+
+	c.Ui.Info(fmt.Sprintf("%s %d generations, %d providers, %d packages and %d orphans (%d bytes)",
+		action, report.Generations, len(report.Providers), len(report.Packages), len(report.Orphans), report.Bytes))
+
+	return 0
+}
+
+func (c *GcCommand) Synopsis() string {
+	return "Report or collect the unused composer files."
+}
+
+func (c *GcCommand) Help() string {
+	return strings.TrimSpace(`
+Usage: pkgmirror gc [options]
+
+  Report the provider files, package definitions and orphan keys not used by a composer
+  mirror, the report is a dry run unless the -apply option is set.
+
+Options:
+  -server             The internal server (default: http://127.0.0.1:8000)
+  -code               The composer mirror (default: packagist)
+  -apply              Delete the keys
+  -verbose            Display the keys
+`)
+}
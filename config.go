@@ -6,9 +6,33 @@
 package pkgmirror
 
 type ComposerConfig struct {
-	Server  string
-	Enabled bool
-	Icon    string
+	Server           string
+	Enabled          bool
+	Icon             string
+	ForwardDownloads bool
+	Include          []string
+	Exclude          []string
+	Lazy             bool
+	Mirrors          bool
+	Generations      int
+	GracePeriod      string
+	Credentials      *CredentialsConfig // credentials of the Server, the upstreams have their own credentials
+	Quarantine       bool
+	QuarantineDelay  string
+	Tokens           map[string]string // identity => bearer token required by the write requests, can reference env:NAME or file:/path
+	Upstreams        []*struct {
+		Server      string
+		Priority    int
+		Credentials *CredentialsConfig // only sent to the upstream host
+	}
+}
+
+// the values can reference an environment variable (env:NAME) or a file (file:/path/to/secret)
+type CredentialsConfig struct {
+	Username    string // http-basic
+	Password    string
+	Token       string // bearer token
+	GithubOAuth string
 }
 
 type BowerConfig struct {
@@ -18,10 +42,15 @@ type BowerConfig struct {
 }
 
 type NpmConfig struct {
-	Server    string
-	Enabled   bool
-	Icon      string
-	Fallbacks []*struct {
+	Server       string
+	Enabled      bool
+	Icon         string
+	ChangesFeed  string
+	Include      []string
+	Replicate    bool
+	Scopes       []string
+	PublishToken string // required to publish in the scopes, can reference env:NAME or file:/path
+	Fallbacks    []*struct {
 		Server string
 	}
 }
@@ -39,6 +68,14 @@ type StaticConfig struct {
 	Icon    string
 }
 
+type RewriteConfig struct {
+	Kind  string
+	Match string
+	Type  string
+	Code  string
+	Path  string
+}
+
 type Config struct {
 	DataDir        string
 	LogDir         string
@@ -51,4 +88,5 @@ type Config struct {
 	Git            map[string]*GitConfig
 	Bower          map[string]*BowerConfig
 	Static         map[string]*StaticConfig
+	Rewrite        []*RewriteConfig
 }
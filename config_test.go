@@ -24,11 +24,21 @@ InternalServer = "localhost:8000"
     [Composer.packagist]
     Server = "https://packagist.org"
     Enabled = true
+    Include = ["symfony/*", "drupal/*"]
+    Exclude = ["symfony/symfony"]
 
     [Composer.satis]
     Server = "https://satis.internal.org"
     Enabled = false
 
+    [Composer.all]
+    Enabled = true
+        [[Composer.all.Upstreams]]
+        Server = "https://satis.internal.org"
+        Priority = 10
+        [[Composer.all.Upstreams]]
+        Server = "https://packagist.org"
+
 [Npm]
     [Npm.npm]
     Server = "https://registry.npmjs.org"
@@ -42,17 +52,30 @@ InternalServer = "localhost:8000"
 [Static]
     [Static.drupal]
     Server = "drupal.org"
+
+[[Rewrite]]
+Kind = "archive"
+Match = '^https://ftp\.drupal\.org/files/projects/(.*)\.zip$'
+Type = "static"
+Code = "drupal8"
+Path = "${1}.zip"
 `
 
 	_, err := toml.Decode(confStr, c)
 
 	assert.NoError(t, err)
 	assert.Equal(t, "/var/lib/pkgmirror", c.DataDir)
-	assert.Equal(t, 2, len(c.Composer))
+	assert.Equal(t, 3, len(c.Composer))
 	assert.Equal(t, "https://satis.internal.org", c.Composer["satis"].Server)
 	assert.Equal(t, false, c.Composer["satis"].Enabled)
 	assert.Equal(t, "https://packagist.org", c.Composer["packagist"].Server)
 	assert.Equal(t, true, c.Composer["packagist"].Enabled)
+	assert.Equal(t, []string{"symfony/*", "drupal/*"}, c.Composer["packagist"].Include)
+	assert.Equal(t, []string{"symfony/symfony"}, c.Composer["packagist"].Exclude)
+	assert.Equal(t, 2, len(c.Composer["all"].Upstreams))
+	assert.Equal(t, "https://satis.internal.org", c.Composer["all"].Upstreams[0].Server)
+	assert.Equal(t, 10, c.Composer["all"].Upstreams[0].Priority)
+	assert.Equal(t, 0, c.Composer["all"].Upstreams[1].Priority)
 
 	assert.Equal(t, 1, len(c.Npm))
 	assert.Equal(t, "https://registry.npmjs.org", c.Npm["npm"].Server)
@@ -66,4 +89,10 @@ InternalServer = "localhost:8000"
 	assert.Equal(t, 1, len(c.Static))
 	assert.Equal(t, "drupal.org", c.Static["drupal"].Server)
 	assert.Equal(t, false, c.Static["drupal"].Enabled)
+
+	assert.Equal(t, 1, len(c.Rewrite))
+	assert.Equal(t, "archive", c.Rewrite[0].Kind)
+	assert.Equal(t, `^https://ftp\.drupal\.org/files/projects/(.*)\.zip$`, c.Rewrite[0].Match)
+	assert.Equal(t, "drupal8", c.Rewrite[0].Code)
+	assert.Equal(t, "${1}.zip", c.Rewrite[0].Path)
 }
@@ -0,0 +1,66 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pkgmirror
+
+import (
+	"time"
+)
+
+const (
+	DOWNLOADS_DAY_FORMAT = "2006-01-02"
+)
+
+// DownloadCounter counts the downloads of a package, the daily counters are kept for a
+// limited number of days.
+type DownloadCounter struct {
+	Total int            `json:"total"`
+	Days  map[string]int `json:"days"`
+}
+
+// Add increments the counters and removes the days older than the history window.
+func (c *DownloadCounter) Add(count int, now time.Time, history int) {
+	c.Merge(&DownloadCounter{Total: count, Days: map[string]int{now.Format(DOWNLOADS_DAY_FORMAT): count}}, now, history)
+}
+
+// Merge adds the counters of another counter, ie: the downloads not stored yet, and removes
+// the days older than the history window.
+func (c *DownloadCounter) Merge(o *DownloadCounter, now time.Time, history int) {
+	if c.Days == nil {
+		c.Days = map[string]int{}
+	}
+
+	c.Total += o.Total
+
+	for day, count := range o.Days {
+		c.Days[day] += count
+	}
+
+	limit := now.AddDate(0, 0, -history).Format(DOWNLOADS_DAY_FORMAT)
+
+	for day := range c.Days {
+		if day < limit {
+			delete(c.Days, day)
+		}
+	}
+}
+
+// Since returns the number of downloads from the provided number of days, 0 means all time.
+func (c *DownloadCounter) Since(days int, now time.Time) int {
+	if days <= 0 {
+		return c.Total
+	}
+
+	limit := now.AddDate(0, 0, -days).Format(DOWNLOADS_DAY_FORMAT)
+	total := 0
+
+	for day, count := range c.Days {
+		if day > limit {
+			total += count
+		}
+	}
+
+	return total
+}
@@ -0,0 +1,39 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pkgmirror
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DownloadCounter(t *testing.T) {
+	now := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	c := &DownloadCounter{
+		Days: map[string]int{
+			"2016-01-01": 4,
+		},
+	}
+
+	c.Add(1, now.AddDate(0, 0, -10), 30)
+	c.Add(2, now, 30)
+
+	assert.Equal(t, 3, c.Total)
+	assert.Equal(t, 2, len(c.Days))
+
+	assert.Equal(t, 3, c.Since(0, now))
+	assert.Equal(t, 2, c.Since(1, now))
+	assert.Equal(t, 3, c.Since(30, now))
+
+	// the days out of the history window are removed
+	c.Merge(&DownloadCounter{Total: 1, Days: map[string]int{"2016-10-01": 1}}, now, 5)
+
+	assert.Equal(t, 4, c.Total)
+	assert.Equal(t, map[string]int{"2016-10-01": 3}, c.Days)
+}
@@ -19,4 +19,8 @@ var (
 	HttpError             = errors.New("Http error")
 	InvalidPackageError   = errors.New("Invalid package error")
 	InvalidReferenceError = errors.New("Invalid reference")
+	ChecksumMismatchError = errors.New("Checksum mismatch")
+	ForbiddenScopeError   = errors.New("The scope is not allowed")
+	VersionExistsError    = errors.New("The version already exists")
+	UnauthorizedError     = errors.New("Invalid credentials")
 )
@@ -42,6 +42,7 @@ type BowerService struct {
 	lock          bool
 	StateChan     chan pkgmirror.State
 	BoltCompacter *pkgmirror.BoltCompacter
+	Rewriter      *git.Rewriter
 }
 
 func (bs *BowerService) Init(app *goapp.App) (err error) {
@@ -196,7 +197,7 @@ func (bs *BowerService) SyncPackages() error {
 			}
 
 			pkg.SourceUrl = pkg.Url
-			pkg.Url = git.GitRewriteRepository(bs.Config.PublicServer, pkg.Url)
+			pkg.Url = bs.Rewriter.RewriteRepository(pkg.Url)
 
 			data, _ = json.Marshal(pkg)
 
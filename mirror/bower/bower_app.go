@@ -12,6 +12,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/rande/goapp"
 	"github.com/rande/pkgmirror"
+	"github.com/rande/pkgmirror/mirror/git"
 	"goji.io"
 	"goji.io/pat"
 	"golang.org/x/net/context"
@@ -41,6 +42,7 @@ func ConfigureApp(config *pkgmirror.Config, l *goapp.Lifecycle) {
 					})
 					s.StateChan = pkgmirror.GetStateChannel(fmt.Sprintf("pkgmirror.bower.%s", name), app.Get("pkgmirror.channel.state").(chan pkgmirror.State))
 					s.BoltCompacter = app.Get("bolt.compacter").(*pkgmirror.BoltCompacter)
+					s.Rewriter = app.Get("pkgmirror.git.rewriter").(*git.Rewriter)
 
 					if err := s.Init(app); err != nil {
 						panic(err)
@@ -7,10 +7,14 @@ package composer
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -26,6 +30,53 @@ type ComposerConfig struct {
 	BasePublicServer string
 	Code             []byte
 	Path             string
+	ForwardDownloads bool
+	GitBinary        string
+	Include          []string
+	Exclude          []string
+	Upstreams        []*Upstream
+	Lazy             bool
+	Mirrors          bool
+	Generations      int
+	GracePeriod      time.Duration
+	Quarantine       bool
+	QuarantineDelay  time.Duration     // new versions are approved after the delay, 0 to disable
+	Tokens           map[string]string // identity => bearer token, the write requests are refused if empty
+}
+
+// Authorize checks the bearer token sent in the Authorization header and returns the identity
+// of the token, the write requests are refused if no token is configured.
+func (c *ComposerConfig) Authorize(header string) (string, bool) {
+	identity, authorized := "", false
+
+	// all the tokens are compared, so the response time does not depend on the identity
+	for name, token := range c.Tokens {
+		if len(token) > 0 && subtle.ConstantTimeCompare([]byte(header), []byte(fmt.Sprintf("Bearer %s", token))) == 1 {
+			identity, authorized = name, true
+		}
+	}
+
+	return identity, authorized
+}
+
+// IsAllowed checks the package name against the include and exclude glob patterns,
+// ie: symfony/*. All packages are allowed if no include pattern is configured.
+func (c *ComposerConfig) IsAllowed(name string) bool {
+	match := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(c.Include) > 0 && !match(c.Include) {
+		return false
+	}
+
+	return !match(c.Exclude)
 }
 
 func NewComposerService() *ComposerService {
@@ -34,27 +85,39 @@ func NewComposerService() *ComposerService {
 			SourceServer: "https://packagist.org",
 			Code:         []byte("packagist"),
 			Path:         "./data/composer",
+			GitBinary:    "git",
+			Generations:  DEFAULT_GENERATIONS,
+			GracePeriod:  DEFAULT_GRACE_PERIOD,
 		},
 	}
 }
 
 type ComposerService struct {
-	DB            *bolt.DB
-	Config        *ComposerConfig
-	Logger        *log.Entry
-	lock          bool
-	StateChan     chan pkgmirror.State
-	ProvidersURL  string
-	BoltCompacter *pkgmirror.BoltCompacter
+	DB             *bolt.DB
+	Config         *ComposerConfig
+	Logger         *log.Entry
+	lock           bool
+	StateChan      chan pkgmirror.State
+	NotifyBatchURL string
+	AdvisoriesURL  string
+	BoltCompacter  *pkgmirror.BoltCompacter
+	Rewriter       *git.Rewriter
+	Auth           *pkgmirror.Authenticator
+	downloads      []*DownloadNotification
+	downloadsLock  sync.Mutex
+	upstreamsLock  sync.Mutex
+	lazyCalls      map[string]*lazyCall
+	lazyMissing    map[string]time.Time
+	lazyLock       sync.Mutex
 }
 
 func (ps *ComposerService) getPackageUrl(pi *PackageInformation) string {
-	return fmt.Sprintf("%s%s", ps.Config.BasePublicServer, ps.getPackageKey(pi))
+	return fmt.Sprintf("%s%s", ps.getUpstream(pi.Upstream).BasePublicServer, ps.getPackageKey(pi))
 }
 
 func (ps *ComposerService) getPackageKey(pi *PackageInformation) string {
 	// /8/%package%$%hash%.json
-	var key = ps.ProvidersURL
+	var key = ps.getUpstream(pi.Upstream).ProvidersURL
 
 	key = strings.Replace(key, "%package%", pi.Package, -1)
 	key = strings.Replace(key, "%hash%", pi.HashSource, -1)
@@ -62,9 +125,20 @@ func (ps *ComposerService) getPackageKey(pi *PackageInformation) string {
 	return key
 }
 
+// getAbsoluteUrl resolves an url advertised by the upstream packages.json file.
+func (ps *ComposerService) getAbsoluteUrl(path string) string {
+	if len(path) == 0 || strings.Contains(path, "://") {
+		return path
+	}
+
+	return fmt.Sprintf("%s%s", ps.Config.BasePublicServer, path)
+}
+
 func (ps *ComposerService) Init(app *goapp.App) (err error) {
 	ps.Logger.Info("Init")
 
+	ps.initUpstreams()
+
 	return ps.openDatabase()
 }
 
@@ -79,8 +153,11 @@ func (ps *ComposerService) Serve(state *goapp.GoroutineState) error {
 		ps.Logger.Info("Starting a new sync...")
 
 		ps.SyncPackages()
+		ps.ApproveExpiredVersions()
 		ps.UpdateEntryPoints()
 		ps.CleanPackages()
+		ps.SyncAdvisories()
+		ps.ForwardDownloads()
 
 		iteration++
 
@@ -95,7 +172,11 @@ func (ps *ComposerService) Serve(state *goapp.GoroutineState) error {
 	}
 
 	// start the first sync
-	go sync()
+	go func() {
+		ps.rebuildSearchIndex()
+
+		sync()
+	}()
 
 	for {
 		select {
@@ -135,7 +216,15 @@ func (ps *ComposerService) openDatabase() (err error) {
 		return err
 	}
 
-	return nil
+	return ps.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{SEARCH_BUCKET, DOWNLOADS_BUCKET, PRIVATE_BUCKET, PRIVATE_DISTS_BUCKET, META_BUCKET, ADVISORIES_BUCKET, INLINE_BUCKET, GENERATIONS_BUCKET, HISTORY_BUCKET, QUARANTINE_BUCKET, QUARANTINE_RULES_BUCKET, VERSIONS_BUCKET} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
 func (ps *ComposerService) optimize() error {
@@ -181,7 +270,7 @@ func (ps *ComposerService) SyncPackages() error {
 				"url":         pkg.Url,
 			}).Debug("Load loading package information")
 
-			if err := pkgmirror.LoadRemoteStruct(pkg.Url, p); err != nil {
+			if err := pkgmirror.LoadRemoteStructWithAuth(pkg.Url, p, ps.Auth); err != nil {
 				logger.WithFields(log.Fields{
 					"package": pkg.Package,
 					"url":     pkg.Url,
@@ -205,8 +294,6 @@ func (ps *ComposerService) SyncPackages() error {
 
 	dm.Start()
 
-	packagesResult := &PackagesResult{}
-
 	logger.Info("Loading packages.json")
 
 	ps.StateChan <- pkgmirror.State{
@@ -214,80 +301,156 @@ func (ps *ComposerService) SyncPackages() error {
 		Status:  pkgmirror.STATUS_RUNNING,
 	}
 
-	if err := pkgmirror.LoadRemoteStruct(fmt.Sprintf("%s/packages.json", ps.Config.SourceServer), packagesResult); err != nil {
-		logger.WithFields(log.Fields{
-			"path":  "packages.json",
-			"error": err.Error(),
-		}).Error("Error loading packages.json")
+	upstreams := ps.getUpstreams()
 
+	results, err := ps.loadUpstreams(upstreams)
+
+	if err != nil {
 		return err // an error occurs avoid empty file
 	}
 
-	ps.ProvidersURL = packagesResult.ProvidersURL
+	// the notifications and the advisories are handled by the primary upstream
+	packagesResult := results[0]
 
-	for provider, sha := range packagesResult.ProviderIncludes {
-		path := strings.Replace(provider, "%hash%", sha.Sha256, -1)
+	ps.NotifyBatchURL = ps.getAbsoluteUrl(packagesResult.NotifyBatch)
 
-		logger := logger.WithFields(log.Fields{
-			"provider":      provider,
-			"provider_hash": sha.Sha256,
-		})
+	if packagesResult.SecurityAdvisories != nil {
+		ps.AdvisoriesURL = ps.getAbsoluteUrl(packagesResult.SecurityAdvisories.ApiURL)
+	}
 
-		logger.Info("Loading provider information")
+	// the inline packages are stored once the providers are known, as a package can be listed
+	// inline and in a provider. The current inline packages are kept if one upstream fails.
+	inline, err := ps.collectInlinePackages(upstreams, results)
 
-		pr := &ProvidersResult{}
+	if err != nil {
+		logger.WithError(err).Error("Error loading inline packages")
+	}
 
-		if err := pkgmirror.LoadRemoteStruct(fmt.Sprintf("%s/%s", ps.Config.SourceServer, path), pr); err != nil {
-			logger.WithField("error", err.Error()).Error("Error loading provider information")
-		} else {
-			logger.Debug("End loading provider information")
+	syncInline := func(claimed map[string]bool) {
+		if inline != nil {
+			ps.syncInlinePackages(inline, claimed)
 		}
+	}
 
-		for name, sha := range pr.Providers {
-			p := PackageInformation{
-				Server:  string(ps.Config.Code),
-				Package: name,
-				Exist:   false,
-			}
+	if ps.Config.Lazy {
+		syncInline(nil)
+
+		dm.Wait()
+
+		return ps.refreshLazyPackages(upstreams, packagesResult)
+	}
+
+	// the change feed only lists the packages of one upstream
+	if len(upstreams) == 1 {
+		syncInline(nil)
+
+		if err := ps.syncChanges(packagesResult); err == nil {
+			logger.Info("Packages updated from the change feed")
+
+			dm.Wait()
+
+			return nil
+		}
+	}
+
+	// keep the current position of the change feed, so the next sync can be incremental
+	var changes *ChangesResult
+
+	if len(upstreams) == 1 && len(packagesResult.MetadataChangesURL) > 0 {
+		changes, _ = ps.loadChanges(ps.getAbsoluteUrl(packagesResult.MetadataChangesURL), 0)
+	}
+
+	// a package is loaded from the upstream with the highest priority
+	claimed := map[string]bool{}
+
+	for index, upstream := range upstreams {
+		for provider, sha := range results[index].ProviderIncludes {
+			path := strings.Replace(provider, "%hash%", sha.Sha256, -1)
 
 			logger := logger.WithFields(log.Fields{
-				"package": name,
+				"server":        upstream.Server,
+				"provider":      provider,
+				"provider_hash": sha.Sha256,
 			})
 
-			logger.Debug("Analysing package")
+			logger.Info("Loading provider information")
 
-			ps.DB.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket(ps.Config.Code)
-				data := b.Get([]byte(p.Package))
+			pr := &ProvidersResult{}
 
-				p.Exist = false
+			if err := pkgmirror.LoadRemoteStructWithAuth(fmt.Sprintf("%s/%s", upstream.Server, path), pr, ps.Auth); err != nil {
+				logger.WithField("error", err.Error()).Error("Error loading provider information")
+			} else {
+				logger.Debug("End loading provider information")
+			}
 
-				if err := pkgmirror.Unmarshal(data, &p); err != nil && len(data) > 0 {
-					logger.WithFields(log.Fields{
-						"error": err,
-						"data":  data,
-					}).Error("Unable to unmarshal package information")
-				} else {
-					p.Exist = p.HashSource == sha.Sha256
+			for name, sha := range pr.Providers {
+				if claimed[name] || !ps.Config.IsAllowed(name) {
+					continue
 				}
 
-				p.HashSource = sha.Sha256
+				if ip, ok := inline[name]; ok {
+					if ip.Index <= index {
+						continue // listed inline by an upstream with a higher priority
+					}
 
-				return nil
-			})
+					delete(inline, name)
+				}
 
-			p.Url = ps.getPackageUrl(&p)
+				claimed[name] = true
 
-			logger = logger.WithFields(log.Fields{
-				"package_hash": p.HashSource,
-			})
+				p := PackageInformation{
+					Server:  string(ps.Config.Code),
+					Package: name,
+					Exist:   false,
+				}
 
-			if !p.Exist {
-				logger.Info("Add/Update new package")
+				logger := logger.WithFields(log.Fields{
+					"package": name,
+				})
 
-				dm.Add(p)
-			} else {
-				logger.Debug("Skipping package")
+				logger.Debug("Analysing package")
+
+				ps.DB.View(func(tx *bolt.Tx) error {
+					b := tx.Bucket(ps.Config.Code)
+					data := b.Get([]byte(p.Package))
+
+					p.Exist = false
+
+					if err := pkgmirror.Unmarshal(data, &p); err != nil && len(data) > 0 {
+						logger.WithFields(log.Fields{
+							"error": err,
+							"data":  data,
+						}).Error("Unable to unmarshal package information")
+					} else {
+						// the package must be reloaded if an upstream with a higher priority provides it
+						p.Exist = p.HashSource == sha.Sha256 && ps.getUpstream(p.Upstream) == upstream
+					}
+
+					p.HashSource = sha.Sha256
+					p.Upstream = upstream.Server
+
+					return nil
+				})
+
+				if p.Private {
+					logger.Debug("Skipping package, a private package exists")
+
+					continue
+				}
+
+				p.Url = ps.getPackageUrl(&p)
+
+				logger = logger.WithFields(log.Fields{
+					"package_hash": p.HashSource,
+				})
+
+				if !p.Exist {
+					logger.Info("Add/Update new package")
+
+					dm.Add(p)
+				} else {
+					logger.Debug("Skipping package")
+				}
 			}
 		}
 	}
@@ -301,6 +464,12 @@ func (ps *ComposerService) SyncPackages() error {
 
 	dm.Wait()
 
+	syncInline(claimed)
+
+	if changes != nil {
+		return ps.setChangesCursor(changes.Timestamp)
+	}
+
 	return nil
 }
 
@@ -386,122 +555,173 @@ func (ps *ComposerService) UpdateEntryPoints() error {
 		Status:  pkgmirror.STATUS_RUNNING,
 	}
 
-	pkgResult := &PackagesResult{}
-	if err := pkgmirror.LoadRemoteStruct(fmt.Sprintf("%s/packages.json", ps.Config.SourceServer), pkgResult); err != nil {
-		logger.WithFields(log.Fields{
-			"path":  "packages.json",
-			"error": err.Error(),
-		}).Error("Error loading packages.json")
+	upstreams := ps.getUpstreams()
+
+	results, err := ps.loadUpstreams(upstreams)
 
+	if err != nil {
 		return err // an error occurs avoid empty file
 	}
 
 	logger.Debug("packages.json loaded")
 
+	// the packages.json file of the primary upstream is used as a base, the providers of all
+	// upstreams are merged into it.
+	pkgResult := results[0]
+	providerIncludes := ProviderInclude{}
 	providers := map[string]*ProvidersResult{}
+	files := map[string][]byte{} // the provider files of the new generation
+	available := []string{}
+	claimed := map[string]bool{}
+
+	// the upstream providers are not exposed in lazy mode, the packages are loaded on demand
+	walked := upstreams
+	if ps.Config.Lazy {
+		walked = nil
+	}
 
-	for provider, sha := range pkgResult.ProviderIncludes {
-		pr := &ProvidersResult{}
-
-		url := fmt.Sprintf("%s/%s", ps.Config.SourceServer, strings.Replace(provider, "%hash%", sha.Sha256, -1))
+	for index, upstream := range walked {
+		for source, sha := range results[index].ProviderIncludes {
+			pr := &ProvidersResult{}
 
-		logger.WithFields(log.Fields{
-			"provider": provider,
-			"url":      url,
-		}).Debug("Load provider")
+			url := fmt.Sprintf("%s/%s", upstream.Server, strings.Replace(source, "%hash%", sha.Sha256, -1))
 
-		if err := pkgmirror.LoadRemoteStruct(url, pr); err != nil {
-			ps.Logger.WithFields(log.Fields{
-				"provider": provider,
+			logger.WithFields(log.Fields{
+				"provider": source,
 				"url":      url,
-				"error":    err,
-			}).Error("Error loading provider information")
-		}
-
-		providers[provider] = pr
+			}).Debug("Load provider")
+
+			if err := pkgmirror.LoadRemoteStructWithAuth(url, pr, ps.Auth); err != nil {
+				ps.Logger.WithFields(log.Fields{
+					"provider": source,
+					"url":      url,
+					"error":    err,
+				}).Error("Error loading provider information")
+			}
 
-		// iterate packages from each provider
-		for name := range pr.Providers {
-			ps.DB.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket(ps.Config.Code)
-				data := b.Get([]byte(name))
+			provider := GetProviderKey(index, source)
+			providers[provider] = pr
 
-				pi := &PackageInformation{}
-				if err := pkgmirror.Unmarshal(data, pi); err != nil {
-					logger.WithFields(log.Fields{
-						"error": err.Error(),
-						"data":  string(data),
-						"name":  name,
-					}).Error("Error while unmarshalling provider package")
+			// iterate packages from each provider, a package is exposed by the upstream with the highest priority
+			for name := range pr.Providers {
+				if claimed[name] || !ps.Config.IsAllowed(name) {
+					delete(pr.Providers, name)
 
-					return err
+					continue
 				}
 
-				// https://github.com/golang/go/issues/3117
-				p := providers[provider].Providers[name]
-				p.Sha256 = pi.HashTarget
-				providers[provider].Providers[name] = p
+				claimed[name] = true
 
-				return nil
-			})
-		}
+				ps.DB.View(func(tx *bolt.Tx) error {
+					b := tx.Bucket(ps.Config.Code)
+					data := b.Get([]byte(name))
 
-		// save provider file, cannot compress *yet* as we need the sha1 from the uncompressed json file.
-		data, err := json.Marshal(providers[provider])
+					pi := &PackageInformation{}
+					if err := pkgmirror.Unmarshal(data, pi); err != nil {
+						logger.WithFields(log.Fields{
+							"error": err.Error(),
+							"data":  string(data),
+							"name":  name,
+						}).Error("Error while unmarshalling provider package")
 
-		if err != nil {
-			ps.Logger.WithFields(log.Fields{
-				"provider": provider,
-				"error":    err,
-			}).Error("Unable to marshal provider information")
-		}
+						return err
+					}
+
+					if pi.Private {
+						// the private package is exposed by the private provider
+						delete(providers[provider].Providers, name)
+
+						return nil
+					}
+
+					// https://github.com/golang/go/issues/3117
+					p := providers[provider].Providers[name]
+					p.Sha256 = pi.HashTarget
+					providers[provider].Providers[name] = p
 
-		hash := sha256.Sum256(data)
+					available = append(available, name)
 
-		// https://github.com/golang/go/issues/3117
-		p := pkgResult.ProviderIncludes[provider]
-		p.Sha256 = hex.EncodeToString(hash[:])
-		pkgResult.ProviderIncludes[provider] = p
+					return nil
+				})
+			}
+
+			// save provider file, cannot compress *yet* as we need the sha1 from the uncompressed json file.
+			data, err := json.Marshal(providers[provider])
+
+			if err != nil {
+				ps.Logger.WithFields(log.Fields{
+					"provider": provider,
+					"error":    err,
+				}).Error("Unable to marshal provider information")
+			}
 
-		path := fmt.Sprintf("%s", strings.Replace(provider, "%hash%", p.Sha256, -1))
+			hash := sha256.Sum256(data)
 
-		ps.DB.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket(ps.Config.Code)
+			// https://github.com/golang/go/issues/3117
+			p := sha
+			p.Sha256 = hex.EncodeToString(hash[:])
+			providerIncludes[provider] = p
+
+			path := fmt.Sprintf("%s", strings.Replace(provider, "%hash%", p.Sha256, -1))
 
 			if data, err := pkgmirror.Marshal(providers[provider]); err != nil {
 				logger.WithError(err).Error("Unable to marshal provider data")
 
 				return err
-			} else if err := b.Put([]byte(path), data); err != nil {
-				logger.WithError(err).Error("Unable to store provider data")
-
-				return err
+			} else {
+				files[path] = data
 			}
+		}
+	}
 
-			ps.Logger.WithFields(log.Fields{
-				"provider": provider,
-				"path":     path,
-			}).Debug("Save provider")
+	pkgResult.ProviderIncludes = providerIncludes
 
-			return nil
-		})
+	for index, provider := range map[string]string{string(PRIVATE_BUCKET): PRIVATE_PROVIDER, string(INLINE_BUCKET): INLINE_PROVIDER} {
+		if names, err := ps.updateLocalProvider(pkgResult, []byte(index), provider, files); err != nil {
+			logger.WithError(err).WithField("provider", provider).Error("Unable to update the local provider")
+		} else {
+			available = append(available, names...)
+		}
 	}
 
 	//pr.ProviderIncludes = providerIncludes
 	pkgResult.ProvidersURL = fmt.Sprintf("/composer/%s/p/%%package%%$%%hash%%.json", ps.Config.Code)
+	pkgResult.MetadataURL = fmt.Sprintf("/composer/%s/p2/%%package%%.json", ps.Config.Code)
+	pkgResult.MetadataChangesURL = ""
+
+	// inline packages are exposed by the inline provider
+	pkgResult.Packages = json.RawMessage("[]")
+	pkgResult.Includes = nil
+	pkgResult.SecurityAdvisories = &SecurityAdvisoriesConfig{
+		Metadata: false,
+		ApiURL:   fmt.Sprintf("/composer/%s/api/security-advisories/", ps.Config.Code),
+	}
+
+	sort.Strings(available)
+	pkgResult.AvailablePackages = available
+	pkgResult.ProvidersLazyURL = ""
+	pkgResult.Mirrors = nil
+
+	if ps.Config.Mirrors {
+		pkgResult.Mirrors = ps.GetMirrors()
+	}
+
+	if ps.Config.Lazy {
+		// composer 2 must request any package from the metadata-url
+		pkgResult.AvailablePackages = nil
+		pkgResult.ProvidersLazyURL = fmt.Sprintf("/composer/%s/lazy/%%package%%.json", ps.Config.Code)
+	}
 	pkgResult.Notify = fmt.Sprintf("/composer/%s/downloads/%%package%%", ps.Config.Code)
 	pkgResult.NotifyBatch = fmt.Sprintf("/composer/%s/downloads", ps.Config.Code)
 	pkgResult.Search = fmt.Sprintf("/composer/%s/search.json?q=%%query%%&type=%%type%%", ps.Config.Code)
 
-	ps.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(ps.Config.Code)
-		data, _ := pkgmirror.Marshal(pkgResult)
-		b.Put([]byte("packages.json"), data)
-
-		ps.Logger.Info("Save packages.json")
+	if generation, err := ps.publish(pkgResult, files); err != nil {
+		logger.WithError(err).Error("Unable to publish the entry points")
 
-		return nil
-	})
+		return err
+	} else {
+		logger.WithField("generation", generation.ID).Info("Save packages.json")
+	}
 
 	ps.Logger.Info("End UpdateEntryPoints")
 
@@ -513,6 +733,70 @@ func (ps *ComposerService) UpdateEntryPoints() error {
 	return nil
 }
 
+// updateLocalProvider generates a provider file listing the packages referenced in the index
+// bucket (ie, private or inline packages), the provider is added to the provider-includes entry
+// of the packages.json file and to the files of the generation.
+func (ps *ComposerService) updateLocalProvider(pkgResult *PackagesResult, index []byte, provider string, files map[string][]byte) ([]string, error) {
+	pr := &ProvidersResult{
+		Providers: map[string]struct {
+			Sha256 string `json:"sha256"`
+		}{},
+	}
+
+	names := []string{}
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ps.Config.Code)
+
+		return tx.Bucket(index).ForEach(func(k, v []byte) error {
+			pi := &PackageInformation{}
+
+			if err := pkgmirror.Unmarshal(b.Get(k), pi); err != nil {
+				return nil
+			}
+
+			p := pr.Providers[pi.Package]
+			p.Sha256 = pi.HashTarget
+			pr.Providers[pi.Package] = p
+
+			names = append(names, pi.Package)
+
+			return nil
+		})
+	})
+
+	if err != nil || len(names) == 0 {
+		return names, err
+	}
+
+	sort.Strings(names)
+
+	data, err := json.Marshal(pr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(data)
+	sha := hex.EncodeToString(hash[:])
+
+	if pkgResult.ProviderIncludes == nil {
+		pkgResult.ProviderIncludes = ProviderInclude{}
+	}
+
+	p := pkgResult.ProviderIncludes[provider]
+	p.Sha256 = sha
+	pkgResult.ProviderIncludes[provider] = p
+
+	if data, err := pkgmirror.Marshal(pr); err != nil {
+		return nil, err
+	} else {
+		files[strings.Replace(provider, "%hash%", sha, -1)] = data
+	}
+
+	return names, nil
+}
+
 func (ps *ComposerService) UpdatePackage(name string) error {
 	if ps.lock {
 		return pkgmirror.SyncInProgressError
@@ -549,11 +833,19 @@ func (ps *ComposerService) UpdatePackage(name string) error {
 		return err // unknown package
 	}
 
+	if pkg.Private {
+		return pkgmirror.InvalidPackageError // nothing to reload from the upstream server
+	}
+
+	if ps.isInline(pkg.Package) {
+		return ps.updateInlinePackage(pkg)
+	}
+
 	pkg.Url = ps.getPackageUrl(pkg)
 
 	pkg.PackageResult = PackageResult{}
 
-	if err := pkgmirror.LoadRemoteStruct(pkg.Url, &pkg.PackageResult); err != nil {
+	if err := pkgmirror.LoadRemoteStructWithAuth(pkg.Url, &pkg.PackageResult, ps.Auth); err != nil {
 		logger.WithFields(log.Fields{
 			"error": err.Error(),
 			"url":   pkg.Url,
@@ -575,160 +867,203 @@ func (ps *ComposerService) UpdatePackage(name string) error {
 
 func (ps *ComposerService) savePackage(pkg *PackageInformation) error {
 	return ps.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(ps.Config.Code)
-
-		logger := ps.Logger.WithFields(log.Fields{
-			"package": pkg.Package,
-			"path":    pkg.GetTargetKey(),
-		})
+		if err := ps.recordVersions(tx, pkg); err != nil {
+			return err
+		}
 
+		// private packages already reference the mirror, the upstream urls are kept if
+		// the mirrors are advertised in the packages.json file.
 		for name := range pkg.PackageResult.Packages {
 			for _, version := range pkg.PackageResult.Packages[name] {
-				version.Dist.URL = git.GitRewriteArchive(ps.Config.PublicServer, version.Dist.URL)
-				version.Source.URL = git.GitRewriteRepository(ps.Config.PublicServer, version.Source.URL)
-			}
-		}
+				if !pkg.Private && !ps.Config.Mirrors {
+					// the protected dist files are served with the credentials, the git and static
+					// mirrors do not have them (ie: a private github repository)
+					if ps.Auth.IsProtected(version.Dist.URL) && len(version.Dist.Reference) > 0 {
+						version.Dist.URL = ps.getDistUrl(name, version)
+					} else {
+						version.Dist.URL = ps.Rewriter.RewriteArchive(version.Dist.URL)
+					}
 
-		ps.StateChan <- pkgmirror.State{
-			Message: fmt.Sprintf("Save package information: %s", pkg.Package),
-			Status:  pkgmirror.STATUS_RUNNING,
+					version.Source.URL = ps.Rewriter.RewriteRepository(version.Source.URL)
+				}
+			}
 		}
 
-		// compute hash
-		data, _ := json.Marshal(pkg.PackageResult)
-		sha := sha256.Sum256(data)
-		pkg.HashTarget = hex.EncodeToString(sha[:])
+		return ps.storePackage(tx, pkg)
+	})
+}
 
-		if data, err := pkgmirror.Compress(data); err != nil {
-			logger.WithError(err).Error("Unable to compress package data")
+// storePackage stores the package definition, the urls must already reference the mirror.
+func (ps *ComposerService) storePackage(tx *bolt.Tx, pkg *PackageInformation) error {
+	b := tx.Bucket(ps.Config.Code)
 
-			return err
-		} else if err := b.Put([]byte(pkg.GetTargetKey()), data); err != nil {
-			logger.WithError(err).Error("Error updating/creating definition")
+	logger := ps.Logger.WithFields(log.Fields{
+		"package": pkg.Package,
+	})
 
-			return err
-		} else if data, err := pkgmirror.Marshal(pkg); err != nil {
-			logger.WithError(err).Error("Unable to marshal package definition data")
+	ps.StateChan <- pkgmirror.State{
+		Message: fmt.Sprintf("Save package information: %s", pkg.Package),
+		Status:  pkgmirror.STATUS_RUNNING,
+	}
 
-			return err
-		} else if err := b.Put([]byte(pkg.Package), data); err != nil {
-			logger.WithError(err).Error("Error updating/creating hash definition")
+	// the versions waiting for an approval are not published
+	if ps.Config.Quarantine && !pkg.Private {
+		if err := ps.quarantineVersions(tx, pkg); err != nil {
+			logger.WithError(err).Error("Unable to quarantine the new versions")
 
 			return err
 		}
+	}
 
-		return nil
-	})
-}
+	// compute hash
+	data, _ := json.Marshal(pkg.PackageResult)
+	sha := sha256.Sum256(data)
+	pkg.HashTarget = hex.EncodeToString(sha[:])
 
-func (ps *ComposerService) CleanPackages() error {
+	logger = logger.WithField("path", pkg.GetTargetKey())
 
-	logger := ps.Logger.WithFields(log.Fields{
-		"action": "CleanPackages",
-	})
+	if err := ps.recordReplacedPackage(tx, pkg); err != nil {
+		logger.WithError(err).Error("Unable to record the previous definition")
 
-	logger.Info("Start cleaning ...")
+		return err
+	}
 
-	ps.StateChan <- pkgmirror.State{
-		Message: "Start cleaning packages",
-		Status:  pkgmirror.STATUS_RUNNING,
+	if data, err := pkgmirror.Compress(data); err != nil {
+		logger.WithError(err).Error("Unable to compress package data")
+
+		return err
+	} else if err := b.Put([]byte(pkg.GetTargetKey()), data); err != nil {
+		logger.WithError(err).Error("Error updating/creating definition")
+
+		return err
+	} else if data, err := pkgmirror.Marshal(pkg); err != nil {
+		logger.WithError(err).Error("Unable to marshal package definition data")
+
+		return err
+	} else if err := b.Put([]byte(pkg.Package), data); err != nil {
+		logger.WithError(err).Error("Error updating/creating hash definition")
+
+		return err
 	}
 
-	ps.DB.Batch(func(tx *bolt.Tx) error {
-		b := tx.Bucket(ps.Config.Code)
+	if err := ps.indexPackage(tx, pkg); err != nil {
+		logger.WithError(err).Error("Error updating the search index")
 
-		pkgResult := &PackagesResult{}
-		if data, err := ps.Get("packages.json"); err != nil {
-			logger.WithFields(log.Fields{
-				"error": err.Error(),
-			}).Error("Error loading packages.json")
+		return err
+	}
 
-			return err // an error occurs avoid empty file
-		} else if err := pkgmirror.Unmarshal(data, pkgResult); err != nil {
-			logger.WithFields(log.Fields{
-				"error": err.Error(),
-			}).Error("Error while decompressing packages.json")
+	return ps.saveMetadata(b, pkg)
+}
 
-			return err
-		}
+// saveMetadata stores the minified files used by the composer v2 protocol (metadata-url).
+func (ps *ComposerService) saveMetadata(b *bolt.Bucket, pkg *PackageInformation) error {
+	logger := ps.Logger.WithFields(log.Fields{
+		"package": pkg.Package,
+		"action":  "saveMetadata",
+	})
 
-		// Sample iteration over key
-		//  - drupal/a11n_code_example
-		//  - drupal/a11n_code_example$e3147979055c65820731c0ebae9a9f989f7d8a52bb3dbb036e2bdc393127528b
-		//  - drupal/a11n_code_form
-		//  - drupal/a11n_code_form$86bd5df758fbfa094e356700d0d645bc41707e57b1ee5ac471e54386687a53e7
-		//  - drupal/a11n_code_rest
-		//  - drupal/a11n_code_rest$48329b3394c64d16784baebd626797454475a560b753f29fa5c64b9fa38795fc
-		//  - drupal/a12_best_bets
-		//  - drupal/a12_best_bets$6037a7856189bf0e9b4d22a44b8587f299ca483fa31585165c52bab221050524
-		//  - drupal/a12_connect
-		//  - drupal/a12_connect$a90ba85da88bd35f0e389cc7fbca4126ede378976862d22fbb14c4505436def9
-		//  - drupal/a_hole
-		var pi *PackageInformation
-		var pr *ProvidersResult
+	stable, dev, err := NewMetadataResults(pkg.Package, pkg.PackageResult.Packages[pkg.Package])
 
-		b.ForEach(func(k, v []byte) error {
-			name := string(k)
-			if i := strings.Index(name, "$"); i > 0 { // sha1 package, ie: drupal/a11n_code_example$e3147979055c65820731c0ebae9a9f989f7d8a52bb3dbb036e2bdc393127528b
-				if pr != nil {
-					// iterate over provider list from packages.json
-					// and remove provide with no reference
-					for provider, sha := range pkgResult.ProviderIncludes {
-						// find the provider but the sha1 does not match (old one) delete
-						if name[0:i+1] == provider[0:i+1] && name[i+1:len(name)-5] != sha.Sha256 {
-							logger.WithFields(log.Fields{
-								"provider":     pr.Code,
-								"hash_target":  sha.Sha256,
-								"hash_current": name[i+1 : len(name)-5],
-							}).Info("Delete provider definition")
-
-							b.Delete(k)
-						}
-					}
-				} else if pi != nil {
-					if name[0:i] == pi.Package && pi.HashTarget != name[i+1:] {
-						logger.WithFields(log.Fields{
-							"package":      pi.Package,
-							"hash_target":  pi.HashTarget,
-							"hash_current": name[i+1:],
-						}).Info("Delete package definition")
+	if err != nil {
+		logger.WithError(err).Error("Unable to minify package versions")
 
-						b.Delete(k)
-					}
-				} else {
-					logger.WithField("key", name).Error("Orphan reference")
-				}
-			} else { // load the current active package or provider, ie: drupal/a11n_code_example
-				pr = &ProvidersResult{}
-				pi = &PackageInformation{}
+		return err
+	}
 
-				pkgmirror.Unmarshal(v, pi)
-				if len(pi.Package) > 0 {
-					// logger.WithField("package", name).Debug("Unmarshal PackageInformation")
-					pr = nil
+	for key, result := range map[string]*MetadataResult{
+		GetMetadataKey(pkg.Package, false): stable,
+		GetMetadataKey(pkg.Package, true):  dev,
+	} {
+		if data, err := pkgmirror.Marshal(result); err != nil {
+			logger.WithError(err).Error("Unable to marshal metadata")
 
-					return nil
-				}
+			return err
+		} else if err := b.Put([]byte(key), data); err != nil {
+			logger.WithError(err).WithField("path", key).Error("Error updating/creating metadata")
 
-				pkgmirror.Unmarshal(v, pr)
-				if len(pr.Code) > 0 {
-					logger.WithField("provider", name).Debug("Unmarshal ProvidersResult")
-					pi = nil
+			return err
+		}
+	}
 
-					return nil
-				}
+	return nil
+}
+
+// removeFilteredPackages deletes the mirrored packages which are not allowed anymore by the
+// include/exclude patterns, private packages are kept.
+func (ps *ComposerService) removeFilteredPackages() error {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action": "removeFilteredPackages",
+	})
+
+	return ps.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ps.Config.Code)
+
+		packages := []*PackageInformation{}
 
-				logger.WithField("key", name).Debug("Unable to unmarshal data")
+		b.ForEach(func(k, v []byte) error {
+			if strings.Contains(string(k), "$") || strings.Contains(string(k), ".json") || ps.Config.IsAllowed(string(k)) {
+				return nil
+			}
 
-				pi = nil
-				pr = nil
+			pi := &PackageInformation{}
+			if err := pkgmirror.Unmarshal(v, pi); err == nil && len(pi.Package) > 0 && !pi.Private {
+				packages = append(packages, pi)
 			}
 
 			return nil
 		})
 
+		for _, pi := range packages {
+			logger.WithField("package", pi.Package).Info("Delete filtered package")
+
+			if err := ps.deletePackage(tx, pi); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
+}
+
+// deletePackage removes the package definition, the metadata files and the search entry.
+func (ps *ComposerService) deletePackage(tx *bolt.Tx, pi *PackageInformation) error {
+	b := tx.Bucket(ps.Config.Code)
+
+	for _, key := range []string{pi.Package, pi.GetTargetKey(), GetMetadataKey(pi.Package, false), GetMetadataKey(pi.Package, true)} {
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(SEARCH_BUCKET).Delete([]byte(pi.Package))
+}
+
+func (ps *ComposerService) CleanPackages() error {
+
+	logger := ps.Logger.WithFields(log.Fields{
+		"action": "CleanPackages",
+	})
+
+	logger.Info("Start cleaning ...")
+
+	ps.StateChan <- pkgmirror.State{
+		Message: "Start cleaning packages",
+		Status:  pkgmirror.STATUS_RUNNING,
+	}
+
+	ps.removeFilteredPackages()
+
+	if report, err := ps.CollectGarbage(true); err != nil {
+		logger.WithError(err).Info("Skip cleaning, no generation available")
+	} else {
+		logger.WithFields(log.Fields{
+			"generations": report.Generations,
+			"providers":   len(report.Providers),
+			"packages":    len(report.Packages),
+			"orphans":     len(report.Orphans),
+			"bytes":       report.Bytes,
+		}).Info("End cleaning")
+	}
 
 	ps.StateChan <- pkgmirror.State{
 		Message: "End cleaning packages",
@@ -0,0 +1,175 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	ADVISORIES_BUCKET = []byte("_advisories")
+
+	ADVISORIES_CURSOR_KEY = []byte("advisories_cursor")
+)
+
+const (
+	ADVISORY_DATE_FORMAT = "2006-01-02 15:04:05"
+)
+
+// MergeAdvisories adds or replaces the advisories, using the advisoryId as identifier.
+func MergeAdvisories(current, advisories []*SecurityAdvisory) []*SecurityAdvisory {
+	merged := []*SecurityAdvisory{}
+
+	ids := map[string]bool{}
+	for _, advisory := range advisories {
+		ids[advisory.AdvisoryID] = true
+	}
+
+	for _, advisory := range current {
+		if !ids[advisory.AdvisoryID] {
+			merged = append(merged, advisory)
+		}
+	}
+
+	return append(merged, advisories...)
+}
+
+// IsUpdatedSince returns true if the advisory has been reported after the timestamp.
+func (a *SecurityAdvisory) IsUpdatedSince(since int64) bool {
+	if since <= 0 {
+		return true
+	}
+
+	reportedAt, err := time.Parse(ADVISORY_DATE_FORMAT, a.ReportedAt)
+
+	return err != nil || reportedAt.Unix() >= since
+}
+
+// SyncAdvisories loads the advisories updated since the last run from the upstream api, the
+// advisories of the packages not mirrored yet are also stored as the cursor moves forward.
+func (ps *ComposerService) SyncAdvisories() error {
+	if len(ps.AdvisoriesURL) == 0 {
+		return nil
+	}
+
+	logger := ps.Logger.WithFields(log.Fields{
+		"action": "SyncAdvisories",
+		"url":    ps.AdvisoriesURL,
+	})
+
+	ps.StateChan <- pkgmirror.State{
+		Message: "Syncing security advisories",
+		Status:  pkgmirror.STATUS_RUNNING,
+	}
+
+	var cursor int64
+
+	ps.DB.View(func(tx *bolt.Tx) error {
+		cursor, _ = strconv.ParseInt(string(tx.Bucket(META_BUCKET).Get(ADVISORIES_CURSOR_KEY)), 10, 64)
+
+		return nil
+	})
+
+	now := time.Now().Unix()
+	result := &SecurityAdvisoriesResult{}
+
+	if err := pkgmirror.LoadRemoteStructWithAuth(fmt.Sprintf("%s?updatedSince=%d", ps.AdvisoriesURL, cursor), result, ps.Auth); err != nil {
+		logger.WithError(err).Error("Error loading security advisories")
+
+		return err
+	}
+
+	err := ps.DB.Update(func(tx *bolt.Tx) error {
+		ab := tx.Bucket(ADVISORIES_BUCKET)
+
+		for name, advisories := range result.Advisories {
+			if !ps.Config.IsAllowed(name) {
+				continue
+			}
+
+			current := []*SecurityAdvisory{}
+
+			if data := ab.Get([]byte(name)); len(data) > 0 {
+				if err := json.Unmarshal(data, &current); err != nil {
+					return err
+				}
+			}
+
+			if data, err := json.Marshal(MergeAdvisories(current, advisories)); err != nil {
+				return err
+			} else if err := ab.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(META_BUCKET).Put(ADVISORIES_CURSOR_KEY, []byte(strconv.FormatInt(now, 10)))
+	})
+
+	if err != nil {
+		logger.WithError(err).Error("Unable to store security advisories")
+
+		return err
+	}
+
+	logger.WithField("packages", len(result.Advisories)).Info("Security advisories synchronized")
+
+	return nil
+}
+
+// GetAdvisories returns the advisories of the provided packages, all packages are
+// used if the list is empty.
+func (ps *ComposerService) GetAdvisories(packages []string, since int64) (*SecurityAdvisoriesResult, error) {
+	result := &SecurityAdvisoriesResult{
+		Advisories: map[string][]*SecurityAdvisory{},
+	}
+
+	add := func(name string, data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+
+		advisories := []*SecurityAdvisory{}
+
+		if err := json.Unmarshal(data, &advisories); err != nil {
+			return err
+		}
+
+		for _, advisory := range advisories {
+			if advisory.IsUpdatedSince(since) {
+				result.Advisories[name] = append(result.Advisories[name], advisory)
+			}
+		}
+
+		return nil
+	}
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		ab := tx.Bucket(ADVISORIES_BUCKET)
+
+		if len(packages) == 0 {
+			return ab.ForEach(func(k, v []byte) error {
+				return add(string(k), v)
+			})
+		}
+
+		for _, name := range packages {
+			if err := add(name, ab.Get([]byte(name))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return result, err
+}
@@ -6,14 +6,20 @@
 package composer
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/rande/goapp"
 	"github.com/rande/pkgmirror"
+	"github.com/rande/pkgmirror/mirror/git"
+	"github.com/rande/pkgmirror/mirror/static"
 	"goji.io"
 	"goji.io/pat"
 	"golang.org/x/net/context"
@@ -35,15 +41,74 @@ func ConfigureApp(config *pkgmirror.Config, l *goapp.Lifecycle) {
 
 					s := NewComposerService()
 
-					if u, err := url.Parse(conf.Server); err != nil {
+					if len(conf.Upstreams) == 0 {
+						if upstream, err := NewUpstream(conf.Server, 0); err != nil {
+							panic(err)
+						} else {
+							upstream.Credentials = conf.Credentials
+							s.Config.Upstreams = append(s.Config.Upstreams, upstream)
+						}
+					} else if conf.Credentials != nil {
+						panic(fmt.Errorf("The credentials of the composer mirror %s must be configured on its upstreams", name))
+					}
+
+					for _, u := range conf.Upstreams {
+						if upstream, err := NewUpstream(u.Server, u.Priority); err != nil {
+							panic(err)
+						} else {
+							upstream.Credentials = u.Credentials
+							s.Config.Upstreams = append(s.Config.Upstreams, upstream)
+						}
+					}
+
+					SortUpstreams(s.Config.Upstreams)
+
+					if auth, err := NewUpstreamsAuthenticator(s.Config.Upstreams); err != nil {
 						panic(err)
 					} else {
-						s.Config.BasePublicServer = fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+						s.Auth = auth
 					}
 
 					s.Config.Path = fmt.Sprintf("%s/composer", config.DataDir)
 					s.Config.PublicServer = config.PublicServer
-					s.Config.SourceServer = conf.Server
+					s.Config.SourceServer = s.Config.Upstreams[0].Server
+					s.Config.BasePublicServer = s.Config.Upstreams[0].BasePublicServer
+					s.Config.ForwardDownloads = conf.ForwardDownloads
+					s.Config.Include = conf.Include
+					s.Config.Exclude = conf.Exclude
+					s.Config.Lazy = conf.Lazy
+					s.Config.Mirrors = conf.Mirrors
+
+					if conf.Generations > 0 {
+						s.Config.Generations = conf.Generations
+					}
+
+					if len(conf.GracePeriod) > 0 {
+						if d, err := time.ParseDuration(conf.GracePeriod); err != nil {
+							panic(err)
+						} else {
+							s.Config.GracePeriod = d
+						}
+					}
+
+					s.Config.Quarantine = conf.Quarantine
+					s.Config.Tokens = map[string]string{}
+
+					for identity, value := range conf.Tokens {
+						if token, err := pkgmirror.ResolveSecret(value); err != nil {
+							panic(err)
+						} else {
+							s.Config.Tokens[identity] = token
+						}
+					}
+
+					if len(conf.QuarantineDelay) > 0 {
+						if d, err := time.ParseDuration(conf.QuarantineDelay); err != nil {
+							panic(err)
+						} else {
+							s.Config.QuarantineDelay = d
+						}
+					}
 
 					s.Config.Code = []byte(name)
 					s.Logger = logger.WithFields(log.Fields{
@@ -53,6 +118,7 @@ func ConfigureApp(config *pkgmirror.Config, l *goapp.Lifecycle) {
 					})
 					s.StateChan = pkgmirror.GetStateChannel(fmt.Sprintf("pkgmirror.composer.%s", name), app.Get("pkgmirror.channel.state").(chan pkgmirror.State))
 					s.BoltCompacter = app.Get("bolt.compacter").(*pkgmirror.BoltCompacter)
+					s.Rewriter = app.Get("pkgmirror.git.rewriter").(*git.Rewriter)
 
 					if err := s.Init(app); err != nil {
 						panic(err)
@@ -63,6 +129,33 @@ func ConfigureApp(config *pkgmirror.Config, l *goapp.Lifecycle) {
 			}(name, conf))
 		}
 
+		app.Set("pkgmirror.composer.warmer", func(app *goapp.App) interface{} {
+			wm := &Warmer{
+				PublicServer: config.PublicServer,
+				Rewriter:     app.Get("pkgmirror.git.rewriter").(*git.Rewriter),
+				Logger: logger.WithFields(log.Fields{
+					"handler": "composer",
+				}),
+				StateChan: pkgmirror.GetStateChannel("pkgmirror.composer.warmer", app.Get("pkgmirror.channel.state").(chan pkgmirror.State)),
+				Git:       map[string]*git.GitService{},
+				Static:    map[string]*static.StaticService{},
+			}
+
+			for name, conf := range config.Git {
+				if conf.Enabled {
+					wm.Git[conf.Server] = app.Get(fmt.Sprintf("pkgmirror.git.%s", name)).(*git.GitService)
+				}
+			}
+
+			for name, conf := range config.Static {
+				if conf.Enabled {
+					wm.Static[name] = app.Get(fmt.Sprintf("pkgmirror.static.%s", name)).(*static.StaticService)
+				}
+			}
+
+			return wm
+		})
+
 		return nil
 	})
 
@@ -73,6 +166,36 @@ func ConfigureApp(config *pkgmirror.Config, l *goapp.Lifecycle) {
 			http.Redirect(w, r, "/composer"+r.URL.EscapedPath(), http.StatusMovedPermanently)
 		})
 
+		mux.HandleFuncC(pat.Post("/api/composer/warm"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			lock := &ComposerLock{}
+
+			if err := json.NewDecoder(r.Body).Decode(lock); err != nil {
+				pkgmirror.SendWithHttpCode(w, 400, err.Error())
+
+				return
+			}
+
+			job := app.Get("pkgmirror.composer.warmer").(*Warmer).Start(lock)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", fmt.Sprintf("/api/composer/warm/%s", job.Id))
+			w.WriteHeader(http.StatusAccepted)
+			pkgmirror.Serialize(w, job)
+		})
+
+		mux.HandleFuncC(pat.Get("/api/composer/warm/:id"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			job, ok := app.Get("pkgmirror.composer.warmer").(*Warmer).GetJob(pat.Param(ctx, "id"))
+
+			if !ok {
+				pkgmirror.SendWithHttpCode(w, 404, pkgmirror.ResourceNotFoundError.Error())
+
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, job)
+		})
+
 		for name, conf := range config.Composer {
 			if !conf.Enabled {
 				continue
@@ -115,6 +238,352 @@ func ConfigureHttp(name string, conf *pkgmirror.ComposerConfig, app *goapp.App)
 		http.Redirect(w, r, fmt.Sprintf("/composer/%s/packages.json", name), http.StatusMovedPermanently)
 	})
 
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/composer/%s/search.json", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		perPage, _ := strconv.Atoi(r.FormValue("per_page"))
+
+		if result, err := composerService.Search(r.FormValue("q"), r.FormValue("type"), page, perPage); err != nil {
+			pkgmirror.SendWithHttpCode(w, 500, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, result)
+		}
+	})
+
+	notifyBatch := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		req := &DownloadsRequest{}
+
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			pkgmirror.SendWithHttpCode(w, 400, err.Error())
+		} else if err := composerService.RecordDownloads(req.Downloads); err != nil {
+			pkgmirror.SendWithHttpCode(w, 500, err.Error())
+		} else {
+			pkgmirror.SendWithHttpCode(w, 201, "Downloads recorded")
+		}
+	}
+
+	mux.HandleFuncC(pat.Post(fmt.Sprintf("/composer/%s/downloads", name)), notifyBatch)
+	mux.HandleFuncC(pat.Post(fmt.Sprintf("/composer/%s/downloads/", name)), notifyBatch)
+
+	mux.HandleFuncC(pat.Post(fmt.Sprintf("/composer/%s/downloads/:vendor/:package", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		download := &DownloadNotification{
+			Name:    fmt.Sprintf("%s/%s", pat.Param(ctx, "vendor"), pat.Param(ctx, "package")),
+			Version: r.FormValue("version"),
+		}
+
+		if err := composerService.RecordDownloads([]*DownloadNotification{download}); err != nil {
+			pkgmirror.SendWithHttpCode(w, 500, err.Error())
+		} else {
+			pkgmirror.SendWithHttpCode(w, 201, "Download recorded")
+		}
+	})
+
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/api/composer/%s/downloads", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		days, _ := strconv.Atoi(r.FormValue("days"))
+
+		if limit < 1 {
+			limit = 20
+		}
+
+		if summaries, err := composerService.TopDownloads(limit, days); err != nil {
+			pkgmirror.SendWithHttpCode(w, 500, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, summaries)
+		}
+	})
+
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/api/composer/%s/downloads/:vendor/:package", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if stat, err := composerService.GetDownloads(fmt.Sprintf("%s/%s", pat.Param(ctx, "vendor"), pat.Param(ctx, "package"))); err != nil {
+			pkgmirror.SendWithHttpCode(w, 404, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, stat)
+		}
+	})
+
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/api/composer/%s/generations", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if generations, err := composerService.GetGenerations(); err != nil {
+			pkgmirror.SendWithHttpCode(w, 500, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, generations)
+		}
+	})
+
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/api/composer/%s/packages/:vendor/:package", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		detail, err := composerService.GetPackageDetail(fmt.Sprintf("%s/%s", pat.Param(ctx, "vendor"), pat.Param(ctx, "package")))
+
+		if err != nil {
+			pkgmirror.SendWithHttpCode(w, 404, err.Error())
+
+			return
+		}
+
+		warmer := app.Get("pkgmirror.composer.warmer").(*Warmer)
+
+		for _, version := range detail.Versions {
+			source, dist := version.Source.URL, version.Dist.URL
+
+			if len(version.Source.Original) > 0 {
+				source, dist = version.Source.Original, version.Dist.Original
+			}
+
+			version.Source.Cached, version.Dist.Cached = warmer.IsCached(source, dist)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		pkgmirror.Serialize(w, detail)
+	})
+
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/api/composer/%s/gc", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if report, err := composerService.CollectGarbage(false); err != nil {
+			pkgmirror.SendWithHttpCode(w, 500, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, report)
+		}
+	})
+
+	mux.HandleFuncC(pat.Post(fmt.Sprintf("/api/composer/%s/gc", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if report, err := composerService.CollectGarbage(true); err != nil {
+			pkgmirror.SendWithHttpCode(w, 500, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, report)
+		}
+	})
+
+	if conf.Quarantine {
+		mux.HandleFuncC(pat.Get(fmt.Sprintf("/api/composer/%s/quarantine", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			status := r.FormValue("status")
+
+			if len(status) == 0 {
+				status = QUARANTINE_PENDING
+			} else if status == "all" {
+				status = ""
+			}
+
+			if entries, err := composerService.GetQuarantine(status); err != nil {
+				pkgmirror.SendWithHttpCode(w, 500, err.Error())
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				pkgmirror.Serialize(w, entries)
+			}
+		})
+
+		mux.HandleFuncC(pat.Get(fmt.Sprintf("/api/composer/%s/quarantine/rules", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			if rules, err := composerService.GetQuarantineRules(); err != nil {
+				pkgmirror.SendWithHttpCode(w, 500, err.Error())
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				pkgmirror.Serialize(w, rules)
+			}
+		})
+
+		// the rules and the approvals publish the versions, the identity of the token is recorded
+		mux.HandleFuncC(pat.Post(fmt.Sprintf("/api/composer/%s/quarantine/rules", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			identity, ok := composerService.Config.Authorize(r.Header.Get("Authorization"))
+
+			if !ok {
+				pkgmirror.SendWithHttpCode(w, 401, pkgmirror.UnauthorizedError.Error())
+
+				return
+			}
+
+			rule := &QuarantineRule{}
+
+			if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+				pkgmirror.SendWithHttpCode(w, 400, err.Error())
+			} else if entries, err := composerService.AddQuarantineRule(rule.Pattern, identity); err != nil {
+				pkgmirror.SendWithHttpCode(w, 400, err.Error())
+			} else {
+				if err := composerService.UpdateEntryPoints(); err != nil {
+					logger.WithError(err).Warn("The approved versions are published on the next sync")
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(201)
+				pkgmirror.Serialize(w, entries)
+			}
+		})
+
+		mux.HandleFuncC(pat.Delete(fmt.Sprintf("/api/composer/%s/quarantine/rules", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			if _, ok := composerService.Config.Authorize(r.Header.Get("Authorization")); !ok {
+				pkgmirror.SendWithHttpCode(w, 401, pkgmirror.UnauthorizedError.Error())
+
+				return
+			}
+
+			if err := composerService.DeleteQuarantineRule(r.FormValue("pattern")); err != nil {
+				pkgmirror.SendWithHttpCode(w, 404, err.Error())
+			} else {
+				pkgmirror.SendWithHttpCode(w, 200, "Rule deleted")
+			}
+		})
+
+		// all the pending versions of the package are approved if no version is provided
+		mux.HandleFuncC(pat.Post(fmt.Sprintf("/api/composer/%s/quarantine/:vendor/:package", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			identity, ok := composerService.Config.Authorize(r.Header.Get("Authorization"))
+
+			if !ok {
+				pkgmirror.SendWithHttpCode(w, 401, pkgmirror.UnauthorizedError.Error())
+
+				return
+			}
+
+			pkg := fmt.Sprintf("%s/%s", pat.Param(ctx, "vendor"), pat.Param(ctx, "package"))
+
+			if entries, err := composerService.ApproveVersion(pkg, r.FormValue("version"), identity); err != nil {
+				pkgmirror.SendWithHttpCode(w, 404, err.Error())
+			} else {
+				if err := composerService.UpdateEntryPoints(); err != nil {
+					logger.WithError(err).Warn("The approved versions are published on the next sync")
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				pkgmirror.Serialize(w, entries)
+			}
+		})
+	}
+
+	// the private packages override the upstream packages, so the uploads require a token
+	mux.HandleFuncC(pat.Post(fmt.Sprintf("/composer/%s/private", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if _, ok := composerService.Config.Authorize(r.Header.Get("Authorization")); !ok {
+			pkgmirror.SendWithHttpCode(w, 401, pkgmirror.UnauthorizedError.Error())
+
+			return
+		}
+
+		var pkg *Package
+		var err error
+
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			req := &PrivateVcsRequest{}
+
+			if err = json.NewDecoder(r.Body).Decode(req); err == nil {
+				pkg, err = composerService.AddPrivateVcs(req)
+			}
+		} else {
+			var data []byte
+
+			if data, err = ioutil.ReadAll(io.LimitReader(r.Body, PRIVATE_MAX_ARCHIVE_SIZE)); err == nil {
+				pkg, err = composerService.AddPrivateArchive(data, r.FormValue("version"))
+			}
+		}
+
+		if err != nil {
+			pkgmirror.SendWithHttpCode(w, 400, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(201)
+			pkgmirror.Serialize(w, pkg)
+		}
+	})
+
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/composer/%s/private/:vendor/:package/:file", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		file := fmt.Sprintf("%s/%s/%s", pat.Param(ctx, "vendor"), pat.Param(ctx, "package"), pat.Param(ctx, "file"))
+
+		if data, err := composerService.GetPrivateArchive(file); err != nil {
+			pkgmirror.SendWithHttpCode(w, 404, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/zip")
+			w.Write(data)
+		}
+	})
+
+	securityAdvisories := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		since, _ := strconv.ParseInt(r.Form.Get("updatedSince"), 10, 64)
+
+		if result, err := composerService.GetAdvisories(r.Form["packages[]"], since); err != nil {
+			pkgmirror.SendWithHttpCode(w, 500, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, result)
+		}
+	}
+
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/composer/%s/api/security-advisories/", name)), securityAdvisories)
+	mux.HandleFuncC(pat.Post(fmt.Sprintf("/composer/%s/api/security-advisories/", name)), securityAdvisories)
+
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/composer/%s/dists/:vendor/:package/:version/:file", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		pkg := fmt.Sprintf("%s/%s", pat.Param(ctx, "vendor"), pat.Param(ctx, "package"))
+		reference := pat.Param(ctx, "file")
+
+		if i := strings.LastIndex(reference, "."); i > 0 {
+			reference = reference[:i]
+		}
+
+		if url, err := composerService.GetMirrorDistUrl(pkg, reference); err == nil {
+			http.Redirect(w, r, url, http.StatusFound)
+		} else if err := composerService.ProxyDist(w, pkg, reference); err != nil {
+			pkgmirror.SendWithHttpCode(w, 404, err.Error())
+		}
+	})
+
+	// git requests the info/refs and git-upload-pack entry points after the repository url
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/composer/%s/git/:vendor/:package/*", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		pkg := fmt.Sprintf("%s/%s", pat.Param(ctx, "vendor"), pat.Param(ctx, "package"))
+		path := r.URL.Path[len(fmt.Sprintf("/composer/%s/git/%s/", name, pkg)):]
+		suffix := ""
+
+		if i := strings.Index(path, "/"); i > 0 {
+			path, suffix = path[:i], path[i:]
+		}
+
+		if len(r.URL.RawQuery) > 0 {
+			suffix += "?" + r.URL.RawQuery
+		}
+
+		if url, err := composerService.GetMirrorGitUrl(pkg, path); err != nil {
+			pkgmirror.SendWithHttpCode(w, 404, err.Error())
+		} else {
+			http.Redirect(w, r, url+suffix, http.StatusFound)
+		}
+	})
+
+	if conf.Lazy {
+		mux.HandleFuncC(pat.Get(fmt.Sprintf("/composer/%s/lazy/:vendor/:package", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			pkg := fmt.Sprintf("%s/%s", pat.Param(ctx, "vendor"), strings.TrimSuffix(pat.Param(ctx, "package"), ".json"))
+
+			if pi, err := composerService.GetLazyPackage(pkg); err != nil {
+				pkgmirror.SendWithHttpCode(w, 404, err.Error())
+			} else if data, err := composerService.Get(pi.GetTargetKey()); err != nil {
+				pkgmirror.SendWithHttpCode(w, 404, err.Error())
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(data)
+			}
+		})
+
+		// the metadata files of a package not requested yet are loaded on demand
+		mux.HandleFuncC(pat.Get(fmt.Sprintf("/composer/%s/p2/:vendor/:package", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			file := strings.TrimSuffix(pat.Param(ctx, "package"), ".json")
+			pkg := fmt.Sprintf("%s/%s", pat.Param(ctx, "vendor"), strings.TrimSuffix(file, "~dev"))
+			key := GetMetadataKey(pkg, strings.HasSuffix(file, "~dev"))
+
+			data, err := composerService.Get(key)
+
+			if err != nil {
+				if _, err = composerService.GetLazyPackage(pkg); err == nil {
+					data, err = composerService.Get(key)
+				}
+			}
+
+			if err != nil {
+				pkgmirror.SendWithHttpCode(w, 404, err.Error())
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(data)
+			}
+		})
+	}
+
 	mux.HandleFuncC(NewPackagePat(name), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		pkg := fmt.Sprintf("%s/%s$%s", pat.Param(ctx, "vendor"), pat.Param(ctx, "package"), pat.Param(ctx, "ref"))
 
@@ -0,0 +1,317 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	META_BUCKET = []byte("_meta")
+
+	CHANGES_CURSOR_KEY = []byte("changes_cursor")
+)
+
+const (
+	// the change feed timestamps are expressed in 1/10000 second
+	CHANGES_TIMESTAMP_UNIT = 10000
+	CHANGES_MAX_AGE        = 24 * time.Hour
+)
+
+// ExpandVersions is the reverse operation of MinifyVersions.
+func ExpandVersions(minified []map[string]json.RawMessage) ([]*Package, error) {
+	versions := make([]*Package, 0, len(minified))
+
+	current := map[string]json.RawMessage{}
+
+	for _, diff := range minified {
+		next := map[string]json.RawMessage{}
+
+		for key, value := range current {
+			next[key] = value
+		}
+
+		for key, value := range diff {
+			if string(value) == `"`+METADATA_UNSET+`"` {
+				delete(next, key)
+			} else {
+				next[key] = value
+			}
+		}
+
+		version := &Package{}
+
+		if data, err := json.Marshal(next); err != nil {
+			return nil, err
+		} else if err := json.Unmarshal(data, version); err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, version)
+		current = next
+	}
+
+	return versions, nil
+}
+
+// IsDeleted returns true if the package is removed, a package is only removed with its stable
+// file. A dev file updated in the same batch means the package is still available.
+func (c *FileChanges) IsDeleted() bool {
+	return c.Stable == "delete" && c.Dev != "update"
+}
+
+// GetChangesCursor returns the timestamp of the last change processed, 0 if none.
+func (ps *ComposerService) GetChangesCursor() int64 {
+	var cursor int64
+
+	ps.DB.View(func(tx *bolt.Tx) error {
+		cursor, _ = strconv.ParseInt(string(tx.Bucket(META_BUCKET).Get(CHANGES_CURSOR_KEY)), 10, 64)
+
+		return nil
+	})
+
+	return cursor
+}
+
+func (ps *ComposerService) setChangesCursor(cursor int64) error {
+	return ps.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(META_BUCKET).Put(CHANGES_CURSOR_KEY, []byte(strconv.FormatInt(cursor, 10)))
+	})
+}
+
+// IsChangesCursorValid returns false if the cursor is missing or too old to be used with the change feed.
+func IsChangesCursorValid(cursor int64, now time.Time) bool {
+	if cursor <= 0 {
+		return false
+	}
+
+	return now.Sub(time.Unix(cursor/CHANGES_TIMESTAMP_UNIT, 0)) < CHANGES_MAX_AGE
+}
+
+// loadChanges returns the change feed since the provided cursor, without cursor the feed
+// only returns the current timestamp.
+func (ps *ComposerService) loadChanges(url string, cursor int64) (*ChangesResult, error) {
+	changes := &ChangesResult{}
+
+	if cursor > 0 {
+		url = fmt.Sprintf("%s?since=%d", url, cursor)
+	}
+
+	if err := pkgmirror.LoadRemoteStructWithAuth(url, changes, ps.Auth); err != nil {
+		return nil, err
+	}
+
+	if changes.Timestamp == 0 {
+		return nil, pkgmirror.EmptyDataError
+	}
+
+	return changes, nil
+}
+
+// syncChanges refetches the packages listed in the upstream change feed. An error is returned
+// if the feed cannot be used, so the caller must fall back to a full provider walk.
+func (ps *ComposerService) syncChanges(packagesResult *PackagesResult) error {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action": "syncChanges",
+		"url":    packagesResult.MetadataChangesURL,
+	})
+
+	if len(packagesResult.MetadataChangesURL) == 0 || len(packagesResult.MetadataURL) == 0 {
+		return pkgmirror.ResourceNotFoundError
+	}
+
+	cursor := ps.GetChangesCursor()
+
+	if !IsChangesCursorValid(cursor, time.Now()) {
+		logger.WithField("cursor", cursor).Info("The cursor is missing or too old")
+
+		return pkgmirror.InvalidReferenceError
+	}
+
+	changes, err := ps.loadChanges(ps.getAbsoluteUrl(packagesResult.MetadataChangesURL), cursor)
+
+	if err != nil {
+		logger.WithError(err).Error("Unable to load the change feed")
+
+		return err
+	}
+
+	// the stable and the dev files are tracked separately, ie: symfony/symfony and symfony/symfony~dev
+	updates := map[string]*FileChanges{}
+
+	// the last action of a file wins
+	sort.SliceStable(changes.Actions, func(i, j int) bool {
+		return changes.Actions[i].Time < changes.Actions[j].Time
+	})
+
+	for _, action := range changes.Actions {
+		if action.Type == "resync" {
+			logger.Info("The upstream server requires a full resync")
+
+			return pkgmirror.InvalidReferenceError
+		}
+
+		if action.Type != "update" && action.Type != "delete" {
+			continue
+		}
+
+		name := strings.TrimSuffix(action.Package, "~dev")
+
+		if updates[name] == nil {
+			updates[name] = &FileChanges{}
+		}
+
+		if strings.HasSuffix(action.Package, "~dev") {
+			updates[name].Dev = action.Type
+		} else {
+			updates[name].Stable = action.Type
+		}
+	}
+
+	names := []string{}
+	for name := range updates {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	logger.WithField("packages", len(names)).Info("Apply changes")
+
+	for _, name := range names {
+		if !ps.Config.IsAllowed(name) {
+			continue
+		}
+
+		pi := &PackageInformation{
+			Server:  string(ps.Config.Code),
+			Package: name,
+		}
+
+		inline := false
+
+		ps.DB.View(func(tx *bolt.Tx) error {
+			pkgmirror.Unmarshal(tx.Bucket(ps.Config.Code).Get([]byte(name)), pi)
+
+			inline = len(tx.Bucket(INLINE_BUCKET).Get([]byte(name))) > 0
+
+			return nil
+		})
+
+		// the inline packages are loaded from the packages.json file
+		if pi.Private || inline {
+			continue
+		}
+
+		// a lazy mirror only follows the packages already requested
+		if ps.Config.Lazy && len(pi.HashTarget) == 0 {
+			continue
+		}
+
+		if updates[name].IsDeleted() {
+			if len(pi.HashTarget) > 0 {
+				logger.WithField("package", name).Info("Delete package removed upstream")
+
+				if err := ps.DB.Update(func(tx *bolt.Tx) error {
+					return ps.deleteRemovedPackage(tx, pi)
+				}); err != nil {
+					logger.WithError(err).WithField("package", name).Error("Unable to delete package")
+				}
+			}
+
+			continue
+		}
+
+		// the package is refreshed from the metadata files, a removed dev file only drops the
+		// dev versions. The source hash of the provider file is kept, a full walk only loads
+		// the package again if its provider file changed since.
+		if err := ps.loadMetadata(packagesResult.MetadataURL, pi); err != nil {
+			logger.WithError(err).WithField("package", name).Error("Error loading package metadata")
+
+			continue
+		}
+
+		ps.savePackage(pi)
+	}
+
+	return ps.setChangesCursor(changes.Timestamp)
+}
+
+// deleteRemovedPackage removes a package deleted upstream with its version records, its
+// quarantine entries and its advisories, so a package published again starts from scratch.
+func (ps *ComposerService) deleteRemovedPackage(tx *bolt.Tx, pi *PackageInformation) error {
+	if err := ps.deletePackage(tx, pi); err != nil {
+		return err
+	}
+
+	// the keys of the versions of a package share the same prefix
+	prefix := GetVersionKey(pi.Package, "")
+
+	for _, name := range [][]byte{VERSIONS_BUCKET, QUARANTINE_BUCKET} {
+		b := tx.Bucket(name)
+		keys := [][]byte{}
+
+		c := b.Cursor()
+
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Bucket(ADVISORIES_BUCKET).Delete([]byte(pi.Package))
+}
+
+// loadMetadata loads the stable and dev metadata files from the upstream server.
+func (ps *ComposerService) loadMetadata(metadataURL string, pi *PackageInformation) error {
+	pi.PackageResult = PackageResult{
+		Packages: map[string]map[string]*Package{
+			pi.Package: {},
+		},
+	}
+
+	for _, name := range []string{pi.Package, pi.Package + "~dev"} {
+		result := &MetadataResult{}
+
+		err := pkgmirror.LoadRemoteStructWithAuth(ps.getAbsoluteUrl(strings.Replace(metadataURL, "%package%", name, -1)), result, ps.Auth)
+
+		if err == pkgmirror.ResourceNotFoundError && strings.HasSuffix(name, "~dev") {
+			continue // the package has no dev version
+		} else if err != nil {
+			return err
+		}
+
+		versions, err := ExpandVersions(result.Packages[pi.Package])
+
+		if err != nil {
+			return err
+		}
+
+		for _, version := range versions {
+			pi.PackageResult.Packages[pi.Package][version.Version] = version
+		}
+	}
+
+	if len(pi.PackageResult.Packages[pi.Package]) == 0 {
+		return pkgmirror.EmptyDataError
+	}
+
+	return nil
+}
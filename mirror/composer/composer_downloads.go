@@ -0,0 +1,232 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	DOWNLOADS_BUCKET = []byte("_downloads")
+)
+
+const (
+	DOWNLOADS_HISTORY_DAYS  = 90
+	DOWNLOADS_MAX_FORWARDED = 10000
+)
+
+// Add increments the counters of the package and of the version.
+func (s *DownloadStat) Add(version string, now time.Time) {
+	if s.Versions == nil {
+		s.Versions = map[string]int{}
+	}
+
+	s.Versions[version]++
+	s.DownloadCounter.Add(1, now, DOWNLOADS_HISTORY_DAYS)
+}
+
+// RecordDownloads stores the download notifications sent by composer clients, unknown packages are ignored.
+// Only the notifications of the packages served by the primary upstream are forwarded.
+func (ps *ComposerService) RecordDownloads(downloads []*DownloadNotification) error {
+	now := time.Now()
+
+	recorded := []*DownloadNotification{}
+
+	err := ps.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ps.Config.Code)
+		db := tx.Bucket(DOWNLOADS_BUCKET)
+		ib := tx.Bucket(INLINE_BUCKET)
+
+		for _, download := range downloads {
+			if len(download.Name) == 0 {
+				continue
+			}
+
+			pi := &PackageInformation{}
+
+			if err := pkgmirror.Unmarshal(b.Get([]byte(download.Name)), pi); err != nil {
+				continue
+			}
+
+			stat := &DownloadStat{}
+
+			if data := db.Get([]byte(download.Name)); len(data) > 0 {
+				if err := json.Unmarshal(data, stat); err != nil {
+					return err
+				}
+			}
+
+			stat.Package = download.Name
+			stat.Add(download.Version, now)
+
+			if data, err := json.Marshal(stat); err != nil {
+				return err
+			} else if err := db.Put([]byte(download.Name), data); err != nil {
+				return err
+			}
+
+			// the private and inline packages, and the packages of the secondary upstreams,
+			// are unknown to the primary upstream
+			if !pi.Private && len(ib.Get([]byte(download.Name))) == 0 && ps.getUpstream(pi.Upstream) == ps.getUpstreams()[0] {
+				recorded = append(recorded, download)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if ps.Config.ForwardDownloads {
+		ps.downloadsLock.Lock()
+		ps.downloads = trimDownloads(append(ps.downloads, recorded...))
+		ps.downloadsLock.Unlock()
+	}
+
+	return nil
+}
+
+// GetDownloads returns the download statistics for one package.
+func (ps *ComposerService) GetDownloads(name string) (*DownloadStat, error) {
+	stat := &DownloadStat{}
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(DOWNLOADS_BUCKET).Get([]byte(name))
+
+		if len(data) == 0 {
+			return pkgmirror.EmptyKeyError
+		}
+
+		return json.Unmarshal(data, stat)
+	})
+
+	return stat, err
+}
+
+// TopDownloads returns the most downloaded packages over the last days, 0 means all time.
+func (ps *ComposerService) TopDownloads(limit, days int) ([]*DownloadSummary, error) {
+	now := time.Now()
+	summaries := []*DownloadSummary{}
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(DOWNLOADS_BUCKET).ForEach(func(k, v []byte) error {
+			stat := &DownloadStat{}
+
+			if err := json.Unmarshal(v, stat); err != nil {
+				return nil
+			}
+
+			summaries = append(summaries, &DownloadSummary{
+				Package:   stat.Package,
+				Total:     stat.Total,
+				Downloads: stat.Since(days, now),
+			})
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Downloads != summaries[j].Downloads {
+			return summaries[i].Downloads > summaries[j].Downloads
+		}
+
+		return summaries[i].Package < summaries[j].Package
+	})
+
+	if limit > 0 && len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+
+	return summaries, nil
+}
+
+// trimDownloads keeps the most recent notifications, so the queue is bounded.
+func trimDownloads(downloads []*DownloadNotification) []*DownloadNotification {
+	if len(downloads) > DOWNLOADS_MAX_FORWARDED {
+		return downloads[len(downloads)-DOWNLOADS_MAX_FORWARDED:]
+	}
+
+	return downloads
+}
+
+// ForwardDownloads sends the pending notifications to the upstream notify-batch url, so
+// the statistics of the upstream repository stay accurate.
+func (ps *ComposerService) ForwardDownloads() error {
+	if !ps.Config.ForwardDownloads || len(ps.NotifyBatchURL) == 0 {
+		return nil
+	}
+
+	ps.downloadsLock.Lock()
+	downloads := ps.downloads
+	ps.downloads = nil
+	ps.downloadsLock.Unlock()
+
+	if len(downloads) == 0 {
+		return nil
+	}
+
+	logger := ps.Logger.WithFields(log.Fields{
+		"action":    "ForwardDownloads",
+		"url":       ps.NotifyBatchURL,
+		"downloads": len(downloads),
+	})
+
+	data, err := json.Marshal(&DownloadsRequest{Downloads: downloads})
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", ps.NotifyBatchURL, bytes.NewBuffer(data))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ps.Auth.Do(req)
+
+	if err == nil {
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			logger = logger.WithField("status", resp.StatusCode)
+			err = pkgmirror.HttpError
+		}
+	}
+
+	if err != nil {
+		logger.WithError(err).Error("Unable to forward downloads")
+
+		// keep the notifications for the next run, the oldest are dropped if the upstream
+		// stays unavailable
+		ps.downloadsLock.Lock()
+		ps.downloads = trimDownloads(append(downloads, ps.downloads...))
+		ps.downloadsLock.Unlock()
+
+		return err
+	}
+
+	logger.Info("Downloads forwarded")
+
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+// GetMetadataPackage returns the package of a metadata key, ie: p2/symfony/symfony~dev.json => symfony/symfony
+func GetMetadataPackage(key string) string {
+	if !strings.HasPrefix(key, "p2/") || !strings.HasSuffix(key, ".json") {
+		return ""
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(key[3:], ".json"), "~dev")
+}
+
+// CollectGarbage reports the provider files and package definitions not referenced by the
+// retained generations, and the orphan keys left by deleted packages. The keys are deleted
+// only if apply is true, otherwise the database is not altered.
+func (ps *ComposerService) CollectGarbage(apply bool) (*GCReport, error) {
+	report := &GCReport{
+		Applied:   apply,
+		Providers: []string{},
+		Packages:  []string{},
+		Orphans:   []string{},
+	}
+
+	collect := func(tx *bolt.Tx) error {
+		return ps.collectGarbage(tx, report)
+	}
+
+	var err error
+
+	if apply {
+		err = ps.DB.Update(collect)
+	} else {
+		err = ps.DB.View(collect)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func (ps *ComposerService) collectGarbage(tx *bolt.Tx, report *GCReport) error {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action": "collectGarbage",
+		"apply":  report.Applied,
+	})
+
+	b := tx.Bucket(ps.Config.Code)
+	hb := tx.Bucket(HISTORY_BUCKET)
+	now := time.Now()
+
+	// the files referenced by the retained generations are kept
+	providers, oldest, expired, err := ps.collectGenerations(tx, now, report.Applied)
+
+	if err != nil {
+		return err
+	}
+
+	report.Generations = expired
+
+	// Sample iteration over key
+	//  - drupal/a11n_code_example
+	//  - drupal/a11n_code_example$e3147979055c65820731c0ebae9a9f989f7d8a52bb3dbb036e2bdc393127528b
+	//  - drupal/a11n_code_form
+	//  - drupal/a11n_code_form$86bd5df758fbfa094e356700d0d645bc41707e57b1ee5ac471e54386687a53e7
+	//  - p/provider-latest$09fc55f7e0e166e7a96d9d07460f87b88fd1aa78ba8bd4454c3c9e953d7e3253.json
+	//  - p2/drupal/a11n_code_form.json
+	var pi *PackageInformation
+
+	keys := [][]byte{}
+
+	remove := func(k, v []byte, list *[]string) {
+		*list = append(*list, string(k))
+		report.Bytes += int64(len(k) + len(v))
+		keys = append(keys, append([]byte{}, k...))
+	}
+
+	b.ForEach(func(k, v []byte) error {
+		name := string(k)
+		i := strings.Index(name, "$")
+
+		if i <= 0 {
+			// the metadata files of a deleted package, ie: p2/drupal/a11n_code_form.json
+			if pkg := GetMetadataPackage(name); len(pkg) > 0 {
+				if len(b.Get([]byte(pkg))) == 0 {
+					remove(k, v, &report.Orphans)
+				}
+
+				return nil
+			}
+
+			// load the current active package, ie: drupal/a11n_code_example
+			pi = &PackageInformation{}
+
+			if err := pkgmirror.Unmarshal(v, pi); err != nil || len(pi.Package) == 0 {
+				pi = nil
+			}
+
+			return nil
+		}
+
+		if strings.HasSuffix(name, ".json") { // provider file, ie: p/provider-latest$09fc55f7...json
+			if !providers[name] {
+				remove(k, v, &report.Providers)
+			}
+
+			return nil
+		}
+
+		if pi == nil || name[0:i] != pi.Package {
+			// the definition of a deleted package
+			if len(b.Get([]byte(name[0:i]))) == 0 {
+				remove(k, v, &report.Orphans)
+			} else {
+				logger.WithField("key", name).Error("Unexpected reference")
+			}
+
+			return nil
+		}
+
+		if pi.HashTarget == name[i+1:] {
+			return nil
+		}
+
+		replacedAt, err := strconv.ParseInt(string(hb.Get(k)), 10, 64)
+
+		if err != nil {
+			if !report.Applied {
+				return nil
+			}
+
+			// replaced before the history was recorded, the definition is collected later
+			return hb.Put(k, []byte(strconv.FormatInt(now.Unix(), 10)))
+		}
+
+		// the definition is not referenced by the retained generations
+		if time.Unix(replacedAt, 0).Before(oldest) {
+			remove(k, v, &report.Packages)
+		}
+
+		return nil
+	})
+
+	if !report.Applied {
+		return nil
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+
+		if err := hb.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	GENERATIONS_BUCKET = []byte("_generations")
+	HISTORY_BUCKET     = []byte("_history")
+)
+
+const (
+	DEFAULT_GENERATIONS  = 3
+	DEFAULT_GRACE_PERIOD = time.Hour
+)
+
+// GetGenerationKey returns the key of a generation, the keys are sorted by id.
+func GetGenerationKey(id uint64) []byte {
+	return []byte(fmt.Sprintf("%020d", id))
+}
+
+// ExpiredGenerations returns the number of generations to collect, the generations are sorted
+// from the oldest to the current one. The last generations and the generations superseded
+// during the grace period are retained.
+func ExpiredGenerations(generations []*Generation, retain int, grace time.Duration, now time.Time) int {
+	if retain < 1 {
+		retain = 1
+	}
+
+	expired := 0
+
+	for i := 0; i < len(generations)-retain; i++ {
+		// a client might still use the generation if it has been superseded recently
+		if now.Sub(generations[i+1].CreatedAt) < grace {
+			break
+		}
+
+		expired = i + 1
+	}
+
+	return expired
+}
+
+// publish stores the provider files, the packages.json file and the generation in a single
+// transaction, so a client never sees a packages.json file referencing missing providers.
+func (ps *ComposerService) publish(pkgResult *PackagesResult, files map[string][]byte) (*Generation, error) {
+	generation := &Generation{
+		CreatedAt: time.Now(),
+		Providers: []string{},
+	}
+
+	for path := range files {
+		generation.Providers = append(generation.Providers, path)
+	}
+
+	sort.Strings(generation.Providers)
+
+	err := ps.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ps.Config.Code)
+		gb := tx.Bucket(GENERATIONS_BUCKET)
+
+		for path, data := range files {
+			if err := b.Put([]byte(path), data); err != nil {
+				return err
+			}
+		}
+
+		if data, err := pkgmirror.Marshal(pkgResult); err != nil {
+			return err
+		} else if err := b.Put([]byte("packages.json"), data); err != nil {
+			return err
+		}
+
+		id, err := gb.NextSequence()
+
+		if err != nil {
+			return err
+		}
+
+		generation.ID = id
+
+		if data, err := json.Marshal(generation); err != nil {
+			return err
+		} else {
+			return gb.Put(GetGenerationKey(id), data)
+		}
+	})
+
+	return generation, err
+}
+
+// GetGenerations returns the generations, from the oldest to the current one.
+func (ps *ComposerService) GetGenerations() ([]*Generation, error) {
+	generations := []*Generation{}
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		var err error
+
+		generations, err = ps.loadGenerations(tx)
+
+		return err
+	})
+
+	return generations, err
+}
+
+func (ps *ComposerService) loadGenerations(tx *bolt.Tx) ([]*Generation, error) {
+	generations := []*Generation{}
+
+	err := tx.Bucket(GENERATIONS_BUCKET).ForEach(func(k, v []byte) error {
+		generation := &Generation{}
+
+		if err := json.Unmarshal(v, generation); err != nil {
+			return err
+		}
+
+		generations = append(generations, generation)
+
+		return nil
+	})
+
+	return generations, err
+}
+
+// collectGenerations deletes the expired generations if apply is true, and returns the provider
+// files referenced by the retained generations, the creation date of the oldest retained
+// generation and the number of expired generations.
+func (ps *ComposerService) collectGenerations(tx *bolt.Tx, now time.Time, apply bool) (map[string]bool, time.Time, int, error) {
+	generations, err := ps.loadGenerations(tx)
+
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+
+	if len(generations) == 0 {
+		return nil, time.Time{}, 0, pkgmirror.EmptyDataError
+	}
+
+	expired := ExpiredGenerations(generations, ps.Config.Generations, ps.Config.GracePeriod, now)
+
+	for _, generation := range generations[:expired] {
+		if !apply {
+			break
+		}
+
+		if err := tx.Bucket(GENERATIONS_BUCKET).Delete(GetGenerationKey(generation.ID)); err != nil {
+			return nil, time.Time{}, 0, err
+		}
+	}
+
+	providers := map[string]bool{}
+
+	for _, generation := range generations[expired:] {
+		for _, path := range generation.Providers {
+			providers[path] = true
+		}
+	}
+
+	return providers, generations[expired].CreatedAt, expired, nil
+}
+
+// recordReplacedPackage keeps the date a package definition has been replaced, the definition
+// is deleted once no retained generation references it.
+func (ps *ComposerService) recordReplacedPackage(tx *bolt.Tx, pkg *PackageInformation) error {
+	current := &PackageInformation{}
+
+	if err := pkgmirror.Unmarshal(tx.Bucket(ps.Config.Code).Get([]byte(pkg.Package)), current); err != nil {
+		return nil // new package
+	}
+
+	if len(current.HashTarget) == 0 || current.HashTarget == pkg.HashTarget {
+		return nil
+	}
+
+	return tx.Bucket(HISTORY_BUCKET).Put([]byte(current.GetTargetKey()), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+}
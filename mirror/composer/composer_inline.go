@@ -0,0 +1,247 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	INLINE_BUCKET = []byte("_inline")
+
+	INLINE_PROVIDER = "p/provider-inline$%hash%.json"
+)
+
+// GetInlinePackages decodes the packages listed in a packages.json or an include file,
+// the empty list ("packages": []) used by repositories relying on providers is ignored.
+func GetInlinePackages(raw json.RawMessage) (map[string]map[string]*Package, error) {
+	packages := map[string]map[string]*Package{}
+
+	if len(raw) == 0 || raw[0] != '{' {
+		return packages, nil
+	}
+
+	if err := json.Unmarshal(raw, &packages); err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+// loadInlinePackages returns the packages defined in the packages.json file and in the include files,
+// the include files are relative to the upstream listing them.
+func (ps *ComposerService) loadInlinePackages(upstream *Upstream, packagesResult *PackagesResult) (map[string]map[string]*Package, error) {
+	packages, err := GetInlinePackages(packagesResult.Packages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for include := range packagesResult.Includes {
+		result := &PackagesResult{}
+
+		if err := pkgmirror.LoadRemoteStructWithAuth(fmt.Sprintf("%s/%s", upstream.Server, include), result, ps.Auth); err != nil {
+			return nil, err
+		}
+
+		included, err := GetInlinePackages(result.Packages)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for name, versions := range included {
+			if packages[name] == nil {
+				packages[name] = map[string]*Package{}
+			}
+
+			for version, pkg := range versions {
+				packages[name][version] = pkg
+			}
+		}
+	}
+
+	return packages, nil
+}
+
+// collectInlinePackages returns the inline packages of the upstreams, a package listed by several
+// upstreams is loaded from the upstream with the highest priority.
+func (ps *ComposerService) collectInlinePackages(upstreams []*Upstream, results []*PackagesResult) (map[string]*InlinePackage, error) {
+	inline := map[string]*InlinePackage{}
+
+	for index, upstream := range upstreams {
+		packages, err := ps.loadInlinePackages(upstream, results[index])
+
+		if err != nil {
+			return nil, err
+		}
+
+		for name, versions := range packages {
+			if _, ok := inline[name]; ok || !ps.Config.IsAllowed(name) {
+				continue
+			}
+
+			inline[name] = &InlinePackage{
+				Upstream: upstream,
+				Index:    index,
+				Versions: versions,
+			}
+		}
+	}
+
+	return inline, nil
+}
+
+// newInlinePackage returns the package information of an inline package, the source hash is
+// computed from the versions as the upstream does not provide one.
+func (ps *ComposerService) newInlinePackage(name string, upstream *Upstream, versions map[string]*Package) *PackageInformation {
+	pi := &PackageInformation{
+		Server:   string(ps.Config.Code),
+		Package:  name,
+		Upstream: upstream.Server,
+		PackageResult: PackageResult{
+			Packages: map[string]map[string]*Package{
+				name: versions,
+			},
+		},
+	}
+
+	data, _ := json.Marshal(pi.PackageResult)
+	hash := sha256.Sum256(data)
+	pi.HashSource = hex.EncodeToString(hash[:])
+
+	return pi
+}
+
+// syncInlinePackages stores the packages listed inline by repositories like Satis or Toran, the
+// packages are then exposed by the inline provider. The packages removed from the inline list are
+// deleted, unless they are now loaded from a provider.
+func (ps *ComposerService) syncInlinePackages(inline map[string]*InlinePackage, claimed map[string]bool) error {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action": "syncInlinePackages",
+	})
+
+	if len(inline) > 0 {
+		logger.WithField("packages", len(inline)).Info("Sync inline packages")
+	}
+
+	for name, ip := range inline {
+		pi := ps.newInlinePackage(name, ip.Upstream, ip.Versions)
+
+		ps.DB.View(func(tx *bolt.Tx) error {
+			current := &PackageInformation{}
+
+			if err := pkgmirror.Unmarshal(tx.Bucket(ps.Config.Code).Get([]byte(name)), current); err == nil {
+				pi.Exist = current.HashSource == pi.HashSource && current.Upstream == pi.Upstream
+				pi.Private = current.Private
+			}
+
+			return nil
+		})
+
+		if pi.Private {
+			delete(inline, name)
+
+			continue
+		}
+
+		if pi.Exist {
+			continue
+		}
+
+		logger.WithField("package", name).Info("Add/Update inline package")
+
+		if err := ps.savePackage(pi); err != nil {
+			logger.WithError(err).WithField("package", name).Error("Unable to save inline package")
+		}
+	}
+
+	// update the index, packages removed upstream are deleted
+	return ps.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ps.Config.Code)
+		ib := tx.Bucket(INLINE_BUCKET)
+
+		removed := [][]byte{}
+
+		ib.ForEach(func(k, v []byte) error {
+			if _, ok := inline[string(k)]; !ok {
+				removed = append(removed, k)
+			}
+
+			return nil
+		})
+
+		for _, k := range removed {
+			pi := &PackageInformation{}
+
+			if err := pkgmirror.Unmarshal(b.Get(k), pi); err == nil && !pi.Private && !claimed[pi.Package] {
+				logger.WithField("package", pi.Package).Info("Delete inline package")
+
+				if err := ps.deletePackage(tx, pi); err != nil {
+					return err
+				}
+			}
+
+			if err := ib.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for name := range inline {
+			if err := ib.Put([]byte(name), []byte("1")); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// updateInlinePackage reloads an inline package from the packages.json file of its upstream, the
+// inline packages have no provider file.
+func (ps *ComposerService) updateInlinePackage(pi *PackageInformation) error {
+	upstream := ps.getUpstream(pi.Upstream)
+
+	results, err := ps.loadUpstreams([]*Upstream{upstream})
+
+	if err != nil {
+		return err
+	}
+
+	packages, err := ps.loadInlinePackages(upstream, results[0])
+
+	if err != nil {
+		return err
+	}
+
+	versions, ok := packages[pi.Package]
+
+	if !ok {
+		return pkgmirror.ResourceNotFoundError
+	}
+
+	return ps.savePackage(ps.newInlinePackage(pi.Package, upstream, versions))
+}
+
+// isInline returns true if the package is listed inline by an upstream.
+func (ps *ComposerService) isInline(name string) bool {
+	inline := false
+
+	ps.DB.View(func(tx *bolt.Tx) error {
+		inline = len(tx.Bucket(INLINE_BUCKET).Get([]byte(name))) > 0
+
+		return nil
+	})
+
+	return inline
+}
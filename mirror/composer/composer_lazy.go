@@ -0,0 +1,250 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+const (
+	LAZY_MISSING_TTL = 5 * time.Minute
+)
+
+// GetLazyPackage returns the stored package, the package is loaded from the upstreams on
+// the first request. The concurrent requests for the same package share the same load, and
+// a package not available upstream is not requested again before LAZY_MISSING_TTL.
+func (ps *ComposerService) GetLazyPackage(name string) (*PackageInformation, error) {
+	if pi, err := ps.GetPackage(name); err == nil {
+		return pi, nil
+	}
+
+	ps.lazyLock.Lock()
+
+	if ps.lazyCalls == nil {
+		ps.lazyCalls = map[string]*lazyCall{}
+		ps.lazyMissing = map[string]time.Time{}
+	}
+
+	if call, ok := ps.lazyCalls[name]; ok {
+		ps.lazyLock.Unlock()
+
+		call.wg.Wait()
+
+		return call.pi, call.err
+	}
+
+	if missing, ok := ps.lazyMissing[name]; ok && time.Since(missing) < LAZY_MISSING_TTL {
+		ps.lazyLock.Unlock()
+
+		return nil, pkgmirror.ResourceNotFoundError
+	}
+
+	call := &lazyCall{}
+	call.wg.Add(1)
+	ps.lazyCalls[name] = call
+
+	ps.lazyLock.Unlock()
+
+	call.pi, call.err = ps.LoadLazyPackage(name)
+
+	ps.lazyLock.Lock()
+
+	delete(ps.lazyCalls, name)
+
+	if call.err == pkgmirror.ResourceNotFoundError {
+		ps.lazyMissing[name] = time.Now()
+	} else {
+		delete(ps.lazyMissing, name)
+	}
+
+	ps.lazyLock.Unlock()
+
+	call.wg.Done()
+
+	return call.pi, call.err
+}
+
+// LoadLazyPackage fetches the package from the first upstream providing it, using the
+// metadata-url or the providers-lazy-url entry point, and stores it. The stored package is
+// kept if the upstream version has the same hash. ResourceNotFoundError is returned only if
+// the package is not available on any upstream.
+func (ps *ComposerService) LoadLazyPackage(name string) (*PackageInformation, error) {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action":  "LoadLazyPackage",
+		"package": name,
+	})
+
+	if strings.Count(name, "/") != 1 || !ps.Config.IsAllowed(name) {
+		return nil, pkgmirror.InvalidPackageError
+	}
+
+	upstreams, err := ps.getLoadedUpstreams()
+
+	if err != nil {
+		return nil, err
+	}
+
+	missing := pkgmirror.ResourceNotFoundError
+
+	for _, upstream := range upstreams {
+		pi := &PackageInformation{
+			Server:   string(ps.Config.Code),
+			Package:  name,
+			Upstream: upstream.Server,
+		}
+
+		if err := ps.loadLazyPackage(upstream, pi); err != nil {
+			logger.WithError(err).WithField("server", upstream.Server).Debug("Package not available")
+
+			if err != pkgmirror.ResourceNotFoundError && err != pkgmirror.EmptyDataError {
+				missing = err // the upstream may be down
+			}
+
+			continue
+		}
+
+		data, _ := json.Marshal(pi.PackageResult)
+		hash := sha256.Sum256(data)
+		pi.HashSource = hex.EncodeToString(hash[:])
+
+		if current, err := ps.GetPackage(name); err == nil && current.HashSource == pi.HashSource && current.Upstream == pi.Upstream {
+			return current, nil
+		}
+
+		if err := ps.savePackage(pi); err != nil {
+			logger.WithError(err).Error("Unable to save package")
+
+			return nil, err
+		}
+
+		logger.WithField("server", upstream.Server).Info("Package loaded")
+
+		return pi, nil
+	}
+
+	return nil, missing
+}
+
+// getLoadedUpstreams returns a copy of the upstreams, the entry points are unknown until
+// the first synchronization so they are loaded on the first call.
+func (ps *ComposerService) getLoadedUpstreams() ([]*Upstream, error) {
+	ps.upstreamsLock.Lock()
+	upstreams := ps.getUpstreams()
+	loaded := upstreams[0].loaded
+	ps.upstreamsLock.Unlock()
+
+	if !loaded {
+		if _, err := ps.loadUpstreams(upstreams); err != nil {
+			return nil, err
+		}
+	}
+
+	ps.upstreamsLock.Lock()
+	defer ps.upstreamsLock.Unlock()
+
+	copies := []*Upstream{}
+
+	for _, upstream := range upstreams {
+		u := *upstream
+		copies = append(copies, &u)
+	}
+
+	return copies, nil
+}
+
+func (ps *ComposerService) loadLazyPackage(upstream *Upstream, pi *PackageInformation) error {
+	if len(upstream.MetadataURL) > 0 {
+		return ps.loadMetadata(upstream.GetAbsoluteUrl(upstream.MetadataURL), pi)
+	}
+
+	if len(upstream.ProvidersLazyURL) == 0 {
+		return pkgmirror.ResourceNotFoundError
+	}
+
+	url := upstream.GetAbsoluteUrl(strings.Replace(upstream.ProvidersLazyURL, "%package%", pi.Package, -1))
+
+	if err := pkgmirror.LoadRemoteStructWithAuth(url, &pi.PackageResult, ps.Auth); err != nil {
+		return err
+	}
+
+	if len(pi.PackageResult.Packages[pi.Package]) == 0 {
+		return pkgmirror.EmptyDataError
+	}
+
+	return nil
+}
+
+// refreshLazyPackages reloads the packages requested by the clients, the private and inline
+// packages are handled by their own workflow. With a single upstream the change feed is used,
+// otherwise the packages are loaded again and only saved if the source hash changed.
+func (ps *ComposerService) refreshLazyPackages(upstreams []*Upstream, packagesResult *PackagesResult) error {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action": "refreshLazyPackages",
+	})
+
+	// keep the current position of the change feed, so the next refresh can be incremental
+	var changes *ChangesResult
+
+	if len(upstreams) == 1 {
+		if err := ps.syncChanges(packagesResult); err == nil {
+			logger.Info("Requested packages updated from the change feed")
+
+			return nil
+		}
+
+		if len(packagesResult.MetadataChangesURL) > 0 {
+			changes, _ = ps.loadChanges(ps.getAbsoluteUrl(packagesResult.MetadataChangesURL), 0)
+		}
+	}
+
+	names := []string{}
+
+	ps.DB.View(func(tx *bolt.Tx) error {
+		inline := tx.Bucket(INLINE_BUCKET)
+
+		return tx.Bucket(ps.Config.Code).ForEach(func(k, v []byte) error {
+			if strings.Contains(string(k), "$") || strings.Contains(string(k), ".json") || len(inline.Get(k)) > 0 {
+				return nil
+			}
+
+			pi := &PackageInformation{}
+			if err := pkgmirror.Unmarshal(v, pi); err == nil && len(pi.Package) > 0 && !pi.Private {
+				names = append(names, pi.Package)
+			}
+
+			return nil
+		})
+	})
+
+	logger.WithField("packages", len(names)).Info("Refresh requested packages")
+
+	for i, name := range names {
+		ps.StateChan <- pkgmirror.State{
+			Message: fmt.Sprintf("Refresh %s (%d/%d)", name, i+1, len(names)),
+			Status:  pkgmirror.STATUS_RUNNING,
+		}
+
+		// the stored version is kept if the package is not available anymore
+		if _, err := ps.LoadLazyPackage(name); err != nil {
+			logger.WithError(err).WithField("package", name).Warn("Unable to refresh package")
+		}
+	}
+
+	if changes != nil {
+		return ps.setChangesCursor(changes.Timestamp)
+	}
+
+	return nil
+}
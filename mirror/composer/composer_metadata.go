@@ -0,0 +1,131 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	METADATA_MINIFIED = "composer/2.0"
+	METADATA_UNSET    = "__unset"
+)
+
+// IsDevVersion returns true if the version is a branch alias, ie: dev-master or 2.8.x-dev.
+// Composer v2 serves those versions in a dedicated ~dev.json file.
+func IsDevVersion(version string) bool {
+	return strings.HasPrefix(version, "dev-") || strings.HasSuffix(version, "-dev")
+}
+
+// GetMetadataKey returns the key used to store the composer v2 metadata file,
+// ie: p2/symfony/framework-standard-edition.json or p2/symfony/framework-standard-edition~dev.json
+func GetMetadataKey(name string, dev bool) string {
+	if dev {
+		return fmt.Sprintf("p2/%s~dev.json", name)
+	}
+
+	return fmt.Sprintf("p2/%s.json", name)
+}
+
+// SortVersions orders versions from the most recent to the oldest one, this is the
+// order used by packagist.org when it generates the v2 metadata files.
+func SortVersions(versions map[string]*Package) []*Package {
+	list := make([]*Package, 0, len(versions))
+
+	for name, version := range versions {
+		if len(version.Version) == 0 {
+			version.Version = name
+		}
+
+		list = append(list, version)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Time.Equal(list[j].Time) {
+			return list[i].Time.After(list[j].Time)
+		}
+
+		return list[i].Version > list[j].Version
+	})
+
+	return list
+}
+
+// MinifyVersions generates the minified representation used by the composer v2 protocol: the first
+// version is complete, the next ones only contain the keys which differ from the previous version.
+// Removed keys are flagged with the __unset value.
+func MinifyVersions(versions []*Package) ([]map[string]json.RawMessage, error) {
+	minified := make([]map[string]json.RawMessage, 0, len(versions))
+
+	var previous map[string]json.RawMessage
+
+	for _, version := range versions {
+		current := map[string]json.RawMessage{}
+
+		if data, err := json.Marshal(version); err != nil {
+			return nil, err
+		} else if err := json.Unmarshal(data, &current); err != nil {
+			return nil, err
+		}
+
+		if previous == nil {
+			minified = append(minified, current)
+			previous = current
+
+			continue
+		}
+
+		diff := map[string]json.RawMessage{}
+
+		for key, value := range current {
+			if prev, ok := previous[key]; !ok || !bytes.Equal(prev, value) {
+				diff[key] = value
+			}
+		}
+
+		for key := range previous {
+			if _, ok := current[key]; !ok {
+				diff[key] = json.RawMessage(`"` + METADATA_UNSET + `"`)
+			}
+		}
+
+		minified = append(minified, diff)
+		previous = current
+	}
+
+	return minified, nil
+}
+
+// NewMetadataResults splits the package's versions into the stable and the dev metadata files.
+func NewMetadataResults(name string, versions map[string]*Package) (stable *MetadataResult, dev *MetadataResult, err error) {
+	stableVersions := []*Package{}
+	devVersions := []*Package{}
+
+	for _, version := range SortVersions(versions) {
+		if IsDevVersion(version.Version) {
+			devVersions = append(devVersions, version)
+		} else {
+			stableVersions = append(stableVersions, version)
+		}
+	}
+
+	stable = &MetadataResult{Packages: map[string][]map[string]json.RawMessage{}, Minified: METADATA_MINIFIED}
+	dev = &MetadataResult{Packages: map[string][]map[string]json.RawMessage{}, Minified: METADATA_MINIFIED}
+
+	if stable.Packages[name], err = MinifyVersions(stableVersions); err != nil {
+		return nil, nil, err
+	}
+
+	if dev.Packages[name], err = MinifyVersions(devVersions); err != nil {
+		return nil, nil, err
+	}
+
+	return stable, dev, nil
+}
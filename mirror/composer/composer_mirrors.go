@@ -0,0 +1,224 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+	"github.com/rande/pkgmirror/mirror/git"
+)
+
+var (
+	MIRROR_URL_CHARS = regexp.MustCompile(`(?i)[^a-z0-9_.-]`)
+	MIRROR_REFERENCE = regexp.MustCompile(`^[a-f0-9]*$`)
+)
+
+// NormalizeMirrorUrl returns the %normalizedUrl% value used by composer in the git-url
+// mirror template, ie: https://github.com/rande/pkgmirror.git => https---github.com-rande-pkgmirror.git
+func NormalizeMirrorUrl(url string) string {
+	return MIRROR_URL_CHARS.ReplaceAllString(strings.Trim(url, "/"), "-")
+}
+
+// IsMirrorReference returns true if the dist reference matches the %reference% value sent
+// by composer, a reference containing other characters than an hexadecimal hash is hashed with md5.
+func IsMirrorReference(reference, value string) bool {
+	if reference == value {
+		return true
+	}
+
+	sum := md5.Sum([]byte(reference))
+
+	return hex.EncodeToString(sum[:]) == value
+}
+
+// GetMirrors returns the mirrors advertised in the packages.json file.
+func (ps *ComposerService) GetMirrors() []*Mirror {
+	return []*Mirror{
+		{DistURL: fmt.Sprintf("%s/composer/%s/dists/%%package%%/%%version%%/%%reference%%.%%type%%", ps.Config.PublicServer, ps.Config.Code), Preferred: true},
+		{GitURL: fmt.Sprintf("%s/composer/%s/git/%%package%%/%%normalizedUrl%%", ps.Config.PublicServer, ps.Config.Code), Preferred: true},
+	}
+}
+
+func (ps *ComposerService) getPackageVersions(name string) (map[string]*Package, error) {
+	pi, err := ps.GetPackage(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ps.Get(pi.GetTargetKey())
+
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &PackageResult{}
+
+	if err := pkgmirror.Unmarshal(data, pr); err != nil {
+		return nil, err
+	}
+
+	return pr.Packages[name], nil
+}
+
+// getDistVersion returns the version matching the %reference% placeholder.
+func (ps *ComposerService) getDistVersion(name, reference string) (*Package, error) {
+	versions, err := ps.getPackageVersions(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versions {
+		if len(version.Dist.Reference) > 0 && IsMirrorReference(version.Dist.Reference, reference) {
+			version.Dist.URL = ps.getUpstreamDistUrl(name, version)
+
+			return version, nil
+		}
+	}
+
+	return nil, pkgmirror.InvalidReferenceError
+}
+
+// getUpstreamDistUrl returns the upstream url of the dist file, the stored url is rewritten
+// unless the mirrors are advertised.
+func (ps *ComposerService) getUpstreamDistUrl(name string, version *Package) string {
+	url := version.Dist.URL
+
+	ps.DB.View(func(tx *bolt.Tx) error {
+		record := &VersionRecord{}
+
+		if err := json.Unmarshal(tx.Bucket(VERSIONS_BUCKET).Get(GetVersionKey(name, version.Version)), record); err == nil && len(record.DistURL) > 0 {
+			url = record.DistURL
+		}
+
+		return nil
+	})
+
+	return url
+}
+
+// getDistUrl returns the dist entry point of the version, the values are encoded like the
+// composer placeholders.
+func (ps *ComposerService) getDistUrl(name string, version *Package) string {
+	normalized, reference := version.VersionNormalized, version.Dist.Reference
+
+	if strings.Contains(normalized, "/") || len(normalized) == 0 {
+		sum := md5.Sum([]byte(version.Version))
+		normalized = hex.EncodeToString(sum[:])
+	}
+
+	if !MIRROR_REFERENCE.MatchString(reference) {
+		sum := md5.Sum([]byte(reference))
+		reference = hex.EncodeToString(sum[:])
+	}
+
+	return fmt.Sprintf("%s/composer/%s/dists/%s/%s/%s.%s", ps.Config.PublicServer, ps.Config.Code, name, normalized, reference, version.Dist.Type)
+}
+
+// GetMirrorDistUrl returns the url of the git or static mirror serving the dist file of
+// the package, the reference is the value of the %reference% placeholder. The protected
+// dist files are not available on the mirrors, they are served by ProxyDist.
+func (ps *ComposerService) GetMirrorDistUrl(name, reference string) (string, error) {
+	version, err := ps.getDistVersion(name, reference)
+
+	if err != nil {
+		return "", err
+	}
+
+	if ps.Auth.IsProtected(version.Dist.URL) {
+		return "", pkgmirror.ResourceNotFoundError
+	}
+
+	if url, rule := ps.Rewriter.Rewrite(git.REWRITE_ARCHIVE, version.Dist.URL, ""); rule != nil && rule.Type != git.REWRITE_TARGET_NONE {
+		return url, nil
+	}
+
+	return "", pkgmirror.ResourceNotFoundError
+}
+
+// ProxyDist streams the dist file of a protected upstream, the request is sent with the
+// credentials of the mirror.
+func (ps *ComposerService) ProxyDist(w http.ResponseWriter, name, reference string) error {
+	version, err := ps.getDistVersion(name, reference)
+
+	if err != nil {
+		return err
+	}
+
+	if !ps.Auth.IsProtected(version.Dist.URL) {
+		return pkgmirror.ResourceNotFoundError
+	}
+
+	req, err := http.NewRequest("GET", version.Dist.URL, nil)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := ps.Auth.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		ps.Logger.WithFields(log.Fields{
+			"action":  "ProxyDist",
+			"package": name,
+			"url":     version.Dist.URL,
+			"status":  resp.StatusCode,
+		}).Error("Unable to load the dist file")
+
+		return pkgmirror.HttpError
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); len(contentType) > 0 {
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+	}
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+// GetMirrorGitUrl returns the url of the git mirror serving the source repository of the
+// package, the normalized url is the value of the %normalizedUrl% placeholder.
+func (ps *ComposerService) GetMirrorGitUrl(name, normalizedUrl string) (string, error) {
+	versions, err := ps.getPackageVersions(name)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, version := range versions {
+		if version.Source.Type != "git" || NormalizeMirrorUrl(version.Source.URL) != normalizedUrl {
+			continue
+		}
+
+		if url, rule := ps.Rewriter.Rewrite(git.REWRITE_REPOSITORY, version.Source.URL, ""); rule != nil && rule.Type != git.REWRITE_TARGET_NONE {
+			return url, nil
+		}
+
+		return "", pkgmirror.ResourceNotFoundError
+	}
+
+	return "", pkgmirror.InvalidReferenceError
+}
@@ -35,10 +35,15 @@ func (pp *PackagePat) Match(ctx context.Context, r *http.Request) context.Contex
 
 func NewPackageInfoPat(code string) goji.Pattern {
 	return &PackageInfoPat{
-		Pattern: regexp.MustCompile(fmt.Sprintf(`\/composer\/%s\/p\/([^\/]*)\/([^\/]*)(.json|)`, code)),
+		Pattern: regexp.MustCompile(fmt.Sprintf(`\/composer\/%s\/p\/([^\/]*)\/([^\/]*?)(\.html|\.json|)$`, code)),
 	}
 }
 
+// GetPackageInfoPath returns the path of the page of a package, matched by the PackageInfoPat.
+func GetPackageInfoPath(code, name string) string {
+	return fmt.Sprintf("/composer/%s/p/%s.html", code, name)
+}
+
 type PackageInfoPat struct {
 	Pattern *regexp.Regexp
 }
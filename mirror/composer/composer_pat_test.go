@@ -51,6 +51,27 @@ func Test_Composer_Pat_PackageInformation(t *testing.T) {
 	assert.Equal(t, "html", result.Value(pattern.Variable("format")))
 }
 
+func Test_Composer_Pat_PackageInformation_Extension(t *testing.T) {
+	p := NewPackageInfoPat("packagist")
+
+	c, r := mustReq("GET", GetPackageInfoPath("packagist", "kevinlebrun/colors.php"))
+
+	result := p.Match(c, r)
+
+	assert.NotNil(t, result)
+	assert.Equal(t, "kevinlebrun", result.Value(pattern.Variable("vendor")))
+	assert.Equal(t, "colors.php", result.Value(pattern.Variable("package")))
+	assert.Equal(t, "html", result.Value(pattern.Variable("format")))
+
+	c, r = mustReq("GET", "/composer/packagist/p/kevinlebrun/colors.php.json")
+
+	result = p.Match(c, r)
+
+	assert.NotNil(t, result)
+	assert.Equal(t, "colors.php", result.Value(pattern.Variable("package")))
+	assert.Equal(t, "json", result.Value(pattern.Variable("format")))
+}
+
 func Test_Composer_Pat_AllVariables(t *testing.T) {
 	p := NewPackagePat("packagist")
 
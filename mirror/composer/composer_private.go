@@ -0,0 +1,339 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	PRIVATE_BUCKET       = []byte("_private")
+	PRIVATE_DISTS_BUCKET = []byte("_private_dists")
+
+	PRIVATE_PROVIDER = "p/provider-private$%hash%.json"
+
+	STABLE_VERSION = regexp.MustCompile(`^[vV]?(\d+)(\.\d+)?(\.\d+)?(\.\d+)?(-[\w\.]+)?$`)
+)
+
+const (
+	PRIVATE_MAX_ARCHIVE_SIZE = 100 * 1024 * 1024
+)
+
+// NormalizeVersion returns the version_normalized value of a version, ie: v1.2 => 1.2.0.0
+func NormalizeVersion(version string) string {
+	results := STABLE_VERSION.FindStringSubmatch(version)
+
+	if len(results) == 0 {
+		return version
+	}
+
+	parts := []string{results[1]}
+
+	for _, part := range results[2:5] {
+		if len(part) == 0 {
+			part = ".0"
+		}
+
+		parts = append(parts, part[1:])
+	}
+
+	return strings.Join(parts, ".") + results[5]
+}
+
+// ReadArchiveManifest returns the composer.json file from a zip archive, the file can be located
+// in the root folder or in a sub folder like github archives.
+func ReadArchiveManifest(archive []byte) (*Package, error) {
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest *zip.File
+
+	for _, f := range r.File {
+		if path.Base(f.Name) != "composer.json" {
+			continue
+		}
+
+		if manifest == nil || strings.Count(f.Name, "/") < strings.Count(manifest.Name, "/") {
+			manifest = f
+		}
+	}
+
+	if manifest == nil {
+		return nil, pkgmirror.InvalidPackageError
+	}
+
+	rc, err := manifest.Open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rc.Close()
+
+	pkg := &Package{}
+
+	if err := json.NewDecoder(rc).Decode(pkg); err != nil {
+		return nil, err
+	}
+
+	if len(pkg.Name) == 0 || strings.Count(pkg.Name, "/") != 1 {
+		return nil, pkgmirror.InvalidPackageError
+	}
+
+	return pkg, nil
+}
+
+// AddPrivateArchive stores a zip artifact, the version is read from the composer.json file
+// if not provided.
+func (ps *ComposerService) AddPrivateArchive(archive []byte, version string) (*Package, error) {
+	pkg, err := ReadArchiveManifest(archive)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(version) == 0 {
+		version = pkg.Version
+	}
+
+	if len(version) == 0 {
+		return nil, pkgmirror.InvalidReferenceError
+	}
+
+	sha := sha1.Sum(archive)
+
+	pkg.Dist.Reference = hex.EncodeToString(sha[:])
+
+	return pkg, ps.savePrivatePackage(pkg, version, archive)
+}
+
+// IsValidVcsUrl returns true if the url is a remote git repository, ie: https://github.com/foo/bar.git,
+// ssh://git@github.com/foo/bar.git or git@github.com:foo/bar.git. The local paths and the file
+// urls are not allowed, they would expose the repositories of the host.
+func IsValidVcsUrl(url string) bool {
+	if strings.HasPrefix(url, "-") {
+		return false
+	}
+
+	for _, prefix := range []string{"https://", "ssh://", "git@"} {
+		if strings.HasPrefix(url, prefix) && len(url) > len(prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddPrivateVcs fetches the reference from a git repository and stores the generated zip artifact.
+func (ps *ComposerService) AddPrivateVcs(req *PrivateVcsRequest) (*Package, error) {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action":    "AddPrivateVcs",
+		"url":       req.Url,
+		"reference": req.Reference,
+	})
+
+	if !IsValidVcsUrl(req.Url) || len(req.Reference) == 0 || strings.HasPrefix(req.Reference, "-") {
+		return nil, pkgmirror.InvalidReferenceError
+	}
+
+	dir, err := ioutil.TempDir("", "pkgmirror-composer-")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) ([]byte, error) {
+		cmd := exec.Command(ps.Config.GitBinary, args...)
+		cmd.Dir = dir
+
+		logger.WithField("cmd", cmd.Args).Debug("Run command")
+
+		return cmd.Output()
+	}
+
+	if _, err := git("init", "--quiet", "--bare"); err != nil {
+		return nil, err
+	}
+
+	if _, err := git("fetch", "--quiet", "--depth", "1", "--", req.Url, req.Reference); err != nil {
+		logger.WithError(err).Error("Unable to fetch the reference")
+
+		return nil, err
+	}
+
+	commit, err := git("rev-parse", "FETCH_HEAD")
+
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := git("archive", "--format=zip", "FETCH_HEAD")
+
+	if err != nil {
+		logger.WithError(err).Error("Unable to generate the archive")
+
+		return nil, err
+	}
+
+	pkg, err := ReadArchiveManifest(archive)
+
+	if err != nil {
+		return nil, err
+	}
+
+	version := req.Version
+
+	if len(version) == 0 {
+		version = pkg.Version
+	}
+
+	if len(version) == 0 {
+		if STABLE_VERSION.MatchString(req.Reference) {
+			version = req.Reference
+		} else {
+			version = "dev-" + req.Reference
+		}
+	}
+
+	pkg.Source.Type = "git"
+	pkg.Source.URL = req.Url
+	pkg.Source.Reference = strings.TrimSpace(string(commit))
+	pkg.Dist.Reference = pkg.Source.Reference
+
+	return pkg, ps.savePrivatePackage(pkg, version, archive)
+}
+
+func (ps *ComposerService) savePrivatePackage(pkg *Package, version string, archive []byte) error {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action":  "savePrivatePackage",
+		"package": pkg.Name,
+		"version": version,
+	})
+
+	if strings.ContainsAny(version, "/\\") {
+		return pkgmirror.InvalidReferenceError
+	}
+
+	sha := sha1.Sum(archive)
+	file := fmt.Sprintf("%s/%s.zip", pkg.Name, version)
+
+	pkg.Version = version
+	pkg.VersionNormalized = NormalizeVersion(version)
+	pkg.Time = time.Now()
+	pkg.Dist.Type = "zip"
+	pkg.Dist.URL = fmt.Sprintf("%s/composer/%s/private/%s", ps.Config.PublicServer, ps.Config.Code, file)
+	pkg.Dist.Shasum = hex.EncodeToString(sha[:])
+
+	pi := &PackageInformation{
+		Server:  "private",
+		Package: pkg.Name,
+		Private: true,
+		PackageResult: PackageResult{
+			Packages: map[string]map[string]*Package{},
+		},
+	}
+
+	// load the versions already uploaded, upstream versions are discarded.
+	ps.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ps.Config.Code)
+
+		current := &PackageInformation{}
+		if err := pkgmirror.Unmarshal(b.Get([]byte(pkg.Name)), current); err != nil || !current.Private {
+			return nil
+		}
+
+		if err := pkgmirror.Unmarshal(b.Get([]byte(current.GetTargetKey())), &pi.PackageResult); err != nil {
+			logger.WithError(err).Error("Unable to load the private package")
+		}
+
+		return nil
+	})
+
+	if pi.PackageResult.Packages[pkg.Name] == nil {
+		pi.PackageResult.Packages = map[string]map[string]*Package{
+			pkg.Name: {},
+		}
+	}
+
+	pi.PackageResult.Packages[pkg.Name][version] = pkg
+
+	data, _ := json.Marshal(pi.PackageResult)
+	hash := sha256.Sum256(data)
+	pi.HashSource = hex.EncodeToString(hash[:])
+
+	if err := ps.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(PRIVATE_DISTS_BUCKET).Put([]byte(file), archive); err != nil {
+			return err
+		}
+
+		// the private package replaces the inline package
+		if err := tx.Bucket(INLINE_BUCKET).Delete([]byte(pkg.Name)); err != nil {
+			return err
+		}
+
+		return tx.Bucket(PRIVATE_BUCKET).Put([]byte(pkg.Name), []byte(pi.HashSource))
+	}); err != nil {
+		logger.WithError(err).Error("Unable to store the private archive")
+
+		return err
+	}
+
+	if err := ps.savePackage(pi); err != nil {
+		return err
+	}
+
+	logger.Info("Private package saved")
+
+	if err := ps.UpdateEntryPoints(); err != nil {
+		// the package will be exposed on the next synchronization
+		logger.WithError(err).Warn("Unable to update entry points")
+	}
+
+	return nil
+}
+
+// GetPrivateArchive returns the zip artifact of a private package, ie: vendor/package/1.0.0.zip
+func (ps *ComposerService) GetPrivateArchive(file string) ([]byte, error) {
+	var data []byte
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(PRIVATE_DISTS_BUCKET).Get([]byte(file))
+
+		if len(raw) == 0 {
+			return pkgmirror.EmptyKeyError
+		}
+
+		data = make([]byte, len(raw))
+
+		copy(data, raw)
+
+		return nil
+	})
+
+	return data, err
+}
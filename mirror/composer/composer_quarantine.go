@@ -0,0 +1,337 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	QUARANTINE_BUCKET       = []byte("_quarantine")
+	QUARANTINE_RULES_BUCKET = []byte("_quarantine_rules")
+)
+
+const (
+	QUARANTINE_PENDING  = "pending"
+	QUARANTINE_APPROVED = "approved"
+)
+
+// MatchQuarantineRules returns the first rule matching the package name, ie: symfony/*
+func MatchQuarantineRules(rules []*QuarantineRule, name string) *QuarantineRule {
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// quarantineVersions removes the versions waiting for an approval from the package, the
+// versions already published when the quarantine is enabled are approved.
+func (ps *ComposerService) quarantineVersions(tx *bolt.Tx, pkg *PackageInformation) error {
+	qb := tx.Bucket(QUARANTINE_BUCKET)
+	now := time.Now()
+
+	rules, err := ps.loadQuarantineRules(tx)
+
+	if err != nil {
+		return err
+	}
+
+	published := ps.loadPublishedVersions(tx, pkg.Package)
+
+	for version, definition := range pkg.PackageResult.Packages[pkg.Package] {
+		key := GetVersionKey(pkg.Package, version)
+		entry := &QuarantineEntry{}
+
+		if data := qb.Get(key); len(data) > 0 {
+			if err := json.Unmarshal(data, entry); err != nil {
+				return err
+			}
+
+			if entry.Status == QUARANTINE_APPROVED && entry.IsChanged(definition) {
+				ps.Logger.WithFields(log.Fields{
+					"action":    "quarantineVersions",
+					"package":   pkg.Package,
+					"version":   version,
+					"reference": definition.Dist.Reference,
+				}).Warn("The reference of an approved version has changed")
+
+				entry.Reset(now)
+			} else if entry.Status == QUARANTINE_APPROVED {
+				if len(entry.DistReference) > 0 || len(entry.SourceReference) > 0 {
+					continue
+				}
+
+				// the entries approved before the references were stored
+				entry.DistReference = definition.Dist.Reference
+				entry.SourceReference = definition.Source.Reference
+			}
+		} else {
+			entry = &QuarantineEntry{
+				Package:    pkg.Package,
+				Version:    version,
+				Status:     QUARANTINE_PENDING,
+				FirstSeen:  now,
+				Definition: definition,
+			}
+
+			if current, ok := published[version]; ok && current.Dist.Reference == definition.Dist.Reference {
+				entry.Approve("published", now)
+			}
+		}
+
+		entry.Definition = definition
+
+		if entry.Status == QUARANTINE_PENDING {
+			if rule := MatchQuarantineRules(rules, pkg.Package); rule != nil {
+				entry.Approve("rule:"+rule.Pattern, now)
+			} else if entry.IsExpired(ps.Config.QuarantineDelay, now) {
+				entry.Approve("delay", now)
+			}
+		}
+
+		if entry.Status == QUARANTINE_PENDING {
+			// the definition is kept to publish the version once approved
+			delete(pkg.PackageResult.Packages[pkg.Package], version)
+		} else {
+			entry.Definition = nil
+		}
+
+		if data, err := json.Marshal(entry); err != nil {
+			return err
+		} else if err := qb.Put(key, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadPublishedVersions returns the versions of the stored package definition.
+func (ps *ComposerService) loadPublishedVersions(tx *bolt.Tx, name string) map[string]*Package {
+	b := tx.Bucket(ps.Config.Code)
+
+	pi := &PackageInformation{}
+	pr := &PackageResult{}
+
+	if err := pkgmirror.Unmarshal(b.Get([]byte(name)), pi); err != nil || len(pi.HashTarget) == 0 {
+		return map[string]*Package{}
+	}
+
+	if err := pkgmirror.Unmarshal(b.Get([]byte(pi.GetTargetKey())), pr); err != nil || pr.Packages[name] == nil {
+		return map[string]*Package{}
+	}
+
+	return pr.Packages[name]
+}
+
+func (ps *ComposerService) loadQuarantineRules(tx *bolt.Tx) ([]*QuarantineRule, error) {
+	rules := []*QuarantineRule{}
+
+	err := tx.Bucket(QUARANTINE_RULES_BUCKET).ForEach(func(k, v []byte) error {
+		rule := &QuarantineRule{}
+
+		if err := json.Unmarshal(v, rule); err != nil {
+			return err
+		}
+
+		rules = append(rules, rule)
+
+		return nil
+	})
+
+	return rules, err
+}
+
+// GetQuarantine returns the versions with the provided status, all versions are returned if
+// the status is empty.
+func (ps *ComposerService) GetQuarantine(status string) ([]*QuarantineEntry, error) {
+	entries := []*QuarantineEntry{}
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(QUARANTINE_BUCKET).ForEach(func(k, v []byte) error {
+			entry := &QuarantineEntry{}
+
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+
+			if len(status) == 0 || entry.Status == status {
+				entries = append(entries, entry)
+			}
+
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// GetQuarantineRules returns the vendor rules approving the new versions.
+func (ps *ComposerService) GetQuarantineRules() ([]*QuarantineRule, error) {
+	rules := []*QuarantineRule{}
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		var err error
+
+		rules, err = ps.loadQuarantineRules(tx)
+
+		return err
+	})
+
+	return rules, err
+}
+
+// AddQuarantineRule stores a rule approving the versions of the matching packages, the
+// pending versions matching the rule are published. The identity adding the rule is recorded.
+func (ps *ComposerService) AddQuarantineRule(pattern, by string) ([]*QuarantineEntry, error) {
+	if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+		return nil, pkgmirror.InvalidPackageError
+	}
+
+	rule := &QuarantineRule{
+		Pattern:   pattern,
+		CreatedAt: time.Now(),
+		CreatedBy: by,
+	}
+
+	if err := ps.DB.Update(func(tx *bolt.Tx) error {
+		if data, err := json.Marshal(rule); err != nil {
+			return err
+		} else {
+			return tx.Bucket(QUARANTINE_RULES_BUCKET).Put([]byte(pattern), data)
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return ps.approve("rule:"+pattern, func(entry *QuarantineEntry) bool {
+		return MatchQuarantineRules([]*QuarantineRule{rule}, entry.Package) != nil
+	})
+}
+
+// DeleteQuarantineRule deletes a rule, the versions already approved are kept.
+func (ps *ComposerService) DeleteQuarantineRule(pattern string) error {
+	return ps.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(QUARANTINE_RULES_BUCKET)
+
+		if len(b.Get([]byte(pattern))) == 0 {
+			return pkgmirror.ResourceNotFoundError
+		}
+
+		return b.Delete([]byte(pattern))
+	})
+}
+
+// ApproveVersion publishes a pending version, all the pending versions of the package are
+// published if the version is empty. The identity approving the version is recorded.
+func (ps *ComposerService) ApproveVersion(name, version, by string) ([]*QuarantineEntry, error) {
+	entries, err := ps.approve(by, func(entry *QuarantineEntry) bool {
+		return entry.Package == name && (len(version) == 0 || entry.Version == version)
+	})
+
+	if err == nil && len(entries) == 0 {
+		return nil, pkgmirror.ResourceNotFoundError
+	}
+
+	return entries, err
+}
+
+// ApproveExpiredVersions publishes the versions pending for longer than the quarantine delay.
+func (ps *ComposerService) ApproveExpiredVersions() ([]*QuarantineEntry, error) {
+	if !ps.Config.Quarantine || ps.Config.QuarantineDelay <= 0 {
+		return []*QuarantineEntry{}, nil
+	}
+
+	now := time.Now()
+
+	return ps.approve("delay", func(entry *QuarantineEntry) bool {
+		return entry.IsExpired(ps.Config.QuarantineDelay, now)
+	})
+}
+
+// approve publishes the pending versions accepted by the filter, the stored definitions are
+// added to the published package definitions.
+func (ps *ComposerService) approve(by string, filter func(entry *QuarantineEntry) bool) ([]*QuarantineEntry, error) {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action": "approve",
+		"by":     by,
+	})
+
+	pending, err := ps.GetQuarantine(QUARANTINE_PENDING)
+
+	if err != nil {
+		return nil, err
+	}
+
+	packages := map[string][]*QuarantineEntry{}
+	names := []string{}
+
+	for _, entry := range pending {
+		if !filter(entry) {
+			continue
+		}
+
+		if _, ok := packages[entry.Package]; !ok {
+			names = append(names, entry.Package)
+		}
+
+		packages[entry.Package] = append(packages[entry.Package], entry)
+	}
+
+	approved := []*QuarantineEntry{}
+	now := time.Now()
+
+	for _, name := range names {
+		err := ps.DB.Update(func(tx *bolt.Tx) error {
+			pi := &PackageInformation{}
+
+			if err := pkgmirror.Unmarshal(tx.Bucket(ps.Config.Code).Get([]byte(name)), pi); err != nil {
+				return err // the package has been removed
+			}
+
+			pi.PackageResult = PackageResult{
+				Packages: map[string]map[string]*Package{
+					name: ps.loadPublishedVersions(tx, name),
+				},
+			}
+
+			for _, entry := range packages[name] {
+				pi.PackageResult.Packages[name][entry.Version] = entry.Definition
+
+				entry.Approve(by, now)
+
+				if data, err := json.Marshal(entry); err != nil {
+					return err
+				} else if err := tx.Bucket(QUARANTINE_BUCKET).Put(GetVersionKey(entry.Package, entry.Version), data); err != nil {
+					return err
+				}
+			}
+
+			return ps.storePackage(tx, pi)
+		})
+
+		if err != nil {
+			logger.WithError(err).WithField("package", name).Error("Unable to approve the versions")
+
+			continue
+		}
+
+		approved = append(approved, packages[name]...)
+	}
+
+	logger.WithField("versions", len(approved)).Info("Versions approved")
+
+	return approved, nil
+}
@@ -0,0 +1,215 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	SEARCH_BUCKET = []byte("_search")
+)
+
+const (
+	SEARCH_PER_PAGE     = 15
+	SEARCH_MAX_PER_PAGE = 100
+)
+
+// NewSearchEntry creates the index entry from the most recent stable version, or
+// from the most recent dev version if the package does not have any release yet.
+func NewSearchEntry(name string, versions map[string]*Package) *SearchEntry {
+	entry := &SearchEntry{
+		Name:     name,
+		Keywords: []string{},
+	}
+
+	var latest *Package
+
+	for _, version := range SortVersions(versions) {
+		if latest == nil || (IsDevVersion(latest.Version) && !IsDevVersion(version.Version)) {
+			latest = version
+		}
+	}
+
+	if latest == nil {
+		return entry
+	}
+
+	entry.Description = latest.Description
+	entry.Type = latest.Type
+	entry.Repository = latest.Source.URL
+
+	if latest.Keywords != nil {
+		json.Unmarshal(*latest.Keywords, &entry.Keywords)
+	}
+
+	return entry
+}
+
+// Score returns the relevance of the entry for the provided terms, 0 means the entry does not match.
+func (e *SearchEntry) Score(terms []string, kind string) int {
+	if len(kind) > 0 && e.Type != kind {
+		return 0
+	}
+
+	score := 1
+
+	for _, term := range terms {
+		matched := pkgmirror.ScoreTerm(term, e.Name, e.Description, e.Keywords)
+
+		if matched == 0 {
+			return 0
+		}
+
+		score += matched
+	}
+
+	return score
+}
+
+func (ps *ComposerService) indexPackage(tx *bolt.Tx, pkg *PackageInformation) error {
+	entry := NewSearchEntry(pkg.Package, pkg.PackageResult.Packages[pkg.Package])
+
+	if data, err := json.Marshal(entry); err != nil {
+		return err
+	} else {
+		return tx.Bucket(SEARCH_BUCKET).Put([]byte(pkg.Package), data)
+	}
+}
+
+// rebuildSearchIndex indexes the packages stored by the versions of the mirror released
+// without the composer search.
+func (ps *ComposerService) rebuildSearchIndex() error {
+	logger := ps.Logger.WithFields(log.Fields{
+		"action": "rebuildSearchIndex",
+	})
+
+	return pkgmirror.RebuildIndex(ps.DB, SEARCH_BUCKET, logger, func(tx *bolt.Tx) error {
+		b := tx.Bucket(ps.Config.Code)
+
+		return b.ForEach(func(k, v []byte) error {
+			if strings.Contains(string(k), "$") || strings.Contains(string(k), ".json") {
+				return nil
+			}
+
+			pi := &PackageInformation{}
+			if err := pkgmirror.Unmarshal(v, pi); err != nil || len(pi.Package) == 0 {
+				return nil
+			}
+
+			if err := pkgmirror.Unmarshal(b.Get([]byte(pi.GetTargetKey())), &pi.PackageResult); err != nil {
+				logger.WithError(err).WithField("package", pi.Package).Debug("Unable to load package definition")
+
+				return nil
+			}
+
+			return ps.indexPackage(tx, pi)
+		})
+	})
+}
+
+// Search returns packagist compatible search results, page starts at 1.
+func (ps *ComposerService) Search(query, kind string, page, perPage int) (*SearchResult, error) {
+	if page < 1 {
+		page = 1
+	}
+
+	if perPage < 1 {
+		perPage = SEARCH_PER_PAGE
+	} else if perPage > SEARCH_MAX_PER_PAGE {
+		perPage = SEARCH_MAX_PER_PAGE
+	}
+
+	terms := strings.Fields(strings.ToLower(query))
+
+	type match struct {
+		entry *SearchEntry
+		score int
+	}
+
+	matches := []*match{}
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(SEARCH_BUCKET).ForEach(func(k, v []byte) error {
+			entry := &SearchEntry{}
+
+			if err := json.Unmarshal(v, entry); err != nil {
+				return nil
+			}
+
+			if score := entry.Score(terms, kind); score > 0 {
+				matches = append(matches, &match{entry, score})
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+
+		return matches[i].entry.Name < matches[j].entry.Name
+	})
+
+	result := &SearchResult{
+		Results: []*SearchResultEntry{},
+		Total:   len(matches),
+	}
+
+	start := (page - 1) * perPage
+	end := start + perPage
+
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	for i := start; i < end; i++ {
+		entry := &SearchResultEntry{
+			Name:        matches[i].entry.Name,
+			Description: matches[i].entry.Description,
+			Url:         ps.Config.PublicServer + GetPackageInfoPath(string(ps.Config.Code), matches[i].entry.Name),
+			Repository:  matches[i].entry.Repository,
+		}
+
+		if stat, err := ps.GetDownloads(entry.Name); err == nil {
+			entry.Downloads = stat.Total
+		}
+
+		result.Results = append(result.Results, entry)
+	}
+
+	if end < len(matches) {
+		params := url.Values{}
+		params.Set("q", query)
+		params.Set("page", fmt.Sprintf("%d", page+1))
+
+		if len(kind) > 0 {
+			params.Set("type", kind)
+		}
+
+		if perPage != SEARCH_PER_PAGE {
+			params.Set("per_page", fmt.Sprintf("%d", perPage))
+		}
+
+		result.Next = fmt.Sprintf("%s/composer/%s/search.json?%s", ps.Config.PublicServer, ps.Config.Code, params.Encode())
+	}
+
+	return result, nil
+}
@@ -8,7 +8,10 @@ package composer
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
+
+	"github.com/rande/pkgmirror"
 )
 
 type ProviderInclude map[string]struct {
@@ -16,12 +19,146 @@ type ProviderInclude map[string]struct {
 }
 
 type PackagesResult struct {
-	Packages         json.RawMessage `json:"packages"`
-	Notify           string          `json:"notify"`
-	NotifyBatch      string          `json:"notify-batch"`
-	ProvidersURL     string          `json:"providers-url"`
-	Search           string          `json:"search"`
-	ProviderIncludes ProviderInclude `json:"provider-includes"`
+	Packages           json.RawMessage `json:"packages"`
+	Notify             string          `json:"notify"`
+	NotifyBatch        string          `json:"notify-batch"`
+	ProvidersURL       string          `json:"providers-url"`
+	ProvidersLazyURL   string          `json:"providers-lazy-url,omitempty"`
+	MetadataURL        string          `json:"metadata-url,omitempty"`
+	MetadataChangesURL string          `json:"metadata-changes-url,omitempty"`
+	AvailablePackages  []string        `json:"available-packages,omitempty"`
+	Search             string          `json:"search"`
+	ProviderIncludes   ProviderInclude `json:"provider-includes"`
+	Includes           map[string]struct {
+		Sha1 string `json:"sha1"`
+	} `json:"includes,omitempty"`
+	SecurityAdvisories *SecurityAdvisoriesConfig `json:"security-advisories,omitempty"`
+	Mirrors            []*Mirror                 `json:"mirrors,omitempty"`
+}
+
+// a publication of the entry points, the provider files are kept while the generation is retained
+type Generation struct {
+	ID        uint64    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Providers []string  `json:"providers"`
+}
+
+// upstream urls and first appearance of a version on the mirror
+type VersionRecord struct {
+	FirstSeen time.Time `json:"first_seen"`
+	DistURL   string    `json:"dist_url"`
+	SourceURL string    `json:"source_url"`
+}
+
+// used to display a package on the gui
+type PackageDetail struct {
+	Package    string           `json:"package"`
+	Upstream   string           `json:"upstream,omitempty"`
+	Private    bool             `json:"private"`
+	HashSource string           `json:"hash_source"`
+	HashTarget string           `json:"hash_target"`
+	Versions   []*VersionDetail `json:"versions"`
+}
+
+type VersionDetail struct {
+	Version           string           `json:"version"`
+	VersionNormalized string           `json:"version_normalized"`
+	Time              time.Time        `json:"time"`
+	FirstSeen         *time.Time       `json:"first_seen,omitempty"`
+	Dist              *VersionLocation `json:"dist"`
+	Source            *VersionLocation `json:"source"`
+}
+
+// the url is the one published by the mirror, the original url is the upstream one
+type VersionLocation struct {
+	Type      string `json:"type"`
+	Reference string `json:"reference"`
+	URL       string `json:"url"`
+	Original  string `json:"original,omitempty"`
+	Cached    bool   `json:"cached"`
+}
+
+// result of the garbage collection, the keys are deleted only if the report is applied
+type GCReport struct {
+	Applied     bool     `json:"applied"`
+	Generations int      `json:"generations"` // expired generations
+	Providers   []string `json:"providers"`
+	Packages    []string `json:"packages"`
+	Orphans     []string `json:"orphans"`
+	Bytes       int64    `json:"bytes"`
+}
+
+// version seen on the upstream, the definition is kept until the version is approved
+type QuarantineEntry struct {
+	Package    string     `json:"package"`
+	Version    string     `json:"version"`
+	Status     string     `json:"status"`
+	FirstSeen  time.Time  `json:"first_seen"`
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+	ApprovedBy string     `json:"approved_by,omitempty"`
+	// the references of the approved definition
+	DistReference   string   `json:"dist_reference,omitempty"`
+	SourceReference string   `json:"source_reference,omitempty"`
+	Definition      *Package `json:"definition,omitempty"`
+}
+
+// Approve publishes the pending definition, its references are kept to detect a change of
+// the version upstream.
+func (e *QuarantineEntry) Approve(by string, now time.Time) {
+	if e.Definition != nil {
+		e.DistReference = e.Definition.Dist.Reference
+		e.SourceReference = e.Definition.Source.Reference
+	}
+
+	e.Status = QUARANTINE_APPROVED
+	e.ApprovedAt = &now
+	e.ApprovedBy = by
+	e.Definition = nil
+}
+
+// IsChanged returns true if the references of the definition differ from the approved ones,
+// ie: a tag moved to another commit. The entries approved without references are not changed.
+func (e *QuarantineEntry) IsChanged(definition *Package) bool {
+	if len(e.DistReference) == 0 && len(e.SourceReference) == 0 {
+		return false
+	}
+
+	return e.DistReference != definition.Dist.Reference || e.SourceReference != definition.Source.Reference
+}
+
+// Reset sends an approved version back to the quarantine.
+func (e *QuarantineEntry) Reset(now time.Time) {
+	e.Status = QUARANTINE_PENDING
+	e.FirstSeen = now
+	e.ApprovedAt = nil
+	e.ApprovedBy = ""
+	e.DistReference = ""
+	e.SourceReference = ""
+}
+
+// IsExpired returns true if the version has been pending for longer than the delay, a
+// delay of 0 disables the automatic approval.
+func (e *QuarantineEntry) IsExpired(delay time.Duration, now time.Time) bool {
+	return e.Status == QUARANTINE_PENDING && delay > 0 && now.Sub(e.FirstSeen) >= delay
+}
+
+// used to approve the new versions of the matching packages, ie: symfony/*
+type QuarantineRule struct {
+	Pattern   string    `json:"pattern"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+// used to advertise the dist and git mirrors, composer falls back to the origin urls
+type Mirror struct {
+	DistURL   string `json:"dist-url,omitempty"`
+	GitURL    string `json:"git-url,omitempty"`
+	Preferred bool   `json:"preferred"`
+}
+
+type SecurityAdvisoriesConfig struct {
+	Metadata bool   `json:"metadata"`
+	ApiURL   string `json:"api-url"`
 }
 
 type ProvidersResult struct {
@@ -78,6 +215,150 @@ type PackageResult struct {
 	Packages map[string]map[string]*Package `json:"packages"`
 }
 
+// used to generate the composer v2 metadata files, ie: p2/vendor/package.json
+type MetadataResult struct {
+	Packages map[string][]map[string]json.RawMessage `json:"packages"`
+	Minified string                                  `json:"minified,omitempty"`
+}
+
+// used to load the upstream change feed, ie: metadata/changes.json?since=TIMESTAMP
+type ChangesResult struct {
+	Actions []struct {
+		Type    string `json:"type"`
+		Package string `json:"package"`
+		Time    int64  `json:"time"`
+	} `json:"actions"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+// package listed inline by an upstream, the index is the position of the upstream
+type InlinePackage struct {
+	Upstream *Upstream
+	Index    int
+	Versions map[string]*Package
+}
+
+// a load shared by the concurrent requests of a package
+type lazyCall struct {
+	wg  sync.WaitGroup
+	pi  *PackageInformation
+	err error
+}
+
+// last action of the change feed for the stable and the dev files of a package
+type FileChanges struct {
+	Stable string
+	Dev    string
+}
+
+// security advisory, the format is compatible with packagist.org
+type SecurityAdvisory struct {
+	AdvisoryID         string           `json:"advisoryId"`
+	PackageName        string           `json:"packageName"`
+	RemoteID           string           `json:"remoteId"`
+	Title              string           `json:"title"`
+	Link               string           `json:"link"`
+	CVE                string           `json:"cve"`
+	AffectedVersions   string           `json:"affectedVersions"`
+	Source             string           `json:"source"`
+	ReportedAt         string           `json:"reportedAt"`
+	ComposerRepository string           `json:"composerRepository"`
+	Severity           string           `json:"severity,omitempty"`
+	Sources            *json.RawMessage `json:"sources,omitempty"`
+}
+
+// used to load and generate the security-advisories api response
+type SecurityAdvisoriesResult struct {
+	Advisories map[string][]*SecurityAdvisory `json:"advisories"`
+}
+
+// used to load a composer.lock file
+type ComposerLock struct {
+	Packages    []*Package `json:"packages"`
+	PackagesDev []*Package `json:"packages-dev"`
+}
+
+// result of the warm operation for one package of the composer.lock file
+type WarmResult struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Source  string `json:"source"`
+	Dist    string `json:"dist"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type WarmReport struct {
+	Results []*WarmResult `json:"results"`
+	Cached  int           `json:"cached"`
+	Skipped int           `json:"skipped"`
+	Errors  int           `json:"errors"`
+}
+
+// warm operation running in the background, the report is set once the operation is completed
+type WarmJob struct {
+	Id       string      `json:"id"`
+	Status   string      `json:"status"`
+	Packages int         `json:"packages"`
+	Report   *WarmReport `json:"report,omitempty"`
+}
+
+// entry stored in the search index
+type SearchEntry struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Keywords    []string `json:"keywords"`
+	Type        string   `json:"type"`
+	Repository  string   `json:"repository"`
+}
+
+// used to generate the search.json file, the format is compatible with packagist.org
+type SearchResult struct {
+	Results []*SearchResultEntry `json:"results"`
+	Total   int                  `json:"total"`
+	Next    string               `json:"next,omitempty"`
+}
+
+type SearchResultEntry struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Url         string `json:"url"`
+	Repository  string `json:"repository"`
+	Downloads   int    `json:"downloads"`
+	Favers      int    `json:"favers"`
+}
+
+// download notification sent by composer clients, ie: {"name": "vendor/package", "version": "1.0.0.0"}
+type DownloadNotification struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// body of the notify-batch request
+type DownloadsRequest struct {
+	Downloads []*DownloadNotification `json:"downloads"`
+}
+
+// download statistics stored for each package, days are kept for a limited period
+type DownloadStat struct {
+	pkgmirror.DownloadCounter
+	Package  string         `json:"package"`
+	Versions map[string]int `json:"versions"`
+}
+
+type DownloadSummary struct {
+	Package   string `json:"package"`
+	Total     int    `json:"total"`
+	Downloads int    `json:"downloads"`
+}
+
+// body of the request used to add a private package from a git repository
+type PrivateVcsRequest struct {
+	Url       string `json:"url"`
+	Reference string `json:"reference"`
+	Version   string `json:"version"`
+}
+
 type PackageInformation struct {
 	Server        string        `json:"server"`
 	PackageResult PackageResult `json:"-"`
@@ -86,6 +367,8 @@ type PackageInformation struct {
 	HashSource    string        `json:"hash_source"`
 	HashTarget    string        `json:"hash_target"`
 	Url           string        `json:"-"`
+	Private       bool          `json:"private,omitempty"`
+	Upstream      string        `json:"upstream,omitempty"`
 }
 
 func (pi *PackageInformation) GetTargetKey() string {
@@ -4,3 +4,890 @@
 // license that can be found in the LICENSE file.
 
 package composer
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+	"github.com/rande/pkgmirror/mirror/git"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IsDevVersion(t *testing.T) {
+	assert.True(t, IsDevVersion("dev-master"))
+	assert.True(t, IsDevVersion("2.8.x-dev"))
+	assert.False(t, IsDevVersion("2.8.1"))
+	assert.False(t, IsDevVersion("1.0.0-beta1"))
+}
+
+func Test_MinifyVersions(t *testing.T) {
+	versions := map[string]*Package{
+		"1.0.0": {Name: "foo/bar", Version: "1.0.0", Description: "Foo", Homepage: "https://foo.bar", Time: time.Unix(1000, 0)},
+		"1.1.0": {Name: "foo/bar", Version: "1.1.0", Description: "Foo", Time: time.Unix(2000, 0)},
+	}
+
+	minified, err := MinifyVersions(SortVersions(versions))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(minified))
+
+	// the most recent version is complete
+	assert.Equal(t, json.RawMessage(`"1.1.0"`), minified[0]["version"])
+	assert.Equal(t, json.RawMessage(`"Foo"`), minified[0]["description"])
+
+	// the next version only contains the differences
+	assert.Equal(t, json.RawMessage(`"1.0.0"`), minified[1]["version"])
+	assert.Equal(t, json.RawMessage(`"https://foo.bar"`), minified[1]["homepage"])
+	_, ok := minified[1]["description"]
+	assert.False(t, ok)
+	_, ok = minified[1]["name"]
+	assert.False(t, ok)
+}
+
+func Test_MinifyVersions_Unset(t *testing.T) {
+	versions := []*Package{
+		{Name: "foo/bar", Version: "1.1.0", Homepage: "https://foo.bar"},
+		{Name: "foo/bar", Version: "1.0.0"},
+	}
+
+	minified, err := MinifyVersions(versions)
+
+	assert.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`"__unset"`), minified[1]["homepage"])
+}
+
+func Test_NewMetadataResults(t *testing.T) {
+	versions := map[string]*Package{
+		"1.0.0":      {Name: "foo/bar"},
+		"dev-master": {Name: "foo/bar"},
+		"1.0.x-dev":  {Name: "foo/bar"},
+	}
+
+	stable, dev, err := NewMetadataResults("foo/bar", versions)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "composer/2.0", stable.Minified)
+	assert.Equal(t, 1, len(stable.Packages["foo/bar"]))
+	assert.Equal(t, 2, len(dev.Packages["foo/bar"]))
+}
+
+func Test_SearchEntry_Score(t *testing.T) {
+	entry := &SearchEntry{
+		Name:        "symfony/framework-standard-edition",
+		Description: "The \"Symfony Standard Edition\" distribution",
+		Keywords:    []string{"framework"},
+		Type:        "project",
+	}
+
+	assert.True(t, entry.Score([]string{"symfony"}, "") > 0)
+	assert.True(t, entry.Score([]string{"framework", "distribution"}, "project") > 0)
+	assert.Equal(t, 0, entry.Score([]string{"symfony"}, "library"))
+	assert.Equal(t, 0, entry.Score([]string{"symfony", "laravel"}, ""))
+	assert.True(t, entry.Score([]string{"symfony/framework-standard-edition"}, "") > entry.Score([]string{"symfony"}, ""))
+}
+
+func Test_NewSearchEntry(t *testing.T) {
+	keywords := json.RawMessage(`["orm", "database"]`)
+
+	versions := map[string]*Package{
+		"dev-master": {Description: "dev description", Time: time.Unix(2000, 0)},
+		"1.0.0":      {Description: "stable description", Type: "library", Keywords: &keywords, Time: time.Unix(1000, 0)},
+	}
+
+	entry := NewSearchEntry("foo/bar", versions)
+
+	assert.Equal(t, "foo/bar", entry.Name)
+	assert.Equal(t, "stable description", entry.Description)
+	assert.Equal(t, "library", entry.Type)
+	assert.Equal(t, []string{"orm", "database"}, entry.Keywords)
+}
+
+func Test_DownloadStat(t *testing.T) {
+	now := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	stat := &DownloadStat{
+		DownloadCounter: pkgmirror.DownloadCounter{
+			Days: map[string]int{
+				"2016-01-01": 4,
+			},
+		},
+	}
+
+	stat.Add("1.0.0.0", now.AddDate(0, 0, -10))
+	stat.Add("1.0.0.0", now)
+	stat.Add("1.1.0.0", now)
+
+	assert.Equal(t, 3, stat.Total)
+	assert.Equal(t, 2, stat.Versions["1.0.0.0"])
+	assert.Equal(t, 2, len(stat.Days))
+
+	assert.Equal(t, 3, stat.Since(0, now))
+	assert.Equal(t, 2, stat.Since(1, now))
+	assert.Equal(t, 3, stat.Since(30, now))
+}
+
+func Test_RecordDownloads_Forward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgmirror")
+
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	ps := NewComposerService()
+	ps.Logger = log.NewEntry(log.New())
+	ps.Config.Path = dir
+	ps.Config.ForwardDownloads = true
+	ps.Config.Upstreams = []*Upstream{
+		{Server: "https://packagist.org"},
+		{Server: "https://satis.example.com"},
+	}
+
+	assert.NoError(t, ps.openDatabase())
+
+	defer ps.DB.Close()
+
+	err = ps.DB.Update(func(tx *bolt.Tx) error {
+		for _, pi := range []*PackageInformation{
+			{Package: "symfony/symfony", Upstream: "https://packagist.org"},
+			{Package: "acme/legacy"},
+			{Package: "acme/satis", Upstream: "https://satis.example.com"},
+			{Package: "acme/private", Private: true},
+			{Package: "acme/inline"},
+		} {
+			data, _ := pkgmirror.Marshal(pi)
+
+			tx.Bucket(ps.Config.Code).Put([]byte(pi.Package), data)
+		}
+
+		return tx.Bucket(INLINE_BUCKET).Put([]byte("acme/inline"), []byte("1"))
+	})
+
+	assert.NoError(t, err)
+
+	downloads := []*DownloadNotification{}
+
+	for _, name := range []string{"symfony/symfony", "acme/legacy", "acme/satis", "acme/private", "acme/inline", "acme/unknown"} {
+		downloads = append(downloads, &DownloadNotification{Name: name, Version: "1.0.0.0"})
+	}
+
+	assert.NoError(t, ps.RecordDownloads(downloads))
+
+	// only the packages of the primary upstream are forwarded
+	assert.Equal(t, 2, len(ps.downloads))
+	assert.Equal(t, "symfony/symfony", ps.downloads[0].Name)
+	assert.Equal(t, "acme/legacy", ps.downloads[1].Name)
+
+	// all the known packages are recorded locally
+	for _, name := range []string{"acme/satis", "acme/private", "acme/inline"} {
+		stat, err := ps.GetDownloads(name)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, stat.Total)
+	}
+}
+
+func Test_ForwardDownloads_Failure(t *testing.T) {
+	ps := NewComposerService()
+	ps.Logger = log.NewEntry(log.New())
+	ps.Config.ForwardDownloads = true
+
+	// the notifications received while the request is running are queued after the failed batch
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ps.downloadsLock.Lock()
+		for i := 0; i < 10; i++ {
+			ps.downloads = append(ps.downloads, &DownloadNotification{Name: "acme/new", Version: "1.0.0.0"})
+		}
+		ps.downloadsLock.Unlock()
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	defer server.Close()
+
+	ps.NotifyBatchURL = server.URL
+
+	for i := 0; i < DOWNLOADS_MAX_FORWARDED; i++ {
+		ps.downloads = append(ps.downloads, &DownloadNotification{Name: "acme/old", Version: "1.0.0.0"})
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Error(t, ps.ForwardDownloads())
+		assert.Equal(t, DOWNLOADS_MAX_FORWARDED, len(ps.downloads))
+	}
+
+	// the oldest notifications are dropped
+	assert.Equal(t, "acme/old", ps.downloads[0].Name)
+	assert.Equal(t, "acme/new", ps.downloads[DOWNLOADS_MAX_FORWARDED-30].Name)
+	assert.Equal(t, "acme/old", ps.downloads[DOWNLOADS_MAX_FORWARDED-31].Name)
+}
+
+func Test_GetLazyPackage_Missing(t *testing.T) {
+	var hits int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+
+		time.Sleep(50 * time.Millisecond)
+
+		http.NotFound(w, r)
+	}))
+
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pkgmirror")
+
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	ps := NewComposerService()
+	ps.Logger = log.NewEntry(log.New())
+	ps.Config.Path = dir
+	ps.Config.Upstreams = []*Upstream{
+		{Server: server.URL, BasePublicServer: server.URL, MetadataURL: "/p2/%package%.json", loaded: true},
+	}
+
+	assert.NoError(t, ps.openDatabase())
+
+	defer ps.DB.Close()
+
+	// the concurrent requests share the same upstream request
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := ps.GetLazyPackage("foo/missing")
+
+			assert.Equal(t, pkgmirror.ResourceNotFoundError, err)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// the missing package is not requested again before the ttl
+	_, err = ps.GetLazyPackage("foo/missing")
+
+	assert.Equal(t, pkgmirror.ResourceNotFoundError, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	ps.lazyMissing["foo/missing"] = time.Now().Add(-LAZY_MISSING_TTL)
+
+	ps.GetLazyPackage("foo/missing")
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+type testTransport func(req *http.Request) (*http.Response, error)
+
+func (f testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func Test_ProxyDist_Github_OAuth(t *testing.T) {
+	var authorization string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+
+		w.Write([]byte("zip content"))
+	}))
+
+	defer server.Close()
+
+	// the github requests are sent to the test server
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = testTransport(func(req *http.Request) (*http.Response, error) {
+		req.URL.Scheme = "http"
+		req.URL.Host = server.Listener.Addr().String()
+
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	defer func() {
+		http.DefaultClient.Transport = transport
+	}()
+
+	dir, err := ioutil.TempDir("", "pkgmirror")
+
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	ps := NewComposerService()
+	ps.Logger = log.NewEntry(log.New())
+	ps.StateChan = make(chan pkgmirror.State, 10)
+	ps.Config.Path = dir
+	ps.Config.PublicServer = "http://localhost:8000"
+	ps.Rewriter = git.NewRewriter("http://localhost:8000", nil)
+	ps.Auth = &pkgmirror.Authenticator{GithubOAuth: "gh-token"}
+
+	assert.NoError(t, ps.openDatabase())
+
+	defer ps.DB.Close()
+
+	version := &Package{Name: "foo/bar", Version: "1.0.0", VersionNormalized: "1.0.0.0"}
+	version.Dist.Type = "zip"
+	version.Dist.URL = "https://api.github.com/repos/foo/bar/zipball/d188f8926162ae1870df40047e0f3ddee5c133e0"
+	version.Dist.Reference = "d188f8926162ae1870df40047e0f3ddee5c133e0"
+
+	pi := &PackageInformation{
+		Package: "foo/bar",
+		PackageResult: PackageResult{
+			Packages: map[string]map[string]*Package{"foo/bar": {"1.0.0": version}},
+		},
+	}
+
+	assert.NoError(t, ps.savePackage(pi))
+
+	// the git mirror has no credentials, the dist file is served by the composer mirror
+	versions, err := ps.getPackageVersions("foo/bar")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8000/composer/packagist/dists/foo/bar/1.0.0.0/d188f8926162ae1870df40047e0f3ddee5c133e0.zip", versions["1.0.0"].Dist.URL)
+
+	_, err = ps.GetMirrorDistUrl("foo/bar", "d188f8926162ae1870df40047e0f3ddee5c133e0")
+
+	assert.Equal(t, pkgmirror.ResourceNotFoundError, err)
+
+	w := httptest.NewRecorder()
+
+	assert.NoError(t, ps.ProxyDist(w, "foo/bar", "d188f8926162ae1870df40047e0f3ddee5c133e0"))
+	assert.Equal(t, "zip content", w.Body.String())
+	assert.Equal(t, "token gh-token", authorization)
+}
+
+func createTestArchive(t *testing.T, files map[string]string) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := zip.NewWriter(buf)
+
+	for name, content := range files {
+		f, err := w.Create(name)
+
+		assert.NoError(t, err)
+
+		f.Write([]byte(content))
+	}
+
+	assert.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func Test_NormalizeVersion(t *testing.T) {
+	assert.Equal(t, "1.2.0.0", NormalizeVersion("v1.2"))
+	assert.Equal(t, "1.2.3.0", NormalizeVersion("1.2.3"))
+	assert.Equal(t, "1.2.3.4-beta1", NormalizeVersion("1.2.3.4-beta1"))
+	assert.Equal(t, "dev-master", NormalizeVersion("dev-master"))
+}
+
+func Test_ReadArchiveManifest(t *testing.T) {
+	archive := createTestArchive(t, map[string]string{
+		"foo-bar-1234/composer.json":          `{"name": "foo/bar", "description": "Foo Bar", "type": "library"}`,
+		"foo-bar-1234/vendor/a/composer.json": `{"name": "a/b"}`,
+	})
+
+	pkg, err := ReadArchiveManifest(archive)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "foo/bar", pkg.Name)
+	assert.Equal(t, "library", pkg.Type)
+
+	_, err = ReadArchiveManifest(createTestArchive(t, map[string]string{"README.md": "Foo"}))
+
+	assert.Error(t, err)
+
+	_, err = ReadArchiveManifest([]byte("not a zip file"))
+
+	assert.Error(t, err)
+}
+
+func Test_IsValidVcsUrl(t *testing.T) {
+	assert.True(t, IsValidVcsUrl("https://github.com/foo/bar.git"))
+	assert.True(t, IsValidVcsUrl("ssh://git@github.com/foo/bar.git"))
+	assert.True(t, IsValidVcsUrl("git@github.com:foo/bar.git"))
+	assert.False(t, IsValidVcsUrl("--upload-pack=touch /tmp/pwn"))
+	assert.False(t, IsValidVcsUrl("file:///var/lib/repositories/foo.git"))
+	assert.False(t, IsValidVcsUrl("/var/lib/repositories/foo.git"))
+	assert.False(t, IsValidVcsUrl("http://github.com/foo/bar.git"))
+	assert.False(t, IsValidVcsUrl(""))
+}
+
+func Test_ComposerConfig_IsAllowed(t *testing.T) {
+	c := &ComposerConfig{}
+
+	assert.True(t, c.IsAllowed("symfony/symfony"))
+
+	c.Include = []string{"symfony/*", "drupal/*"}
+	c.Exclude = []string{"symfony/symfony", "*/*-bundle"}
+
+	assert.True(t, c.IsAllowed("symfony/console"))
+	assert.True(t, c.IsAllowed("drupal/core"))
+	assert.False(t, c.IsAllowed("symfony/symfony"))
+	assert.False(t, c.IsAllowed("symfony/monolog-bundle"))
+	assert.False(t, c.IsAllowed("laravel/framework"))
+}
+
+func Test_ComposerConfig_Authorize(t *testing.T) {
+	c := &ComposerConfig{}
+
+	// the write requests are disabled without token
+	_, ok := c.Authorize("")
+	assert.False(t, ok)
+
+	_, ok = c.Authorize("Bearer ")
+	assert.False(t, ok)
+
+	c.Tokens = map[string]string{"alice": "secret-a", "bob": "secret-b", "empty": ""}
+
+	identity, ok := c.Authorize("Bearer secret-b")
+	assert.True(t, ok)
+	assert.Equal(t, "bob", identity)
+
+	_, ok = c.Authorize("Bearer other")
+	assert.False(t, ok)
+
+	_, ok = c.Authorize("secret-a")
+	assert.False(t, ok)
+
+	_, ok = c.Authorize("Bearer ")
+	assert.False(t, ok)
+}
+
+func Test_ExpandVersions(t *testing.T) {
+	versions := []*Package{
+		{Version: "1.1.0", Description: "Foo", Type: "library"},
+		{Version: "1.0.0", Description: "Foo"},
+	}
+
+	minified, err := MinifyVersions(versions)
+
+	assert.NoError(t, err)
+
+	expanded, err := ExpandVersions(minified)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(expanded))
+	assert.Equal(t, "1.1.0", expanded[0].Version)
+	assert.Equal(t, "library", expanded[0].Type)
+	assert.Equal(t, "1.0.0", expanded[1].Version)
+	assert.Equal(t, "Foo", expanded[1].Description)
+	assert.Equal(t, "", expanded[1].Type)
+}
+
+func Test_IsChangesCursorValid(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	assert.False(t, IsChangesCursorValid(0, now))
+	assert.True(t, IsChangesCursorValid(now.Add(-1*time.Hour).Unix()*CHANGES_TIMESTAMP_UNIT, now))
+	assert.False(t, IsChangesCursorValid(now.Add(-48*time.Hour).Unix()*CHANGES_TIMESTAMP_UNIT, now))
+}
+
+func Test_SyncChanges(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/changes.json":
+			w.Write([]byte(fmt.Sprintf(`{"actions": [
+				{"type": "update", "package": "foo/bar", "time": 1},
+				{"type": "delete", "package": "foo/removed", "time": 2}
+			], "timestamp": %d}`, time.Now().Unix()*CHANGES_TIMESTAMP_UNIT)))
+		case "/p2/foo/bar.json":
+			w.Write([]byte(`{"packages": {"foo/bar": [{"name": "foo/bar", "version": "1.1.0"}, {"version": "1.0.0"}]}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pkgmirror")
+
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	ps := NewComposerService()
+	ps.Logger = log.NewEntry(log.New())
+	ps.StateChan = make(chan pkgmirror.State, 10)
+	ps.Config.Path = dir
+	ps.Rewriter = git.NewRewriter("http://localhost:8000", nil)
+
+	go func() {
+		for range ps.StateChan {
+		}
+	}()
+
+	assert.NoError(t, ps.openDatabase())
+
+	defer ps.DB.Close()
+
+	for _, name := range []string{"foo/bar", "foo/removed", "foo/removed-fork"} {
+		assert.NoError(t, ps.savePackage(&PackageInformation{
+			Package:    name,
+			HashSource: "provider-hash",
+			PackageResult: PackageResult{
+				Packages: map[string]map[string]*Package{name: {"1.0.0": {Name: name, Version: "1.0.0"}}},
+			},
+		}))
+	}
+
+	assert.NoError(t, ps.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"foo/removed", "foo/removed-fork"} {
+			tx.Bucket(QUARANTINE_BUCKET).Put(GetVersionKey(name, "1.0.0"), []byte("{}"))
+			tx.Bucket(ADVISORIES_BUCKET).Put([]byte(name), []byte("[]"))
+		}
+
+		return nil
+	}))
+
+	assert.NoError(t, ps.setChangesCursor(time.Now().Unix()*CHANGES_TIMESTAMP_UNIT))
+
+	assert.NoError(t, ps.syncChanges(&PackagesResult{
+		MetadataChangesURL: server.URL + "/metadata/changes.json",
+		MetadataURL:        server.URL + "/p2/%package%.json",
+	}))
+
+	// the updated package is refreshed without a full walk
+	pi, err := ps.GetPackage("foo/bar")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "provider-hash", pi.HashSource)
+
+	versions, err := ps.getPackageVersions("foo/bar")
+
+	assert.NoError(t, err)
+	assert.Contains(t, versions, "1.1.0")
+
+	// the deleted package is removed with its records
+	_, err = ps.GetPackage("foo/removed")
+
+	assert.Error(t, err)
+
+	ps.DB.View(func(tx *bolt.Tx) error {
+		assert.Empty(t, tx.Bucket(VERSIONS_BUCKET).Get(GetVersionKey("foo/removed", "1.0.0")))
+		assert.Empty(t, tx.Bucket(QUARANTINE_BUCKET).Get(GetVersionKey("foo/removed", "1.0.0")))
+		assert.Empty(t, tx.Bucket(ADVISORIES_BUCKET).Get([]byte("foo/removed")))
+
+		// the packages sharing the name prefix are kept
+		assert.NotEmpty(t, tx.Bucket(VERSIONS_BUCKET).Get(GetVersionKey("foo/removed-fork", "1.0.0")))
+		assert.NotEmpty(t, tx.Bucket(QUARANTINE_BUCKET).Get(GetVersionKey("foo/removed-fork", "1.0.0")))
+		assert.NotEmpty(t, tx.Bucket(ADVISORIES_BUCKET).Get([]byte("foo/removed-fork")))
+
+		return nil
+	})
+}
+
+func Test_FileChanges_IsDeleted(t *testing.T) {
+	assert.True(t, (&FileChanges{Stable: "delete"}).IsDeleted())
+	assert.True(t, (&FileChanges{Stable: "delete", Dev: "delete"}).IsDeleted())
+	assert.False(t, (&FileChanges{Stable: "delete", Dev: "update"}).IsDeleted())
+	assert.False(t, (&FileChanges{Dev: "delete"}).IsDeleted())
+	assert.False(t, (&FileChanges{Stable: "update", Dev: "delete"}).IsDeleted())
+}
+
+func Test_LoadMetadata_Without_Dev_File(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/p2/foo/bar.json" {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		w.Write([]byte(`{"packages": {"foo/bar": [{"version": "1.0.0", "name": "foo/bar"}]}}`))
+	}))
+
+	defer server.Close()
+
+	ps := NewComposerService()
+	ps.Config.BasePublicServer = server.URL
+
+	pi := &PackageInformation{Package: "foo/bar"}
+
+	assert.NoError(t, ps.loadMetadata("/p2/%package%.json", pi))
+	assert.Equal(t, 1, len(pi.PackageResult.Packages["foo/bar"]))
+	assert.Contains(t, pi.PackageResult.Packages["foo/bar"], "1.0.0")
+
+	// the stable file is required
+	pi = &PackageInformation{Package: "foo/unknown"}
+
+	assert.Equal(t, pkgmirror.ResourceNotFoundError, ps.loadMetadata("/p2/%package%.json", pi))
+}
+
+func Test_MergeAdvisories(t *testing.T) {
+	current := []*SecurityAdvisory{
+		{AdvisoryID: "PKSA-1", Title: "old"},
+		{AdvisoryID: "PKSA-2", Title: "kept"},
+	}
+
+	merged := MergeAdvisories(current, []*SecurityAdvisory{
+		{AdvisoryID: "PKSA-1", Title: "new"},
+		{AdvisoryID: "PKSA-3", Title: "added"},
+	})
+
+	assert.Equal(t, 3, len(merged))
+	assert.Equal(t, "kept", merged[0].Title)
+	assert.Equal(t, "new", merged[1].Title)
+	assert.Equal(t, "added", merged[2].Title)
+}
+
+func Test_SecurityAdvisory_IsUpdatedSince(t *testing.T) {
+	advisory := &SecurityAdvisory{ReportedAt: "2016-08-01 10:00:00"}
+
+	assert.True(t, advisory.IsUpdatedSince(0))
+	assert.True(t, advisory.IsUpdatedSince(time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC).Unix()))
+	assert.False(t, advisory.IsUpdatedSince(time.Date(2016, 9, 1, 0, 0, 0, 0, time.UTC).Unix()))
+}
+
+func Test_ParseGitArchiveUrl(t *testing.T) {
+	servers := []string{"github.com", "git.drupal.org"}
+
+	server, repository, ref, ok := ParseGitArchiveUrl("/git/github.com/rande/pkgmirror/0a1b2c.zip", servers)
+
+	assert.True(t, ok)
+	assert.Equal(t, "github.com", server)
+	assert.Equal(t, "rande/pkgmirror.git", repository)
+	assert.Equal(t, "0a1b2c", ref)
+
+	_, _, _, ok = ParseGitArchiveUrl("/git/bitbucket.org/rande/pkgmirror/0a1b2c.zip", servers)
+
+	assert.False(t, ok)
+
+	_, _, _, ok = ParseGitArchiveUrl("/static/drupal/views-7.x-3.14.zip", servers)
+
+	assert.False(t, ok)
+}
+
+func Test_ParseGitRepositoryUrl(t *testing.T) {
+	servers := []string{"github.com"}
+
+	server, repository, ok := ParseGitRepositoryUrl("/git/github.com/rande/pkgmirror.git", servers)
+
+	assert.True(t, ok)
+	assert.Equal(t, "github.com", server)
+	assert.Equal(t, "rande/pkgmirror.git", repository)
+
+	_, _, ok = ParseGitRepositoryUrl("/git/github.com/.git", servers)
+
+	assert.False(t, ok)
+}
+
+func Test_GetInlinePackages(t *testing.T) {
+	packages, err := GetInlinePackages(json.RawMessage(`[]`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(packages))
+
+	packages, err = GetInlinePackages(json.RawMessage(`{"foo/bar": {"1.0.0": {"name": "foo/bar", "version": "1.0.0"}, "dev-master": {"name": "foo/bar", "version": "dev-master"}}}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(packages))
+	assert.Equal(t, 2, len(packages["foo/bar"]))
+	assert.Equal(t, "dev-master", packages["foo/bar"]["dev-master"].Version)
+
+	_, err = GetInlinePackages(json.RawMessage(`{"foo/bar": "invalid"}`))
+
+	assert.Error(t, err)
+}
+
+func Test_CollectInlinePackages(t *testing.T) {
+	// the include file is only available on the satis server
+	satis := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/include/all$abc.json" {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		w.Write([]byte(`{"packages": {"foo/bar": {"1.0.0": {"name": "foo/bar", "version": "1.0.0"}}}}`))
+	}))
+
+	defer satis.Close()
+
+	ps := NewComposerService()
+	ps.Config.SourceServer = "http://localhost:1"
+
+	upstreams := []*Upstream{{Server: satis.URL}, {Server: "http://localhost:2"}}
+	results := []*PackagesResult{
+		{Packages: json.RawMessage(`[]`)},
+		{Packages: json.RawMessage(`{"foo/bar": {"2.0.0": {"name": "foo/bar", "version": "2.0.0"}}, "acme/baz": {"1.0.0": {"name": "acme/baz", "version": "1.0.0"}}}`)},
+	}
+
+	json.Unmarshal([]byte(`{"include/all$abc.json": {"sha1": "abc"}}`), &results[0].Includes)
+
+	inline, err := ps.collectInlinePackages(upstreams, results)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(inline))
+
+	// the package is loaded from the upstream with the highest priority
+	assert.Equal(t, 0, inline["foo/bar"].Index)
+	assert.Equal(t, satis.URL, inline["foo/bar"].Upstream.Server)
+	assert.Contains(t, inline["foo/bar"].Versions, "1.0.0")
+
+	assert.Equal(t, 1, inline["acme/baz"].Index)
+
+	pi := ps.newInlinePackage("acme/baz", inline["acme/baz"].Upstream, inline["acme/baz"].Versions)
+
+	assert.Equal(t, "http://localhost:2", pi.Upstream)
+	assert.Equal(t, 64, len(pi.HashSource))
+}
+
+func Test_NormalizeMirrorUrl(t *testing.T) {
+	assert.Equal(t, "https---github.com-rande-pkgmirror.git", NormalizeMirrorUrl("https://github.com/rande/pkgmirror.git"))
+	assert.Equal(t, "git-github.com-rande-pkgmirror.git", NormalizeMirrorUrl("git@github.com:rande/pkgmirror.git/"))
+}
+
+func Test_IsMirrorReference(t *testing.T) {
+	assert.True(t, IsMirrorReference("d188f8926162ae1870df40047e0f3ddee5c133e0", "d188f8926162ae1870df40047e0f3ddee5c133e0"))
+	assert.True(t, IsMirrorReference("v1.0.0", "2888cd106bd98b888fca74c785bd6cf5"))
+	assert.False(t, IsMirrorReference("v1.0.0", "v1.0.1"))
+}
+
+func Test_ExpiredGenerations(t *testing.T) {
+	now := time.Now()
+
+	generations := []*Generation{
+		{ID: 1, CreatedAt: now.Add(-5 * time.Hour)},
+		{ID: 2, CreatedAt: now.Add(-4 * time.Hour)},
+		{ID: 3, CreatedAt: now.Add(-3 * time.Hour)},
+		{ID: 4, CreatedAt: now.Add(-30 * time.Minute)},
+		{ID: 5, CreatedAt: now.Add(-10 * time.Minute)},
+	}
+
+	// the generation 3 has been superseded 30 minutes ago
+	assert.Equal(t, 2, ExpiredGenerations(generations, 1, time.Hour, now))
+	assert.Equal(t, 4, ExpiredGenerations(generations, 1, 0, now))
+	assert.Equal(t, 2, ExpiredGenerations(generations, 3, 0, now))
+	assert.Equal(t, 0, ExpiredGenerations(generations, 10, 0, now))
+	assert.Equal(t, 0, ExpiredGenerations(generations[:1], 0, 0, now))
+}
+
+func Test_GetGenerationKey(t *testing.T) {
+	assert.Equal(t, []byte("00000000000000000042"), GetGenerationKey(42))
+	assert.True(t, string(GetGenerationKey(9)) < string(GetGenerationKey(10)))
+}
+
+func Test_GetMetadataPackage(t *testing.T) {
+	assert.Equal(t, "symfony/symfony", GetMetadataPackage("p2/symfony/symfony.json"))
+	assert.Equal(t, "symfony/symfony", GetMetadataPackage("p2/symfony/symfony~dev.json"))
+	assert.Equal(t, "", GetMetadataPackage("p/provider-latest$09fc55f7.json"))
+	assert.Equal(t, "", GetMetadataPackage("packages.json"))
+}
+
+func Test_GetVersionKey(t *testing.T) {
+	assert.Equal(t, []byte("symfony/symfony@v3.1.0"), GetVersionKey("symfony/symfony", "v3.1.0"))
+}
+
+func Test_MatchQuarantineRules(t *testing.T) {
+	rules := []*QuarantineRule{{Pattern: "symfony/*"}, {Pattern: "rande/pkgmirror"}}
+
+	assert.Equal(t, rules[0], MatchQuarantineRules(rules, "symfony/symfony"))
+	assert.Equal(t, rules[1], MatchQuarantineRules(rules, "rande/pkgmirror"))
+	assert.Nil(t, MatchQuarantineRules(rules, "rande/gonode"))
+	assert.Nil(t, MatchQuarantineRules([]*QuarantineRule{}, "symfony/symfony"))
+}
+
+func Test_QuarantineEntry_IsExpired(t *testing.T) {
+	now := time.Now()
+	entry := &QuarantineEntry{Status: QUARANTINE_PENDING, FirstSeen: now.Add(-2 * time.Hour)}
+
+	assert.True(t, entry.IsExpired(time.Hour, now))
+	assert.False(t, entry.IsExpired(3*time.Hour, now))
+	assert.False(t, entry.IsExpired(0, now))
+
+	entry.Approve("api", now)
+
+	assert.Equal(t, QUARANTINE_APPROVED, entry.Status)
+	assert.Equal(t, "api", entry.ApprovedBy)
+	assert.False(t, entry.IsExpired(time.Hour, now))
+}
+
+func Test_QuarantineVersions_Changed_Reference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgmirror")
+
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	ps := NewComposerService()
+	ps.Logger = log.NewEntry(log.New())
+	ps.Config.Path = dir
+	ps.Config.Quarantine = true
+
+	assert.NoError(t, ps.openDatabase())
+
+	defer ps.DB.Close()
+
+	newPackage := func(reference string) *PackageInformation {
+		version := &Package{Name: "foo/bar", Version: "1.0.0"}
+		version.Dist.Reference = reference
+		version.Source.Reference = reference
+
+		return &PackageInformation{
+			Package: "foo/bar",
+			PackageResult: PackageResult{
+				Packages: map[string]map[string]*Package{"foo/bar": {"1.0.0": version}},
+			},
+		}
+	}
+
+	quarantine := func(pi *PackageInformation) *QuarantineEntry {
+		entry := &QuarantineEntry{}
+
+		assert.NoError(t, ps.DB.Update(func(tx *bolt.Tx) error {
+			if err := ps.quarantineVersions(tx, pi); err != nil {
+				return err
+			}
+
+			return json.Unmarshal(tx.Bucket(QUARANTINE_BUCKET).Get(GetVersionKey("foo/bar", "1.0.0")), entry)
+		}))
+
+		return entry
+	}
+
+	entry := quarantine(newPackage("abc"))
+
+	assert.Equal(t, QUARANTINE_PENDING, entry.Status)
+
+	// approve the pending definition
+	assert.NoError(t, ps.DB.Update(func(tx *bolt.Tx) error {
+		entry.Approve("api", time.Now())
+
+		data, _ := json.Marshal(entry)
+
+		return tx.Bucket(QUARANTINE_BUCKET).Put(GetVersionKey("foo/bar", "1.0.0"), data)
+	}))
+
+	pi := newPackage("abc")
+	entry = quarantine(pi)
+
+	assert.Equal(t, QUARANTINE_APPROVED, entry.Status)
+	assert.Equal(t, "abc", entry.DistReference)
+	assert.Contains(t, pi.PackageResult.Packages["foo/bar"], "1.0.0")
+
+	// the reference changed upstream, the version must be approved again
+	pi = newPackage("def")
+	entry = quarantine(pi)
+
+	assert.Equal(t, QUARANTINE_PENDING, entry.Status)
+	assert.Equal(t, "def", entry.Definition.Dist.Reference)
+	assert.NotContains(t, pi.PackageResult.Packages["foo/bar"], "1.0.0")
+}
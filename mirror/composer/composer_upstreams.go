@@ -0,0 +1,158 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rande/pkgmirror"
+)
+
+// Upstream is a composer repository aggregated by the mirror, when a package is available
+// on several upstreams the one with the highest priority is used.
+type Upstream struct {
+	Server           string
+	BasePublicServer string
+	Priority         int
+	ProvidersURL     string // loaded from the packages.json file
+	MetadataURL      string
+	ProvidersLazyURL string
+	Credentials      *pkgmirror.CredentialsConfig // only sent to the upstream host
+	loaded           bool
+}
+
+func NewUpstream(server string, priority int) (*Upstream, error) {
+	u, err := url.Parse(server)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Upstream{
+		Server:           server,
+		BasePublicServer: fmt.Sprintf("%s://%s", u.Scheme, u.Host),
+		Priority:         priority,
+	}, nil
+}
+
+// GetAbsoluteUrl resolves an url advertised by the upstream packages.json file.
+func (u *Upstream) GetAbsoluteUrl(path string) string {
+	if len(path) == 0 || strings.Contains(path, "://") {
+		return path
+	}
+
+	return fmt.Sprintf("%s%s", u.BasePublicServer, path)
+}
+
+// NewUpstreamsAuthenticator creates the authenticator of the upstreams, the credentials of an
+// upstream are only sent to its host. nil is returned if no credentials are configured.
+func NewUpstreamsAuthenticator(upstreams []*Upstream) (*pkgmirror.Authenticator, error) {
+	var auth *pkgmirror.Authenticator
+
+	for _, upstream := range upstreams {
+		if upstream.Credentials == nil {
+			continue
+		}
+
+		if auth == nil {
+			auth = &pkgmirror.Authenticator{}
+		}
+
+		if err := auth.Add([]string{upstream.Server}, upstream.Credentials); err != nil {
+			return nil, err
+		}
+	}
+
+	return auth, nil
+}
+
+// SortUpstreams sorts the upstreams by priority, the configuration order is kept for
+// upstreams with the same priority.
+func SortUpstreams(upstreams []*Upstream) {
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		return upstreams[i].Priority > upstreams[j].Priority
+	})
+}
+
+// GetProviderKey returns the key used to store a provider file, the providers of the secondary
+// upstreams are prefixed to avoid collisions, ie: p/upstream-1-provider-latest$%hash%.json
+func GetProviderKey(index int, provider string) string {
+	if index == 0 {
+		return provider
+	}
+
+	return fmt.Sprintf("p/upstream-%d-%s", index, path.Base(provider))
+}
+
+// initUpstreams builds the upstream list once, before the goroutines reading it are started. Without
+// configured upstreams, the source server is the only upstream.
+func (ps *ComposerService) initUpstreams() {
+	if len(ps.Config.Upstreams) > 0 {
+		return
+	}
+
+	ps.Config.Upstreams = []*Upstream{{
+		Server:           ps.Config.SourceServer,
+		BasePublicServer: ps.Config.BasePublicServer,
+	}}
+}
+
+// getUpstreams returns the upstreams sorted by priority, the first one is the primary upstream.
+func (ps *ComposerService) getUpstreams() []*Upstream {
+	return ps.Config.Upstreams
+}
+
+// getUpstream returns the upstream matching the server, packages stored before the
+// upstreams were introduced belong to the primary upstream.
+func (ps *ComposerService) getUpstream(server string) *Upstream {
+	upstreams := ps.getUpstreams()
+
+	for _, upstream := range upstreams {
+		if upstream.Server == server {
+			return upstream
+		}
+	}
+
+	return upstreams[0]
+}
+
+// loadUpstreams loads the packages.json file of each upstream, an error is returned if one
+// of the files cannot be loaded to avoid generating incomplete entry points.
+func (ps *ComposerService) loadUpstreams(upstreams []*Upstream) ([]*PackagesResult, error) {
+	results := []*PackagesResult{}
+
+	for _, upstream := range upstreams {
+		result := &PackagesResult{}
+
+		if err := pkgmirror.LoadRemoteStructWithAuth(fmt.Sprintf("%s/packages.json", upstream.Server), result, ps.Auth); err != nil {
+			ps.Logger.WithFields(log.Fields{
+				"action": "loadUpstreams",
+				"path":   "packages.json",
+				"server": upstream.Server,
+				"error":  err.Error(),
+			}).Error("Error loading packages.json")
+
+			return nil, err
+		}
+
+		// the lazy requests read the entry points while the sync runs
+		ps.upstreamsLock.Lock()
+		upstream.ProvidersURL = result.ProvidersURL
+		upstream.MetadataURL = result.MetadataURL
+		upstream.ProvidersLazyURL = result.ProvidersLazyURL
+		upstream.loaded = true
+		ps.upstreamsLock.Unlock()
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,129 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rande/pkgmirror"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewUpstream(t *testing.T) {
+	upstream, err := NewUpstream("https://packages.drupal.org/8", 10)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://packages.drupal.org/8", upstream.Server)
+	assert.Equal(t, "https://packages.drupal.org", upstream.BasePublicServer)
+	assert.Equal(t, 10, upstream.Priority)
+}
+
+func Test_SortUpstreams(t *testing.T) {
+	upstreams := []*Upstream{
+		{Server: "https://packagist.org", Priority: 0},
+		{Server: "https://satis.example.com", Priority: 20},
+		{Server: "https://packages.drupal.org/8", Priority: 10},
+		{Server: "https://mirror.example.com", Priority: 0},
+	}
+
+	SortUpstreams(upstreams)
+
+	assert.Equal(t, "https://satis.example.com", upstreams[0].Server)
+	assert.Equal(t, "https://packages.drupal.org/8", upstreams[1].Server)
+	assert.Equal(t, "https://packagist.org", upstreams[2].Server)
+	assert.Equal(t, "https://mirror.example.com", upstreams[3].Server)
+}
+
+func Test_GetProviderKey(t *testing.T) {
+	assert.Equal(t, "p/provider-latest$%hash%.json", GetProviderKey(0, "p/provider-latest$%hash%.json"))
+	assert.Equal(t, "p/upstream-1-provider-latest$%hash%.json", GetProviderKey(1, "p/provider-latest$%hash%.json"))
+	assert.Equal(t, "p/upstream-2-provider-2011-2$%hash%.json", GetProviderKey(2, "drupal/provider-2011-2$%hash%.json"))
+}
+
+func Test_GetUpstream(t *testing.T) {
+	ps := NewComposerService()
+	ps.Config.Upstreams = []*Upstream{
+		{Server: "https://satis.example.com", Priority: 20},
+		{Server: "https://packagist.org", Priority: 0},
+	}
+
+	assert.Equal(t, "https://packagist.org", ps.getUpstream("https://packagist.org").Server)
+
+	// packages stored without upstream belong to the primary upstream
+	assert.Equal(t, "https://satis.example.com", ps.getUpstream("").Server)
+}
+
+func Test_InitUpstreams(t *testing.T) {
+	ps := NewComposerService()
+	ps.Config.SourceServer = "https://packagist.org"
+	ps.Config.BasePublicServer = "https://packagist.org"
+
+	ps.initUpstreams()
+
+	assert.Equal(t, 1, len(ps.getUpstreams()))
+	assert.Equal(t, "https://packagist.org", ps.getUpstreams()[0].Server)
+
+	// the configured upstreams are kept
+	ps.Config.Upstreams = []*Upstream{{Server: "https://satis.example.com"}}
+
+	ps.initUpstreams()
+
+	assert.Equal(t, "https://satis.example.com", ps.getUpstreams()[0].Server)
+}
+
+func Test_LoadUpstreams_Credentials(t *testing.T) {
+	headers := map[string]string{}
+	lock := sync.Mutex{}
+
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			headers[name] = req.Header.Get("Authorization")
+			lock.Unlock()
+
+			res.Write([]byte(`{"packages": []}`))
+		}))
+	}
+
+	private := newServer("private")
+	defer private.Close()
+
+	public := newServer("public")
+	defer public.Close()
+
+	ps := NewComposerService()
+	ps.Logger = log.NewEntry(log.New())
+	ps.Config.Upstreams = []*Upstream{
+		{Server: private.URL, Priority: 10, Credentials: &pkgmirror.CredentialsConfig{Token: "private-token"}},
+		{Server: public.URL},
+	}
+
+	auth, err := NewUpstreamsAuthenticator(ps.Config.Upstreams)
+
+	assert.NoError(t, err)
+
+	ps.Auth = auth
+
+	_, err = ps.loadUpstreams(ps.Config.Upstreams)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer private-token", headers["private"])
+
+	// the public upstream never receives the credentials
+	assert.Contains(t, headers, "public")
+	assert.Empty(t, headers["public"])
+}
+
+func Test_NewUpstreamsAuthenticator_Empty(t *testing.T) {
+	auth, err := NewUpstreamsAuthenticator([]*Upstream{{Server: "https://packagist.org"}})
+
+	assert.NoError(t, err)
+	assert.Nil(t, auth)
+}
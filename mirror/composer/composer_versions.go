@@ -0,0 +1,132 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	VERSIONS_BUCKET = []byte("_versions")
+)
+
+// GetVersionKey returns the key of a version in the versions and quarantine buckets, the
+// versions of a package share the same prefix.
+func GetVersionKey(name, version string) []byte {
+	return []byte(fmt.Sprintf("%s@%s", name, version))
+}
+
+// recordVersions keeps the upstream urls and the date a version has been seen for the first
+// time, it must be called before the urls are rewritten.
+func (ps *ComposerService) recordVersions(tx *bolt.Tx, pkg *PackageInformation) error {
+	vb := tx.Bucket(VERSIONS_BUCKET)
+	now := time.Now()
+
+	for version, definition := range pkg.PackageResult.Packages[pkg.Package] {
+		key := GetVersionKey(pkg.Package, version)
+		record := &VersionRecord{}
+
+		if data := vb.Get(key); len(data) > 0 {
+			if err := json.Unmarshal(data, record); err != nil {
+				return err
+			}
+
+			if record.DistURL == definition.Dist.URL && record.SourceURL == definition.Source.URL {
+				continue
+			}
+		} else {
+			record.FirstSeen = now
+		}
+
+		record.DistURL = definition.Dist.URL
+		record.SourceURL = definition.Source.URL
+
+		if data, err := json.Marshal(record); err != nil {
+			return err
+		} else if err := vb.Put(key, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetPackageDetail returns the published versions of a package with their upstream urls,
+// the versions stored before the records were introduced have no upstream urls.
+func (ps *ComposerService) GetPackageDetail(name string) (*PackageDetail, error) {
+	detail := &PackageDetail{
+		Versions: []*VersionDetail{},
+	}
+
+	err := ps.DB.View(func(tx *bolt.Tx) error {
+		pi := &PackageInformation{}
+
+		if data := tx.Bucket(ps.Config.Code).Get([]byte(name)); len(data) == 0 {
+			return pkgmirror.ResourceNotFoundError
+		} else if err := pkgmirror.Unmarshal(data, pi); err != nil {
+			return err
+		}
+
+		detail.Package = pi.Package
+		detail.Upstream = pi.Upstream
+		detail.Private = pi.Private
+		detail.HashSource = pi.HashSource
+		detail.HashTarget = pi.HashTarget
+
+		vb := tx.Bucket(VERSIONS_BUCKET)
+
+		for version, definition := range ps.loadPublishedVersions(tx, name) {
+			v := &VersionDetail{
+				Version:           version,
+				VersionNormalized: definition.VersionNormalized,
+				Time:              definition.Time,
+				Dist: &VersionLocation{
+					Type:      definition.Dist.Type,
+					Reference: definition.Dist.Reference,
+					URL:       definition.Dist.URL,
+				},
+				Source: &VersionLocation{
+					Type:      definition.Source.Type,
+					Reference: definition.Source.Reference,
+					URL:       definition.Source.URL,
+				},
+			}
+
+			record := &VersionRecord{}
+
+			if err := json.Unmarshal(vb.Get(GetVersionKey(name, version)), record); err == nil {
+				v.FirstSeen = &record.FirstSeen
+				v.Dist.Original = record.DistURL
+				v.Source.Original = record.SourceURL
+			}
+
+			detail.Versions = append(detail.Versions, v)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the last released versions first
+	sort.Slice(detail.Versions, func(i, j int) bool {
+		if detail.Versions[i].Time.Equal(detail.Versions[j].Time) {
+			return detail.Versions[i].Version > detail.Versions[j].Version
+		}
+
+		return detail.Versions[i].Time.After(detail.Versions[j].Time)
+	})
+
+	return detail, nil
+}
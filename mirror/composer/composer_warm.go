@@ -0,0 +1,278 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package composer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rande/pkgmirror"
+	"github.com/rande/pkgmirror/mirror/git"
+	"github.com/rande/pkgmirror/mirror/static"
+)
+
+const (
+	WARM_STATUS_CACHED  = "cached"
+	WARM_STATUS_SKIPPED = "skipped"
+	WARM_STATUS_ERROR   = "error"
+
+	WARM_JOB_RUNNING   = "running"
+	WARM_JOB_COMPLETED = "completed"
+	WARM_JOBS_HISTORY  = 20 // number of jobs kept to be retrieved by the clients
+)
+
+// Warmer downloads the dependencies of a composer.lock file, so the git and static
+// caches are populated before the packages are required.
+type Warmer struct {
+	PublicServer string
+	Rewriter     *git.Rewriter
+	Logger       *log.Entry
+	StateChan    chan pkgmirror.State
+	Git          map[string]*git.GitService       // indexed by git server, ie: github.com
+	Static       map[string]*static.StaticService // indexed by code, ie: drupal
+	jobs         []*WarmJob
+	jobsCounter  int
+	jobsLock     sync.Mutex
+}
+
+// ParseGitArchiveUrl extracts the server, the repository path and the reference from
+// a rewritten archive url, ie: /git/github.com/rande/pkgmirror/master.zip
+func ParseGitArchiveUrl(path string, servers []string) (server, repository, ref string, ok bool) {
+	for _, server := range servers {
+		prefix := fmt.Sprintf("/git/%s/", server)
+
+		if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, ".zip") {
+			continue
+		}
+
+		path = strings.TrimSuffix(path[len(prefix):], ".zip")
+
+		if i := strings.LastIndex(path, "/"); i > 0 {
+			return server, path[:i] + ".git", path[i+1:], true
+		}
+	}
+
+	return "", "", "", false
+}
+
+// ParseGitRepositoryUrl extracts the server and the repository path from a rewritten
+// repository url, ie: /git/github.com/rande/pkgmirror.git
+func ParseGitRepositoryUrl(path string, servers []string) (server, repository string, ok bool) {
+	for _, server := range servers {
+		prefix := fmt.Sprintf("/git/%s/", server)
+
+		if strings.HasPrefix(path, prefix) && strings.HasSuffix(path, ".git") && len(path) > len(prefix)+4 {
+			return server, path[len(prefix):], true
+		}
+	}
+
+	return "", "", false
+}
+
+func (wm *Warmer) gitServers() []string {
+	servers := []string{}
+
+	for server := range wm.Git {
+		servers = append(servers, server)
+	}
+
+	return servers
+}
+
+// Start runs the warm operation in the background and returns the created job, the
+// progress is reported on the state channel.
+func (wm *Warmer) Start(lock *ComposerLock) WarmJob {
+	wm.jobsLock.Lock()
+
+	wm.jobsCounter++
+
+	job := &WarmJob{
+		Id:       strconv.Itoa(wm.jobsCounter),
+		Status:   WARM_JOB_RUNNING,
+		Packages: len(lock.Packages) + len(lock.PackagesDev),
+	}
+
+	wm.jobs = append(wm.jobs, job)
+
+	if len(wm.jobs) > WARM_JOBS_HISTORY {
+		wm.jobs = wm.jobs[len(wm.jobs)-WARM_JOBS_HISTORY:]
+	}
+
+	created := *job
+
+	wm.jobsLock.Unlock()
+
+	go func() {
+		report := wm.Warm(lock)
+
+		wm.jobsLock.Lock()
+		defer wm.jobsLock.Unlock()
+
+		job.Report = report
+		job.Status = WARM_JOB_COMPLETED
+	}()
+
+	return created
+}
+
+// GetJob returns a copy of a job started recently.
+func (wm *Warmer) GetJob(id string) (WarmJob, bool) {
+	wm.jobsLock.Lock()
+	defer wm.jobsLock.Unlock()
+
+	for _, job := range wm.jobs {
+		if job.Id == id {
+			return *job, true
+		}
+	}
+
+	return WarmJob{}, false
+}
+
+// Warm processes each package of the lock file and returns a report.
+func (wm *Warmer) Warm(lock *ComposerLock) *WarmReport {
+	packages := append(lock.Packages, lock.PackagesDev...)
+
+	report := &WarmReport{
+		Results: []*WarmResult{},
+	}
+
+	for i, pkg := range packages {
+		wm.StateChan <- pkgmirror.State{
+			Message: fmt.Sprintf("Warm %s (%d/%d)", pkg.Name, i+1, len(packages)),
+			Status:  pkgmirror.STATUS_RUNNING,
+		}
+
+		result := wm.warmPackage(pkg)
+
+		switch result.Status {
+		case WARM_STATUS_CACHED:
+			report.Cached++
+		case WARM_STATUS_SKIPPED:
+			report.Skipped++
+		case WARM_STATUS_ERROR:
+			report.Errors++
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	wm.StateChan <- pkgmirror.State{
+		Message: fmt.Sprintf("Warm completed: %d cached, %d skipped, %d errors", report.Cached, report.Skipped, report.Errors),
+		Status:  pkgmirror.STATUS_HOLD,
+	}
+
+	return report
+}
+
+func (wm *Warmer) warmPackage(pkg *Package) *WarmResult {
+	result := &WarmResult{
+		Package: pkg.Name,
+		Version: pkg.Version,
+		Source:  wm.Rewriter.RewriteRepository(pkg.Source.URL),
+		Dist:    wm.Rewriter.RewriteArchive(pkg.Dist.URL),
+		Status:  WARM_STATUS_SKIPPED,
+	}
+
+	logger := wm.Logger.WithFields(log.Fields{
+		"action":  "Warm",
+		"package": pkg.Name,
+		"version": pkg.Version,
+	})
+
+	fail := func(err error) *WarmResult {
+		logger.WithError(err).Error("Unable to warm the package")
+
+		result.Status = WARM_STATUS_ERROR
+		result.Message = err.Error()
+
+		return result
+	}
+
+	source := strings.TrimPrefix(result.Source, wm.PublicServer)
+	dist := strings.TrimPrefix(result.Dist, wm.PublicServer)
+
+	// clone the repository, so the source install and the archive generation use the local copy
+	if server, repository, ok := ParseGitRepositoryUrl(source, wm.gitServers()); ok {
+		gs := wm.Git[server]
+
+		if !gs.Has(repository) {
+			if err := gs.Clone(repository); err != nil {
+				return fail(err)
+			}
+		}
+
+		result.Status = WARM_STATUS_CACHED
+	}
+
+	if server, repository, ref, ok := ParseGitArchiveUrl(dist, wm.gitServers()); ok {
+		if err := wm.Git[server].WriteArchive(ioutil.Discard, repository, ref); err != nil {
+			return fail(err)
+		}
+
+		result.Status = WARM_STATUS_CACHED
+	}
+
+	for code, ss := range wm.Static {
+		prefix := fmt.Sprintf("/static/%s/", code)
+
+		if !strings.HasPrefix(dist, prefix) {
+			continue
+		}
+
+		if _, err := ss.WriteArchive(ioutil.Discard, dist[len(prefix):]); err != nil {
+			return fail(err)
+		}
+
+		result.Status = WARM_STATUS_CACHED
+	}
+
+	if result.Status == WARM_STATUS_SKIPPED {
+		result.Message = "No mirror configured for this package"
+	}
+
+	logger.WithField("status", result.Status).Info("Package warmed")
+
+	return result
+}
+
+// IsCached returns true if the git repository and the dist file of the urls are available
+// in the git and static caches, the urls are rewritten if they are not local.
+func (wm *Warmer) IsCached(sourceUrl, distUrl string) (source bool, dist bool) {
+	local := func(url, kind string) string {
+		if !strings.HasPrefix(url, wm.PublicServer) {
+			if kind == git.REWRITE_ARCHIVE {
+				url = wm.Rewriter.RewriteArchive(url)
+			} else {
+				url = wm.Rewriter.RewriteRepository(url)
+			}
+		}
+
+		return strings.TrimPrefix(url, wm.PublicServer)
+	}
+
+	sourcePath, distPath := local(sourceUrl, git.REWRITE_REPOSITORY), local(distUrl, git.REWRITE_ARCHIVE)
+
+	if server, repository, ok := ParseGitRepositoryUrl(sourcePath, wm.gitServers()); ok {
+		source = wm.Git[server].Has(repository)
+	}
+
+	if server, repository, ref, ok := ParseGitArchiveUrl(distPath, wm.gitServers()); ok {
+		dist = wm.Git[server].HasArchive(repository, ref)
+	}
+
+	for code, ss := range wm.Static {
+		if prefix := fmt.Sprintf("/static/%s/", code); strings.HasPrefix(distPath, prefix) {
+			dist = ss.Has(distPath[len(prefix):])
+		}
+	}
+
+	return source, dist
+}
@@ -29,6 +29,7 @@ var (
 	BITBUCKET_ARCHIVE = regexp.MustCompile(`http(s|):\/\/([\w-\.]+)\/([\w\.\d-]+)\/([\w-\.\d]+)\/get\/([\w]+)\.zip`)
 	GITHUB_ARCHIVE    = regexp.MustCompile(`http(s|):\/\/api\.([\w-\.]+)\/repos\/([\w\.\d-]+)\/([\w\.\d-]+)\/zipball\/([\w]+)`)
 	GITLAB_ARCHIVE    = regexp.MustCompile(`http(s|):\/\/([\w-\.]+)\/([\w-\.\d]+)\/([\w-\.\d]+)\/repository\/archive.zip\?ref=([\w]+)`)
+	NPM_ARCHIVE       = regexp.MustCompile(`http(s|):\/\/([\w\.]+)\/(.*)`)
 
 	GIT_REPOSITORY = regexp.MustCompile(`^(((git|http(s|)):\/\/|git@))([\w-\.]+@|)([\w-\.]+)(\/|:)([\w-\.\/]+?)(\.git|)$`)
 	SVN_REPOSITORY = regexp.MustCompile(`(svn:\/\/(.*)|(.*)\.svn\.(.*))`)
@@ -218,7 +219,7 @@ func (gs *GitService) cacheArchive(w io.Writer, path, ref string) error {
 		return pkgmirror.InvalidReferenceError
 	}
 
-	vaultKey := fmt.Sprintf("%s:%s/%s", gs.Config.Server, path, ref)
+	vaultKey := gs.archiveKey(path, ref)
 
 	if !gs.Vault.Has(vaultKey) {
 		logger.Info("Create vault entry")
@@ -292,6 +293,15 @@ func (gs *GitService) cacheArchive(w io.Writer, path, ref string) error {
 	return nil
 }
 
+func (gs *GitService) archiveKey(path, ref string) string {
+	return fmt.Sprintf("%s:%s/%s", gs.Config.Server, path, ref)
+}
+
+// HasArchive returns true if the archive of the reference is stored in the vault.
+func (gs *GitService) HasArchive(path, ref string) bool {
+	return CACHEABLE_REF.Match([]byte(ref)) && gs.Vault.Has(gs.archiveKey(path, ref))
+}
+
 func (gs *GitService) dataFolder() string {
 	return gs.Config.DataDir + string(filepath.Separator) + gs.Config.Server
 }
@@ -401,34 +411,12 @@ func (gs *GitService) Clone(path string) error {
 	return nil
 }
 
+// GitRewriteArchive rewrites the url with the default rules.
 func GitRewriteArchive(publicServer, path string) string {
-	if results := GITHUB_ARCHIVE.FindStringSubmatch(path); len(results) == 6 {
-		return fmt.Sprintf("%s/git/%s/%s/%s/%s.zip", publicServer, results[2], results[3], results[4], results[5])
-	}
-
-	if results := BITBUCKET_ARCHIVE.FindStringSubmatch(path); len(results) == 6 {
-		return fmt.Sprintf("%s/git/%s/%s/%s/%s.zip", publicServer, results[2], results[3], results[4], results[5])
-	}
-
-	if results := GITLAB_ARCHIVE.FindStringSubmatch(path); len(results) == 6 {
-		return fmt.Sprintf("%s/git/%s/%s/%s/%s.zip", publicServer, results[2], results[3], results[4], results[5])
-	}
-
-	if results := DRUPAL_ARCHIVE.FindStringSubmatch(path); len(results) == 2 {
-		return fmt.Sprintf("%s/static/drupal/%s.zip", publicServer, results[1])
-	}
-
-	return publicServer
+	return NewRewriter(publicServer, nil).RewriteArchive(path)
 }
 
+// GitRewriteRepository rewrites the url with the default rules.
 func GitRewriteRepository(publicServer, path string) string {
-	if results := SVN_REPOSITORY.FindStringSubmatch(path); len(results) > 1 {
-		return path // svn not supported
-	}
-
-	if results := GIT_REPOSITORY.FindStringSubmatch(path); len(results) > 1 {
-		return fmt.Sprintf("%s/git/%s/%s.git", publicServer, results[6], results[8])
-	}
-
-	return publicServer
+	return NewRewriter(publicServer, nil).RewriteRepository(path)
 }
@@ -32,6 +32,16 @@ func ConfigureApp(config *pkgmirror.Config, l *goapp.Lifecycle) {
 			},
 		}
 
+		app.Set("pkgmirror.git.rewriter", func(app *goapp.App) interface{} {
+			rules, err := NewRewriteRules(config.Rewrite)
+
+			if err != nil {
+				panic(err)
+			}
+
+			return NewRewriter(config.PublicServer, rules)
+		})
+
 		for name, conf := range config.Git {
 			if !conf.Enabled {
 				continue
@@ -77,6 +87,17 @@ func ConfigureApp(config *pkgmirror.Config, l *goapp.Lifecycle) {
 
 		mux := app.Get("mux").(*goji.Mux)
 
+		mux.HandleFuncC(pat.Get("/api/rewrite"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			kind := r.FormValue("kind")
+
+			if len(kind) == 0 {
+				kind = REWRITE_ARCHIVE
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, app.Get("pkgmirror.git.rewriter").(*Rewriter).DryRun(kind, r.FormValue("url"), r.FormValue("code")))
+		})
+
 		// disable push, RO repository
 		gitServer := githttp.New(config.DataDir)
 		gitServer.ReceivePack = false
@@ -0,0 +1,159 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rande/pkgmirror"
+)
+
+const (
+	REWRITE_ARCHIVE    = "archive"    // composer dist url
+	REWRITE_REPOSITORY = "repository" // composer source url, bower repository
+	REWRITE_TARBALL    = "tarball"    // npm dist url
+
+	REWRITE_TARGET_NONE = "none" // keep the url untouched
+)
+
+var (
+	DEFAULT_REWRITE_RULES = []*RewriteRule{
+		{Kind: REWRITE_ARCHIVE, Match: GITHUB_ARCHIVE, Type: "git", Code: "${2}", Path: "${3}/${4}/${5}.zip"},
+		{Kind: REWRITE_ARCHIVE, Match: BITBUCKET_ARCHIVE, Type: "git", Code: "${2}", Path: "${3}/${4}/${5}.zip"},
+		{Kind: REWRITE_ARCHIVE, Match: GITLAB_ARCHIVE, Type: "git", Code: "${2}", Path: "${3}/${4}/${5}.zip"},
+		{Kind: REWRITE_ARCHIVE, Match: DRUPAL_ARCHIVE, Type: "static", Code: "drupal", Path: "${1}.zip"},
+		{Kind: REWRITE_REPOSITORY, Match: SVN_REPOSITORY, Type: REWRITE_TARGET_NONE},
+		{Kind: REWRITE_REPOSITORY, Match: GIT_REPOSITORY, Type: "git", Code: "${6}", Path: "${8}.git"},
+		{Kind: REWRITE_TARBALL, Match: NPM_ARCHIVE, Type: "npm", Code: "{code}", Path: "${3}"},
+	}
+)
+
+// RewriteRule alters an upstream url to point to a mirror, the Code and Path templates
+// can reference the captured groups of the Match expression, ie: ${1}. The {code} placeholder
+// is replaced by the code of the service rewriting the url.
+type RewriteRule struct {
+	Kind  string         `json:"kind"`
+	Match *regexp.Regexp `json:"-"`
+	Type  string         `json:"type"`
+	Code  string         `json:"code"`
+	Path  string         `json:"path"`
+}
+
+// used by the dry-run api to explain how an url is rewritten
+type RewriteResult struct {
+	Url       string       `json:"url"`
+	Kind      string       `json:"kind"`
+	Rewritten string       `json:"rewritten"`
+	Match     string       `json:"match,omitempty"`
+	Rule      *RewriteRule `json:"rule"`
+}
+
+// NewRewriteRules creates the rules defined in the configuration file, the expressions
+// are compiled so an invalid rule is reported on startup.
+func NewRewriteRules(configs []*pkgmirror.RewriteConfig) ([]*RewriteRule, error) {
+	rules := []*RewriteRule{}
+
+	for _, conf := range configs {
+		match, err := regexp.Compile(conf.Match)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch conf.Kind {
+		case REWRITE_ARCHIVE, REWRITE_REPOSITORY, REWRITE_TARBALL:
+		default:
+			return nil, fmt.Errorf("Invalid rewrite kind %q for %q", conf.Kind, conf.Match)
+		}
+
+		rules = append(rules, &RewriteRule{
+			Kind:  conf.Kind,
+			Match: match,
+			Type:  conf.Type,
+			Code:  conf.Code,
+			Path:  conf.Path,
+		})
+	}
+
+	return rules, nil
+}
+
+func NewRewriter(publicServer string, rules []*RewriteRule) *Rewriter {
+	return &Rewriter{
+		PublicServer: publicServer,
+		Rules:        append(rules, DEFAULT_REWRITE_RULES...),
+	}
+}
+
+type Rewriter struct {
+	PublicServer string
+	Rules        []*RewriteRule
+}
+
+// Rewrite returns the rewritten url and the matching rule, the rule is nil if no rule matches.
+func (rw *Rewriter) Rewrite(kind, url, code string) (string, *RewriteRule) {
+	for _, rule := range rw.Rules {
+		if rule.Kind != kind {
+			continue
+		}
+
+		submatches := rule.Match.FindStringSubmatchIndex(url)
+
+		if submatches == nil {
+			continue
+		}
+
+		if rule.Type == REWRITE_TARGET_NONE {
+			return url, rule
+		}
+
+		expand := func(template string) string {
+			template = strings.Replace(template, "{code}", code, -1)
+
+			return string(rule.Match.ExpandString(nil, template, url, submatches))
+		}
+
+		return fmt.Sprintf("%s/%s/%s/%s", rw.PublicServer, rule.Type, expand(rule.Code), expand(rule.Path)), rule
+	}
+
+	return url, nil
+}
+
+// DryRun explains how the url is rewritten.
+func (rw *Rewriter) DryRun(kind, url, code string) *RewriteResult {
+	result := &RewriteResult{
+		Url:  url,
+		Kind: kind,
+	}
+
+	result.Rewritten, result.Rule = rw.Rewrite(kind, url, code)
+
+	if result.Rule != nil {
+		result.Match = result.Rule.Match.String()
+	}
+
+	return result
+}
+
+// RewriteArchive returns the public server if the url cannot be rewritten.
+func (rw *Rewriter) RewriteArchive(url string) string {
+	if path, rule := rw.Rewrite(REWRITE_ARCHIVE, url, ""); rule != nil {
+		return path
+	}
+
+	return rw.PublicServer
+}
+
+// RewriteRepository returns the public server if the url cannot be rewritten.
+func (rw *Rewriter) RewriteRepository(url string) string {
+	if path, rule := rw.Rewrite(REWRITE_REPOSITORY, url, ""); rule != nil {
+		return path
+	}
+
+	return rw.PublicServer
+}
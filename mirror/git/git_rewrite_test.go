@@ -0,0 +1,70 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"testing"
+
+	"github.com/rande/pkgmirror"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewRewriteRules_Invalid(t *testing.T) {
+	_, err := NewRewriteRules([]*pkgmirror.RewriteConfig{
+		{Kind: "foobar", Match: `^https://example\.com/(.*)$`, Type: "static", Code: "example", Path: "${1}"},
+	})
+
+	assert.Error(t, err)
+
+	_, err = NewRewriteRules([]*pkgmirror.RewriteConfig{
+		{Kind: REWRITE_ARCHIVE, Match: `^https://example\.com/(.*$`, Type: "static", Code: "example", Path: "${1}"},
+	})
+
+	assert.Error(t, err)
+}
+
+func Test_Rewriter_Custom_Rule(t *testing.T) {
+	rules, err := NewRewriteRules([]*pkgmirror.RewriteConfig{
+		{Kind: REWRITE_ARCHIVE, Match: `^https://ftp\.drupal\.org/files/projects/(.*)\.zip$`, Type: "static", Code: "drupal8", Path: "${1}.zip"},
+		{Kind: REWRITE_REPOSITORY, Match: `^https://git\.example\.com/(.*)$`, Type: REWRITE_TARGET_NONE},
+	})
+
+	assert.NoError(t, err)
+
+	rw := NewRewriter("https://mirrors.localhost", rules)
+
+	// the custom rule takes precedence over the default one
+	assert.Equal(t, "https://mirrors.localhost/static/drupal8/ctools-8.x-3.0.zip", rw.RewriteArchive("https://ftp.drupal.org/files/projects/ctools-8.x-3.0.zip"))
+	assert.Equal(t, "https://git.example.com/foo/bar.git", rw.RewriteRepository("https://git.example.com/foo/bar.git"))
+
+	// default rules are still available
+	assert.Equal(t, "https://mirrors.localhost/git/github.com/foo/bar.git", rw.RewriteRepository("https://github.com/foo/bar.git"))
+}
+
+func Test_Rewriter_Tarball(t *testing.T) {
+	rw := NewRewriter("https://mirrors.localhost", nil)
+
+	path, rule := rw.Rewrite(REWRITE_TARBALL, "https://registry.npmjs.org/angular/-/angular-1.5.8.tgz", "npm")
+
+	assert.NotNil(t, rule)
+	assert.Equal(t, "https://mirrors.localhost/npm/npm/angular/-/angular-1.5.8.tgz", path)
+}
+
+func Test_Rewriter_DryRun(t *testing.T) {
+	rw := NewRewriter("https://mirrors.localhost", nil)
+
+	result := rw.DryRun(REWRITE_ARCHIVE, "https://bitbucket.org/foo/bar/get/master.zip", "")
+
+	assert.Equal(t, "https://mirrors.localhost/git/bitbucket.org/foo/bar/master.zip", result.Rewritten)
+	assert.Equal(t, BITBUCKET_ARCHIVE.String(), result.Match)
+	assert.NotNil(t, result.Rule)
+
+	result = rw.DryRun(REWRITE_ARCHIVE, "https://example.com/foo.zip", "")
+
+	assert.Equal(t, "https://example.com/foo.zip", result.Rewritten)
+	assert.Nil(t, result.Rule)
+	assert.Empty(t, result.Match)
+}
@@ -6,11 +6,14 @@
 package npm
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"regexp"
+	"os"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -23,16 +26,52 @@ import (
 	"github.com/rande/pkgmirror/mirror/git"
 )
 
-var (
-	NPM_ARCHIVE = regexp.MustCompile(`http(s|):\/\/([\w\.]+)\/(.*)`)
-)
-
 type NpmConfig struct {
 	SourceServer    string
 	PublicServer    string
 	FallbackServers []string
 	Path            string
 	Code            []byte
+	ChangesFeed     string   // the _changes url, the packages are synced from the feed if set
+	Include         []string // packages updated from the feed even if not tracked, ie: @types/*
+	Replicate       bool     // update all packages from the feed
+	Scopes          []string // scopes of the private packages published on the mirror, ie: @acme
+	PublishToken    string   // bearer token required by the write requests, publishing is disabled if empty
+}
+
+// IsPrivate returns true if the package belongs to a private scope, the name can be escaped,
+// ie: @acme%2fui.
+func (c *NpmConfig) IsPrivate(name string) bool {
+	name = strings.Replace(name, "%2f", "/", -1)
+
+	for _, scope := range c.Scopes {
+		if strings.HasPrefix(name, fmt.Sprintf("@%s/", strings.TrimPrefix(scope, "@"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsAuthorized checks the bearer token sent in the Authorization header, the write requests
+// are refused if no token is configured.
+func (c *NpmConfig) IsAuthorized(header string) bool {
+	if len(c.PublishToken) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(header), []byte(fmt.Sprintf("Bearer %s", c.PublishToken))) == 1
+}
+
+// IsIncluded checks the package name against the include glob patterns.
+func (c *NpmConfig) IsIncluded(name string) bool {
+	for _, pattern := range c.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
 }
 
 func NewNpmService() *NpmService {
@@ -56,6 +95,9 @@ type NpmService struct {
 	dbLock        *sync.Mutex
 	StateChan     chan pkgmirror.State
 	BoltCompacter *pkgmirror.BoltCompacter
+	Rewriter      *git.Rewriter
+	downloads     map[string]*pkgmirror.DownloadCounter
+	downloadsLock sync.Mutex
 }
 
 func (ns *NpmService) Init(app *goapp.App) (err error) {
@@ -76,7 +118,15 @@ func (ns *NpmService) openDatabase() (err error) {
 		return err
 	}
 
-	return nil
+	return ns.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{META_BUCKET, DIST_TAGS_BUCKET, SEARCH_BUCKET, DOWNLOADS_BUCKET, UNPUBLISHED_BUCKET} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
 func (ns *NpmService) optimize() error {
@@ -107,12 +157,18 @@ func (ns *NpmService) Serve(state *goapp.GoroutineState) error {
 	sync := func() {
 		ns.Logger.Debug("Starting a new sync...")
 
-		ns.SyncPackages()
+		if len(ns.Config.ChangesFeed) > 0 {
+			ns.SyncChanges()
+		} else {
+			ns.SyncPackages()
+		}
 
 		iteration++
 
 		// optimize every 10 iteration
 		if iteration > 9 {
+			ns.flushDownloads()
+
 			ns.Logger.Info("Starting database optimization")
 			ns.optimize()
 			iteration = 0
@@ -159,14 +215,25 @@ func (ns *NpmService) Serve(state *goapp.GoroutineState) error {
 	// }()
 
 	// start the first sync
-	go sync()
+	go func() {
+		ns.rebuildSearchIndex()
+
+		sync()
+	}()
+
+	ticker := time.NewTicker(DOWNLOADS_FLUSH_INTERVAL)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-state.In:
+			ns.flushDownloads()
 			ns.DB.Close()
 			return nil
 
+		case <-ticker.C:
+			ns.flushDownloads()
+
 		case <-syncEnd:
 			ns.StateChan <- pkgmirror.State{
 				Message: "Wait for a new run",
@@ -208,7 +275,7 @@ func (ns *NpmService) SyncPackages() error {
 	dm := pkgmirror.NewWorkerManager(10, func(id int, data <-chan interface{}, result chan interface{}) {
 		for raw := range data {
 			currentPkg := raw.(ShortPackageDefinition)
-			remotePkg, err := ns.loadPackage(currentPkg.Name)
+			remotePkg, err := ns.loadPackage(currentPkg.Name, currentPkg.Server)
 
 			if err != nil {
 				logger.WithFields(log.Fields{
@@ -228,7 +295,7 @@ func (ns *NpmService) SyncPackages() error {
 				"remoteReleases":  len(remotePkg.Versions),
 			}
 
-			if currentPkg.Rev != remotePkg.Rev || currentPkg.ReleasesAvailable != len(remotePkg.Versions) {
+			if currentPkg.Rev != remotePkg.Rev || currentPkg.ReleasesAvailable != len(remotePkg.Versions) || currentPkg.Server != remotePkg.Server {
 				logger.WithFields(fields).Debug("Updating package information")
 
 				result <- *remotePkg
@@ -283,6 +350,10 @@ func (ns *NpmService) SyncPackages() error {
 				continue
 			}
 
+			if pkg.Private {
+				continue
+			}
+
 			dm.Add(*pkg)
 		}
 
@@ -306,8 +377,6 @@ func (ns *NpmService) savePackage(pkg *FullPackageDefinition) error {
 		return pkgmirror.DatabaseLockedError
 	}
 
-	var data []byte
-	var datac []byte
 	var meta []byte
 	var err error
 
@@ -328,6 +397,7 @@ func (ns *NpmService) savePackage(pkg *FullPackageDefinition) error {
 		Rev:               pkg.Rev,
 		Name:              pkg.Name,
 		ReleasesAvailable: len(pkg.Versions),
+		Server:            pkg.Server,
 	}
 
 	if meta, err = json.Marshal(shortPkg); err != nil {
@@ -335,8 +405,8 @@ func (ns *NpmService) savePackage(pkg *FullPackageDefinition) error {
 	}
 
 	for _, version := range pkg.Versions {
-		if results := NPM_ARCHIVE.FindStringSubmatch(version.Dist.Tarball); len(results) > 0 {
-			version.Dist.Tarball = fmt.Sprintf("%s/npm/%s/%s", ns.Config.PublicServer, string(ns.Config.Code), results[3])
+		if tarball, rule := ns.Rewriter.Rewrite(git.REWRITE_TARBALL, version.Dist.Tarball, string(ns.Config.Code)); rule != nil {
+			version.Dist.Tarball = tarball
 		} else {
 			logger.WithFields(log.Fields{
 				log.ErrorKey: "regexp does not match",
@@ -345,33 +415,25 @@ func (ns *NpmService) savePackage(pkg *FullPackageDefinition) error {
 		}
 	}
 
-	data, err = json.Marshal(&pkg)
-	if err != nil {
-		logger.WithError(err).Error("Unable to marshal data")
-
-		return err
-	}
-
 	err = ns.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(ns.Config.Code)
 
-		logger.Debug("Saving package meta")
-
-		if err = b.Put([]byte(fmt.Sprintf("%s.meta", pkg.Name)), meta); err != nil {
-			logger.WithError(err).Error("Unable to save package meta")
+		// the local tags are kept when the package is updated from the registry
+		if err := ns.mergeDistTags(tx, pkg); err != nil {
+			logger.WithError(err).Error("Unable to merge the local dist-tags")
 
 			return err
 		}
 
-		datac, err = pkgmirror.Compress(data)
+		logger.Debug("Saving package meta")
 
-		if err != nil {
-			logger.WithError(err).Error("Unable to compress data")
+		if err := b.Put([]byte(fmt.Sprintf("%s.meta", pkg.Name)), meta); err != nil {
+			logger.WithError(err).Error("Unable to save package meta")
 
 			return err
 		}
 
-		if err := b.Put([]byte(pkg.Name), datac); err != nil {
+		if err := ns.putDefinition(tx, pkg); err != nil {
 			logger.WithError(err).Error("Error updating/creating definition")
 
 			return err
@@ -385,7 +447,80 @@ func (ns *NpmService) savePackage(pkg *FullPackageDefinition) error {
 	return err
 }
 
-func (ns *NpmService) loadPackage(name string) (*FullPackageDefinition, error) {
+// putDefinition stores the compressed full and abbreviated definitions of a package, and
+// updates the search index.
+func (ns *NpmService) putDefinition(tx *bolt.Tx, pkg *FullPackageDefinition) error {
+	b := tx.Bucket(ns.Config.Code)
+
+	data, err := json.Marshal(pkg)
+
+	if err != nil {
+		return err
+	}
+
+	if data, err = pkgmirror.Compress(data); err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte(pkg.Name), data); err != nil {
+		return err
+	}
+
+	if data, err = pkgmirror.Marshal(NewAbbreviatedPackage(pkg)); err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte(GetAbbreviatedKey(pkg.Name)), data); err != nil {
+		return err
+	}
+
+	return ns.indexPackage(tx, pkg)
+}
+
+// getServers returns the registries in the failover order, the registry providing the
+// package is contacted first if it is still configured.
+func (ns *NpmService) getServers(preferred string) []string {
+	servers := append([]string{ns.Config.SourceServer}, ns.Config.FallbackServers...)
+
+	for i, server := range servers {
+		if i > 0 && server == preferred {
+			return append([]string{server}, append(servers[:i:i], servers[i+1:]...)...)
+		}
+	}
+
+	return servers
+}
+
+// getMeta returns the short definition of a stored package, the name can be escaped,
+// ie: @types%2freact.
+func (ns *NpmService) getMeta(name string) (*ShortPackageDefinition, error) {
+	pkg := &ShortPackageDefinition{}
+
+	err := ns.DB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(ns.Config.Code).Get([]byte(fmt.Sprintf("%s.meta", strings.Replace(name, "%2f", "/", -1))))
+
+		if len(data) == 0 {
+			return pkgmirror.EmptyKeyError
+		}
+
+		return json.Unmarshal(data, pkg)
+	})
+
+	return pkg, err
+}
+
+// getPackageServer returns the registry recorded for the package.
+func (ns *NpmService) getPackageServer(name string) string {
+	pkg, _ := ns.getMeta(name)
+
+	return pkg.Server
+}
+
+// loadPackage loads the package from the registries in the failover order, starting with
+// the registry recorded for the package, the next registry is contacted when the package
+// does not exist on the previous one or when the request fails. The registry providing the
+// package is stored in the Server field.
+func (ns *NpmService) loadPackage(name, server string) (*FullPackageDefinition, error) {
 	// handle scoped package
 	name = strings.Replace(name, "/", "%2f", -1)
 
@@ -396,25 +531,65 @@ func (ns *NpmService) loadPackage(name string) (*FullPackageDefinition, error) {
 
 	logger.Debug("Load remote data")
 
-	pkg := &FullPackageDefinition{}
+	err := pkgmirror.ResourceNotFoundError
 
-	if err := pkgmirror.LoadRemoteStruct(fmt.Sprintf("%s/%s", ns.Config.SourceServer, name), &pkg); err != nil {
-		logger.WithFields(log.Fields{
-			"path":       fmt.Sprintf("%s/%s", ns.Config.SourceServer, name),
-			log.ErrorKey: err.Error(),
-		}).Error("Error loading package definition")
+	for _, server := range ns.getServers(server) {
+		pkg := &FullPackageDefinition{}
 
-		return nil, err
-	}
+		if lerr := pkgmirror.LoadRemoteStruct(fmt.Sprintf("%s/%s", server, name), &pkg); lerr == pkgmirror.ResourceNotFoundError {
+			logger.WithField("path", fmt.Sprintf("%s/%s", server, name)).Debug("Package not available on the registry")
+
+			continue
+		} else if lerr != nil {
+			logger.WithFields(log.Fields{
+				"path":       fmt.Sprintf("%s/%s", server, name),
+				log.ErrorKey: lerr.Error(),
+			}).Warn("Error loading package definition, trying the next registry")
+
+			// keep the error, the package might exist on the failing registry
+			err = lerr
+
+			continue
+		}
+
+		if pkg.ID == "" {
+			logger.WithField("path", fmt.Sprintf("%s/%s", server, name)).Error("Invalid package definition")
 
-	if pkg.ID == "" {
-		return nil, pkgmirror.InvalidPackageError
+			return nil, pkgmirror.InvalidPackageError
+		}
+
+		pkg.Server = server
+
+		return pkg, nil
 	}
 
-	return pkg, nil
+	logger.WithError(err).Error("Package not available on the registries")
+
+	return nil, err
 }
 
 func (ns *NpmService) Get(key string) ([]byte, error) {
+	data, err := ns.get(key)
+
+	// the key is not here, get it from the source, the private packages only exist on the mirror
+	if err == pkgmirror.EmptyKeyError && !ns.Config.IsPrivate(key) {
+		ns.Logger.WithFields(log.Fields{
+			"action": "Get",
+			"key":    key,
+		}).Debug("Package does not exist")
+
+		if err := ns.UpdatePackage(key); err != nil {
+			return data, err
+		}
+
+		return ns.get(key)
+	}
+
+	return data, err
+}
+
+// get returns the stored value, the remote registries are not contacted.
+func (ns *NpmService) get(key string) ([]byte, error) {
 	var data []byte
 
 	if ns.lock {
@@ -446,17 +621,6 @@ func (ns *NpmService) Get(key string) ([]byte, error) {
 		return nil
 	})
 
-	// the key is not here, get it from the source
-	if err == pkgmirror.EmptyKeyError {
-		logger.Debug("Package does not exist")
-
-		if err := ns.UpdatePackage(key); err != nil {
-			return data, err
-		}
-
-		return ns.Get(key)
-	}
-
 	return data, err
 }
 
@@ -465,7 +629,13 @@ func (ns *NpmService) UpdatePackage(key string) error {
 		return pkgmirror.DatabaseLockedError
 	}
 
-	pkg, err := ns.loadPackage(key)
+	meta, err := ns.getMeta(key)
+
+	if (err == nil && meta.Private) || ns.Config.IsPrivate(key) {
+		return nil // published on the mirror
+	}
+
+	pkg, err := ns.loadPackage(key, meta.Server)
 
 	if err != nil {
 		return err
@@ -485,21 +655,26 @@ func (ns *NpmService) WriteArchive(w io.Writer, pkg, version string) error {
 		"action":  "WriteArchive",
 	})
 
-	vaultKey := fmt.Sprintf("%s/%s", pkg, version)
+	vaultKey := GetVaultKey(pkg, version)
+
+	if !ns.Vault.Has(vaultKey) && ns.Config.IsPrivate(pkg) {
+		return pkgmirror.ResourceNotFoundError
+	}
 
 	if !ns.Vault.Has(vaultKey) {
-		var url string
+		// the digests are required to verify the tarball, the metadata are loaded if the
+		// package has not been requested yet
+		dist := ns.getDist(pkg, version)
 
-		if pkg[0] == '@' { // scoped package
-			subNames := strings.Split(pkg, "%2f")
-			url = fmt.Sprintf("%s/%s/%s/-/%s-%s.tgz", ns.Config.SourceServer, subNames[0], subNames[1], subNames[1], version)
-		} else {
-			url = fmt.Sprintf("%s/%s/-/%s-%s.tgz", ns.Config.SourceServer, pkg, pkg, version)
-		}
+		if !NewVerifier(dist).HasDigests() {
+			if _, err := ns.Get(strings.Replace(pkg, "%2f", "/", -1)); err != nil {
+				logger.WithError(err).Debug("Unable to load the package metadata")
+			}
 
-		logger.WithField("url", url).Debug("Create vault entry")
+			dist = ns.getDist(pkg, version)
+		}
 
-		resp, err := http.Get(url)
+		resp, err := ns.downloadArchive(pkg, version)
 
 		if err != nil {
 			return err
@@ -507,15 +682,45 @@ func (ns *NpmService) WriteArchive(w io.Writer, pkg, version string) error {
 
 		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			return pkgmirror.ResourceNotFoundError
+		// the tarball is downloaded into a temporary file, the vault entry is only created
+		// once the digests are verified
+		file, err := ioutil.TempFile("", "pkgmirror-npm-")
+
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		verifier := NewVerifier(dist)
+
+		if _, err := io.Copy(file, io.TeeReader(resp.Body, verifier)); err != nil {
+			logger.WithError(err).Info("Error while downloading the tarball")
+
+			return err
+		}
+
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		// old packages might not publish any digest, the tarball is stored as downloaded
+		// so it is only requested once
+		if !verifier.HasDigests() {
+			logger.Warn("No digest published, the tarball is stored without verification")
+		} else if err := verifier.Verify(); err != nil {
+			logger.WithError(err).Error("The tarball does not match the published integrity")
+
+			return err
 		}
 
 		meta := vault.NewVaultMetadata()
 		meta["path"] = pkg
 		meta["version"] = version
+		meta["verified"] = verifier.HasDigests()
 
-		if _, err := ns.Vault.Put(vaultKey, meta, resp.Body); err != nil {
+		if _, err := ns.Vault.Put(vaultKey, meta, file); err != nil {
 			logger.WithError(err).Info("Error while writing into vault")
 
 			ns.Vault.Remove(vaultKey)
@@ -529,5 +734,65 @@ func (ns *NpmService) WriteArchive(w io.Writer, pkg, version string) error {
 		return err
 	}
 
+	ns.recordDownload(strings.Replace(pkg, "%2f", "/", -1))
+
 	return nil
 }
+
+// getDist returns the dist object of the stored version, an empty object is returned if the
+// package has not been stored.
+func (ns *NpmService) getDist(pkg, version string) DistDefinition {
+	definition := &FullPackageDefinition{}
+
+	if data, err := ns.get(strings.Replace(pkg, "%2f", "/", -1)); err != nil {
+		return DistDefinition{}
+	} else if err := pkgmirror.Unmarshal(data, definition); err != nil {
+		return DistDefinition{}
+	}
+
+	if v, ok := definition.Versions[version]; ok {
+		return v.Dist
+	}
+
+	return DistDefinition{}
+}
+
+// downloadArchive requests the tarball from the registries in the failover order.
+func (ns *NpmService) downloadArchive(pkg, version string) (*http.Response, error) {
+	logger := ns.Logger.WithFields(log.Fields{
+		"package": pkg,
+		"version": version,
+		"action":  "downloadArchive",
+	})
+
+	for _, server := range ns.getServers(ns.getPackageServer(pkg)) {
+		var url string
+
+		if pkg[0] == '@' { // scoped package
+			subNames := strings.Split(pkg, "%2f")
+			url = fmt.Sprintf("%s/%s/%s/-/%s-%s.tgz", server, subNames[0], subNames[1], subNames[1], version)
+		} else {
+			url = fmt.Sprintf("%s/%s/-/%s-%s.tgz", server, pkg, pkg, version)
+		}
+
+		logger.WithField("url", url).Debug("Create vault entry")
+
+		resp, err := http.Get(url)
+
+		if err != nil {
+			logger.WithError(err).WithField("url", url).Warn("Unable to download the archive")
+
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, pkgmirror.ResourceNotFoundError
+}
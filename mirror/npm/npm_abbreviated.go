@@ -0,0 +1,96 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package npm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+const (
+	ABBREVIATED_CONTENT_TYPE = "application/vnd.npm.install-v1+json"
+)
+
+// GetAbbreviatedKey returns the key of the abbreviated metadata of a package.
+func GetAbbreviatedKey(name string) string {
+	return fmt.Sprintf("%s.abbreviated", name)
+}
+
+// IsAbbreviatedRequest returns true if the client accepts the abbreviated metadata.
+func IsAbbreviatedRequest(accept string) bool {
+	return strings.Contains(accept, ABBREVIATED_CONTENT_TYPE)
+}
+
+// NewAbbreviatedPackage keeps the fields required to resolve and install the versions of
+// a package.
+func NewAbbreviatedPackage(pkg *FullPackageDefinition) *AbbreviatedPackageDefinition {
+	abbreviated := &AbbreviatedPackageDefinition{
+		Name:     pkg.Name,
+		DistTags: pkg.DistTags,
+		Versions: map[string]*AbbreviatedVersionDefinition{},
+	}
+
+	if pkg.Time != nil {
+		times := map[string]string{}
+
+		if err := json.Unmarshal(*pkg.Time, &times); err == nil {
+			abbreviated.Modified = times["modified"]
+		}
+	}
+
+	for name, version := range pkg.Versions {
+		abbreviated.Versions[name] = &AbbreviatedVersionDefinition{
+			Name:                 version.Name,
+			Version:              version.Version,
+			Dependencies:         version.Dependencies,
+			DevDependencies:      version.DevDependencies,
+			PeerDependencies:     version.PeerDependencies,
+			OptionalDependencies: version.OptionalDependencies,
+			BundleDependencies:   version.BundleDependencies,
+			Bin:                  version.Bin,
+			Engines:              version.Engines,
+			Os:                   version.Os,
+			Cpu:                  version.Cpu,
+			Dist:                 version.Dist,
+		}
+	}
+
+	return abbreviated
+}
+
+// GetAbbreviated returns the compressed abbreviated metadata, the metadata is generated from
+// the full definition if the package has been stored before the abbreviated form existed.
+func (ns *NpmService) GetAbbreviated(name string) ([]byte, error) {
+	if data, err := ns.get(GetAbbreviatedKey(name)); err == nil {
+		return data, nil
+	}
+
+	data, err := ns.Get(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := &FullPackageDefinition{}
+
+	if err := pkgmirror.Unmarshal(data, pkg); err != nil {
+		return nil, err
+	}
+
+	if data, err = pkgmirror.Marshal(NewAbbreviatedPackage(pkg)); err != nil {
+		return nil, err
+	}
+
+	err = ns.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ns.Config.Code).Put([]byte(GetAbbreviatedKey(name)), data)
+	})
+
+	return data, err
+}
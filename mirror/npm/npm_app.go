@@ -6,13 +6,17 @@
 package npm
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/rande/goapp"
 	"github.com/rande/gonode/core/vault"
 	"github.com/rande/pkgmirror"
+	"github.com/rande/pkgmirror/mirror/git"
 	"goji.io"
 	"goji.io/pat"
 	"golang.org/x/net/context"
@@ -35,6 +39,21 @@ func ConfigureApp(config *pkgmirror.Config, l *goapp.Lifecycle) {
 					s.Config.Path = fmt.Sprintf("%s/npm", config.DataDir)
 					s.Config.PublicServer = config.PublicServer
 					s.Config.SourceServer = conf.Server
+					s.Config.ChangesFeed = conf.ChangesFeed
+					s.Config.Include = conf.Include
+					s.Config.Replicate = conf.Replicate
+					s.Config.Scopes = conf.Scopes
+
+					if token, err := pkgmirror.ResolveSecret(conf.PublishToken); err != nil {
+						panic(err)
+					} else {
+						s.Config.PublishToken = token
+					}
+
+					for _, fallback := range conf.Fallbacks {
+						s.Config.FallbackServers = append(s.Config.FallbackServers, fallback.Server)
+					}
+
 					s.Config.Code = []byte(name)
 					s.Logger = logger.WithFields(log.Fields{
 						"handler": "npm",
@@ -49,6 +68,7 @@ func ConfigureApp(config *pkgmirror.Config, l *goapp.Lifecycle) {
 					}
 					s.StateChan = pkgmirror.GetStateChannel(fmt.Sprintf("pkgmirror.npm.%s", name), app.Get("pkgmirror.channel.state").(chan pkgmirror.State))
 					s.BoltCompacter = app.Get("bolt.compacter").(*pkgmirror.BoltCompacter)
+					s.Rewriter = app.Get("pkgmirror.git.rewriter").(*git.Rewriter)
 
 					if err := s.Init(app); err != nil {
 						panic(err)
@@ -97,9 +117,167 @@ func ConfigureHttp(name string, conf *pkgmirror.NpmConfig, app *goapp.App) {
 	mux := app.Get("mux").(*goji.Mux)
 	npmService := app.Get(fmt.Sprintf("pkgmirror.npm.%s", name)).(*NpmService)
 
+	if len(conf.ChangesFeed) > 0 {
+		mux.HandleFuncC(pat.Get(fmt.Sprintf("/api/npm/%s/changes", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, map[string]string{
+				"feed":  npmService.Config.ChangesFeed,
+				"since": npmService.GetChangesSeq(),
+			})
+		})
+
+		mux.HandleFuncC(pat.Post(fmt.Sprintf("/api/npm/%s/changes", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			if err := npmService.SyncChanges(); err != nil {
+				pkgmirror.SendWithHttpCode(w, 500, err.Error())
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				pkgmirror.Serialize(w, map[string]string{
+					"feed":  npmService.Config.ChangesFeed,
+					"since": npmService.GetChangesSeq(),
+				})
+			}
+		})
+	}
+
+	// the search and dist-tags routes must be registered before the publish and package routes
+	mux.HandleFuncC(pat.Get(fmt.Sprintf("/npm/%s/-/v1/search", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.FormValue("size"))
+		from, _ := strconv.Atoi(r.FormValue("from"))
+
+		if result, err := npmService.Search(r.FormValue("text"), size, from); err != nil {
+			pkgmirror.SendWithHttpCode(w, 500, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, result)
+		}
+	})
+
+	mux.HandleFuncC(NewDistTagsPat(name, "GET"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if tags, err := npmService.GetDistTags(pat.Param(ctx, "package")); err != nil {
+			pkgmirror.SendWithHttpCode(w, 404, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, tags)
+		}
+	})
+
+	mux.HandleFuncC(NewDistTagsPat(name, "PUT"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !npmService.Config.IsAuthorized(r.Header.Get("Authorization")) {
+			sendDistTags(w, nil, pkgmirror.UnauthorizedError)
+
+			return
+		}
+
+		version := ""
+
+		// the npm client sends the version as a json string
+		if err := json.NewDecoder(r.Body).Decode(&version); err != nil {
+			pkgmirror.SendWithHttpCode(w, 400, err.Error())
+
+			return
+		}
+
+		tags, err := npmService.SetDistTag(pat.Param(ctx, "package"), pat.Param(ctx, "tag"), version)
+
+		sendDistTags(w, tags, err)
+	})
+
+	mux.HandleFuncC(NewDistTagsPat(name, "DELETE"), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !npmService.Config.IsAuthorized(r.Header.Get("Authorization")) {
+			sendDistTags(w, nil, pkgmirror.UnauthorizedError)
+
+			return
+		}
+
+		tags, err := npmService.DeleteDistTag(pat.Param(ctx, "package"), pat.Param(ctx, "tag"))
+
+		sendDistTags(w, tags, err)
+	})
+
+	// the publish routes must be registered before the archive route, the archive pattern
+	// matches the tarball urls sent by the unpublish command
+	mux.HandleFuncC(pat.Put(fmt.Sprintf("/npm/%s/*", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !npmService.Config.IsAuthorized(r.Header.Get("Authorization")) {
+			sendPublishError(w, pkgmirror.UnauthorizedError)
+
+			return
+		}
+
+		pkg := r.URL.Path[6+len(name):]
+		doc := &PublishDocument{}
+
+		if err := json.NewDecoder(r.Body).Decode(doc); err != nil {
+			pkgmirror.SendWithHttpCode(w, 400, err.Error())
+
+			return
+		}
+
+		var meta *ShortPackageDefinition
+		var err error
+
+		// ie: /npm/npm/@acme/ui/-rev/3-5a9cd12c, sent by the unpublish command
+		if i := strings.Index(pkg, "/-rev/"); i > 0 {
+			meta, err = npmService.UpdatePrivate(pkg[:i], doc)
+		} else {
+			meta, err = npmService.Publish(pkg, doc)
+		}
+
+		if err != nil {
+			sendPublishError(w, err)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+
+		if meta == nil {
+			pkgmirror.Serialize(w, map[string]interface{}{"ok": true, "id": pkg})
+		} else {
+			pkgmirror.Serialize(w, map[string]interface{}{"ok": true, "id": meta.Name, "rev": meta.Rev})
+		}
+	})
+
+	mux.HandleFuncC(pat.Delete(fmt.Sprintf("/npm/%s/*", name)), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !npmService.Config.IsAuthorized(r.Header.Get("Authorization")) {
+			sendPublishError(w, pkgmirror.UnauthorizedError)
+
+			return
+		}
+
+		pkg := r.URL.Path[6+len(name):]
+
+		if i := strings.Index(pkg, "/-rev/"); i > 0 {
+			pkg = pkg[:i]
+		}
+
+		var err error
+
+		// ie: /npm/npm/@acme/ui/-/ui-1.0.0.tgz
+		if i := strings.Index(pkg, "/-/"); i > 0 {
+			basename := pkg[strings.LastIndex(pkg[:i], "/")+1 : i]
+			version := strings.TrimSuffix(strings.TrimPrefix(pkg[i+3:], basename+"-"), ".tgz")
+
+			err = npmService.DeletePrivateTarball(pkg[:i], version)
+		} else {
+			err = npmService.DeletePrivate(pkg)
+		}
+
+		if err != nil {
+			sendPublishError(w, err)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			pkgmirror.Serialize(w, map[string]interface{}{"ok": true})
+		}
+	})
+
 	mux.HandleFuncC(NewArchivePat(name), func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "Content-Type: application/octet-stream")
-		if err := npmService.WriteArchive(w, pat.Param(ctx, "package"), pat.Param(ctx, "version")); err != nil {
+		if err := npmService.WriteArchive(w, pat.Param(ctx, "package"), pat.Param(ctx, "version")); err == pkgmirror.ChecksumMismatchError {
+			pkgmirror.SendWithHttpCode(w, 502, err.Error())
+		} else if err == pkgmirror.ResourceNotFoundError {
+			pkgmirror.SendWithHttpCode(w, 404, err.Error())
+		} else if err != nil {
 			pkgmirror.SendWithHttpCode(w, 500, err.Error())
 		}
 	})
@@ -119,6 +297,21 @@ func ConfigureHttp(name string, conf *pkgmirror.NpmConfig, app *goapp.App) {
 			return
 		}
 
+		// the response depends on the metadata format requested by the client
+		w.Header().Set("Vary", "Accept")
+
+		if IsAbbreviatedRequest(r.Header.Get("Accept")) {
+			if data, err := npmService.GetAbbreviated(pkg); err != nil {
+				pkgmirror.SendWithHttpCode(w, 404, err.Error())
+			} else {
+				w.Header().Set("Content-Type", ABBREVIATED_CONTENT_TYPE)
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(data)
+			}
+
+			return
+		}
+
 		if data, err := npmService.Get(pkg); err != nil {
 			pkgmirror.SendWithHttpCode(w, 404, err.Error())
 		} else {
@@ -128,3 +321,38 @@ func ConfigureHttp(name string, conf *pkgmirror.NpmConfig, app *goapp.App) {
 		}
 	})
 }
+
+func sendDistTags(w http.ResponseWriter, tags map[string]string, err error) {
+	switch err {
+	case nil:
+		w.Header().Set("Content-Type", "application/json")
+		pkgmirror.Serialize(w, tags)
+	case pkgmirror.UnauthorizedError:
+		pkgmirror.SendWithHttpCode(w, 401, err.Error())
+	case pkgmirror.ForbiddenScopeError:
+		pkgmirror.SendWithHttpCode(w, 403, err.Error())
+	case pkgmirror.InvalidReferenceError:
+		pkgmirror.SendWithHttpCode(w, 400, err.Error())
+	case pkgmirror.ResourceNotFoundError, pkgmirror.EmptyKeyError, pkgmirror.InvalidPackageError:
+		pkgmirror.SendWithHttpCode(w, 404, err.Error())
+	default:
+		pkgmirror.SendWithHttpCode(w, 500, err.Error())
+	}
+}
+
+func sendPublishError(w http.ResponseWriter, err error) {
+	switch err {
+	case pkgmirror.UnauthorizedError:
+		pkgmirror.SendWithHttpCode(w, 401, err.Error())
+	case pkgmirror.ForbiddenScopeError:
+		pkgmirror.SendWithHttpCode(w, 403, err.Error())
+	case pkgmirror.InvalidPackageError, pkgmirror.InvalidReferenceError, pkgmirror.ChecksumMismatchError:
+		pkgmirror.SendWithHttpCode(w, 400, err.Error())
+	case pkgmirror.EmptyKeyError:
+		pkgmirror.SendWithHttpCode(w, 404, err.Error())
+	case pkgmirror.VersionExistsError:
+		pkgmirror.SendWithHttpCode(w, 409, err.Error())
+	default:
+		pkgmirror.SendWithHttpCode(w, 500, err.Error())
+	}
+}
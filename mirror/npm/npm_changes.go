@@ -0,0 +1,243 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package npm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	META_BUCKET = []byte("_meta")
+
+	CHANGES_SEQ_KEY   = []byte("changes_seq")
+	CHANGES_RETRY_KEY = []byte("changes_retry")
+)
+
+const (
+	CHANGES_BATCH_SIZE = 500
+)
+
+// GetSeq returns the value of a sequence, the sequences are numbers on CouchDB 1.x and
+// opaque strings on CouchDB 2.x, ie: 1234-g1AAAAB...
+func GetSeq(raw json.RawMessage) string {
+	var seq string
+
+	if err := json.Unmarshal(raw, &seq); err == nil {
+		return seq
+	}
+
+	return strings.TrimSpace(string(raw))
+}
+
+// GetChangesSeq returns the sequence of the last change processed, an empty string if none.
+func (ns *NpmService) GetChangesSeq() string {
+	var seq string
+
+	ns.DB.View(func(tx *bolt.Tx) error {
+		seq = string(tx.Bucket(META_BUCKET).Get(CHANGES_SEQ_KEY))
+
+		return nil
+	})
+
+	return seq
+}
+
+// GetChangesRetry returns the packages which failed to update, they are updated again on the
+// next sync.
+func (ns *NpmService) GetChangesRetry() []string {
+	retry := []string{}
+
+	ns.DB.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(META_BUCKET).Get(CHANGES_RETRY_KEY); len(data) > 0 {
+			json.Unmarshal(data, &retry)
+		}
+
+		return nil
+	})
+
+	return retry
+}
+
+// setChangesSeq stores the sequence with the packages to retry, so a failed package is not
+// lost when the sequence moves forward.
+func (ns *NpmService) setChangesSeq(seq string, retry map[string]bool) error {
+	ids := []string{}
+
+	for id := range retry {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	data, err := json.Marshal(ids)
+
+	if err != nil {
+		return err
+	}
+
+	return ns.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(META_BUCKET).Put(CHANGES_RETRY_KEY, data); err != nil {
+			return err
+		}
+
+		return tx.Bucket(META_BUCKET).Put(CHANGES_SEQ_KEY, []byte(seq))
+	})
+}
+
+// loadChanges returns a batch of the change feed since the provided sequence.
+func (ns *NpmService) loadChanges(since string) (*ChangesResult, error) {
+	separator := "?"
+	if strings.Contains(ns.Config.ChangesFeed, "?") {
+		separator = "&"
+	}
+
+	changes := &ChangesResult{}
+
+	if err := pkgmirror.LoadRemoteStruct(fmt.Sprintf("%s%ssince=%s&limit=%d", ns.Config.ChangesFeed, separator, url.QueryEscape(since), CHANGES_BATCH_SIZE), changes); err != nil {
+		return nil, err
+	}
+
+	if len(changes.LastSeq) == 0 {
+		return nil, pkgmirror.EmptyDataError
+	}
+
+	return changes, nil
+}
+
+// SyncChanges updates the packages listed in the change feed. Only the tracked packages and
+// the packages matching the include patterns are updated, unless the whole registry is
+// replicated. Without sequence the feed is followed from the current sequence. The packages
+// failing to update are kept in a retry list processed first by the next sync.
+func (ns *NpmService) SyncChanges() error {
+	if ns.lock {
+		return pkgmirror.DatabaseLockedError
+	}
+
+	logger := ns.Logger.WithFields(log.Fields{
+		"action": "SyncChanges",
+		"url":    ns.Config.ChangesFeed,
+	})
+
+	since := ns.GetChangesSeq()
+
+	if len(since) == 0 {
+		if ns.Config.Replicate {
+			since = "0"
+		} else {
+			since = "now"
+		}
+	}
+
+	retry := map[string]bool{}
+
+	for _, id := range ns.GetChangesRetry() {
+		if err := ns.applyChange(&Change{ID: id}); err != nil {
+			retry[id] = true
+		}
+	}
+
+	for {
+		ns.StateChan <- pkgmirror.State{
+			Message: fmt.Sprintf("Fetching changes since %s", since),
+			Status:  pkgmirror.STATUS_RUNNING,
+		}
+
+		changes, err := ns.loadChanges(since)
+
+		if err != nil {
+			logger.WithError(err).Error("Unable to load the change feed")
+
+			return err
+		}
+
+		logger.WithFields(log.Fields{
+			"since":   since,
+			"changes": len(changes.Results),
+		}).Info("Apply changes")
+
+		for _, change := range changes.Results {
+			if err := ns.applyChange(change); err != nil {
+				retry[change.ID] = true
+			} else {
+				delete(retry, change.ID)
+			}
+		}
+
+		next := GetSeq(changes.LastSeq)
+
+		// the sequence is stored after each batch, so an interrupted sync resumes from it
+		if err := ns.setChangesSeq(next, retry); err != nil {
+			return err
+		}
+
+		if next == since || len(changes.Results) < CHANGES_BATCH_SIZE {
+			return nil
+		}
+
+		since = next
+	}
+}
+
+// applyChange updates the package of a change, an error is returned if the package cannot be
+// loaded or saved.
+func (ns *NpmService) applyChange(change *Change) error {
+	logger := ns.Logger.WithFields(log.Fields{
+		"action":  "applyChange",
+		"package": change.ID,
+	})
+
+	if strings.HasPrefix(change.ID, "_design/") {
+		return nil
+	}
+
+	if change.Deleted {
+		logger.Debug("Package deleted on the registry, the local copy is kept")
+
+		return nil
+	}
+
+	current, err := ns.getMeta(change.ID)
+
+	if err != nil && !ns.Config.Replicate && !ns.Config.IsIncluded(change.ID) {
+		return nil // not tracked
+	}
+
+	if current.Private || ns.Config.IsPrivate(change.ID) {
+		return nil // published on the mirror
+	}
+
+	if err == nil && len(change.Changes) > 0 && change.Changes[0].Rev == current.Rev {
+		return nil // already up to date
+	}
+
+	pkg, err := ns.loadPackage(change.ID, current.Server)
+
+	if err == pkgmirror.ResourceNotFoundError {
+		logger.Debug("Package not available on the registries")
+
+		return nil
+	} else if err != nil {
+		logger.WithError(err).Error("Unable to load the package")
+
+		return err
+	}
+
+	if err := ns.savePackage(pkg); err != nil {
+		logger.WithError(err).Error("Unable to save the package")
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package npm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	DIST_TAGS_BUCKET = []byte("_dist_tags")
+)
+
+// GetDistTags returns the dist-tags of a package, the name can be escaped, ie: @types%2freact.
+func (ns *NpmService) GetDistTags(name string) (map[string]string, error) {
+	pkg, err := ns.getDefinition(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return getTags(pkg.DistTags), nil
+}
+
+// SetDistTag points a local tag to a version of a package published on the mirror, the tags
+// of the packages mirrored from the registries cannot be changed.
+func (ns *NpmService) SetDistTag(name, tag, version string) (map[string]string, error) {
+	if !ns.IsPrivatePackage(name) {
+		return nil, pkgmirror.ForbiddenScopeError
+	}
+
+	pkg, err := ns.getDefinition(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := pkg.Versions[version]; !ok || len(tag) == 0 {
+		return nil, pkgmirror.InvalidReferenceError
+	}
+
+	err = ns.DB.Update(func(tx *bolt.Tx) error {
+		local := getLocalTags(tx, pkg.Name)
+		local[tag] = version
+
+		if err := putLocalTags(tx, pkg.Name, local); err != nil {
+			return err
+		}
+
+		if err := ns.mergeDistTags(tx, pkg); err != nil {
+			return err
+		}
+
+		return ns.putDefinition(tx, pkg)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return getTags(pkg.DistTags), nil
+}
+
+// DeleteDistTag removes a tag from a package published on the mirror, the latest tag cannot
+// be removed.
+func (ns *NpmService) DeleteDistTag(name, tag string) (map[string]string, error) {
+	if !ns.IsPrivatePackage(name) {
+		return nil, pkgmirror.ForbiddenScopeError
+	}
+
+	if tag == "latest" {
+		return nil, pkgmirror.InvalidReferenceError
+	}
+
+	pkg, err := ns.getDefinition(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tags := getTags(pkg.DistTags)
+
+	if _, ok := tags[tag]; !ok {
+		return nil, pkgmirror.ResourceNotFoundError
+	}
+
+	delete(tags, tag)
+
+	err = ns.DB.Update(func(tx *bolt.Tx) error {
+		local := getLocalTags(tx, pkg.Name)
+		delete(local, tag)
+
+		if err := putLocalTags(tx, pkg.Name, local); err != nil {
+			return err
+		}
+
+		if err := setTags(pkg, tags); err != nil {
+			return err
+		}
+
+		return ns.putDefinition(tx, pkg)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// getDefinition returns the stored definition of a package, the package is loaded from the
+// registries if required.
+func (ns *NpmService) getDefinition(name string) (*FullPackageDefinition, error) {
+	pkg := &FullPackageDefinition{}
+
+	data, err := ns.Get(strings.Replace(name, "%2f", "/", -1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pkgmirror.Unmarshal(data, pkg); err != nil {
+		return nil, err
+	}
+
+	return pkg, nil
+}
+
+// IsPrivatePackage returns true if the package belongs to a private scope or has been published
+// on the mirror, the name can be escaped, ie: @acme%2fui.
+func (ns *NpmService) IsPrivatePackage(name string) bool {
+	private := false
+
+	ns.DB.View(func(tx *bolt.Tx) error {
+		private = ns.isPrivate(tx, strings.Replace(name, "%2f", "/", -1))
+
+		return nil
+	})
+
+	return private
+}
+
+func (ns *NpmService) isPrivate(tx *bolt.Tx, name string) bool {
+	if ns.Config.IsPrivate(name) {
+		return true
+	}
+
+	meta := &ShortPackageDefinition{}
+
+	if data := tx.Bucket(ns.Config.Code).Get([]byte(fmt.Sprintf("%s.meta", name))); len(data) > 0 {
+		json.Unmarshal(data, meta)
+	}
+
+	return meta.Private
+}
+
+// mergeDistTags applies the local tags on the tags of a private package, the tags of the
+// packages mirrored from the registries are never overridden.
+func (ns *NpmService) mergeDistTags(tx *bolt.Tx, pkg *FullPackageDefinition) error {
+	if !ns.isPrivate(tx, pkg.Name) {
+		return nil
+	}
+
+	local := getLocalTags(tx, pkg.Name)
+
+	if len(local) == 0 {
+		return nil
+	}
+
+	tags := getTags(pkg.DistTags)
+
+	for tag, version := range local {
+		tags[tag] = version
+	}
+
+	return setTags(pkg, tags)
+}
+
+func getTags(raw *json.RawMessage) map[string]string {
+	tags := map[string]string{}
+
+	if raw != nil {
+		json.Unmarshal(*raw, &tags)
+	}
+
+	return tags
+}
+
+func setTags(pkg *FullPackageDefinition, tags map[string]string) error {
+	data, err := json.Marshal(tags)
+
+	if err != nil {
+		return err
+	}
+
+	raw := json.RawMessage(data)
+	pkg.DistTags = &raw
+
+	return nil
+}
+
+func getLocalTags(tx *bolt.Tx, name string) map[string]string {
+	tags := map[string]string{}
+
+	if data := tx.Bucket(DIST_TAGS_BUCKET).Get([]byte(name)); len(data) > 0 {
+		json.Unmarshal(data, &tags)
+	}
+
+	return tags
+}
+
+func putLocalTags(tx *bolt.Tx, name string, tags map[string]string) error {
+	b := tx.Bucket(DIST_TAGS_BUCKET)
+
+	if len(tags) == 0 {
+		return b.Delete([]byte(name))
+	}
+
+	data, err := json.Marshal(tags)
+
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(name), data)
+}
@@ -0,0 +1,156 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package npm
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	DOWNLOADS_BUCKET = []byte("_downloads")
+)
+
+const (
+	DOWNLOADS_HISTORY_DAYS = 30
+
+	// the downloads are counted in memory and stored at this interval
+	DOWNLOADS_FLUSH_INTERVAL = time.Minute
+)
+
+// recordDownload increments the counters kept in memory each time a tarball is served, the
+// counters are stored by flushDownloads.
+func (ns *NpmService) recordDownload(name string) {
+	ns.downloadsLock.Lock()
+	defer ns.downloadsLock.Unlock()
+
+	if ns.downloads == nil {
+		ns.downloads = map[string]*pkgmirror.DownloadCounter{}
+	}
+
+	if _, ok := ns.downloads[name]; !ok {
+		ns.downloads[name] = &pkgmirror.DownloadCounter{}
+	}
+
+	ns.downloads[name].Add(1, time.Now(), DOWNLOADS_HISTORY_DAYS)
+}
+
+// flushDownloads stores the counters kept in memory in one transaction, the counters are
+// kept for the next run if the transaction fails.
+func (ns *NpmService) flushDownloads() error {
+	if ns.lock {
+		return pkgmirror.DatabaseLockedError
+	}
+
+	ns.downloadsLock.Lock()
+	downloads := ns.downloads
+	ns.downloads = nil
+	ns.downloadsLock.Unlock()
+
+	if len(downloads) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	err := ns.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(DOWNLOADS_BUCKET)
+
+		for name, counter := range downloads {
+			stat := &DownloadStat{}
+
+			if data := b.Get([]byte(name)); len(data) > 0 {
+				if err := json.Unmarshal(data, stat); err != nil {
+					return err
+				}
+			}
+
+			stat.Merge(counter, now, DOWNLOADS_HISTORY_DAYS)
+
+			data, err := json.Marshal(stat)
+
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		ns.Logger.WithFields(log.Fields{
+			"action":     "flushDownloads",
+			"packages":   len(downloads),
+			log.ErrorKey: err.Error(),
+		}).Error("Unable to store the downloads")
+
+		ns.downloadsLock.Lock()
+		for name, counter := range ns.downloads {
+			if _, ok := downloads[name]; !ok {
+				downloads[name] = &pkgmirror.DownloadCounter{}
+			}
+
+			downloads[name].Merge(counter, now, DOWNLOADS_HISTORY_DAYS)
+		}
+		ns.downloads = downloads
+		ns.downloadsLock.Unlock()
+	}
+
+	return err
+}
+
+// GetDownloads returns the download counters of a package, including the downloads not
+// stored yet.
+func (ns *NpmService) GetDownloads(name string) (*DownloadStat, error) {
+	stat := &DownloadStat{}
+
+	err := ns.DB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(DOWNLOADS_BUCKET).Get([]byte(name))
+
+		if len(data) == 0 {
+			return pkgmirror.EmptyKeyError
+		}
+
+		return json.Unmarshal(data, stat)
+	})
+
+	if counter := ns.getPendingDownloads(name); counter != nil && (err == nil || err == pkgmirror.EmptyKeyError) {
+		stat.Merge(counter, time.Now(), DOWNLOADS_HISTORY_DAYS)
+
+		return stat, nil
+	}
+
+	return stat, err
+}
+
+// getPendingDownloads returns a copy of the counters not stored yet, nil if the package has
+// not been downloaded since the last flush.
+func (ns *NpmService) getPendingDownloads(name string) *pkgmirror.DownloadCounter {
+	ns.downloadsLock.Lock()
+	defer ns.downloadsLock.Unlock()
+
+	counter, ok := ns.downloads[name]
+
+	if !ok {
+		return nil
+	}
+
+	pending := &pkgmirror.DownloadCounter{Total: counter.Total, Days: map[string]int{}}
+
+	for day, count := range counter.Days {
+		pending.Days[day] = count
+	}
+
+	return pending
+}
@@ -0,0 +1,94 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package npm
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	INTEGRITY_ALGORITHMS = map[string]func() hash.Hash{
+		"sha1":   sha1.New,
+		"sha256": sha256.New,
+		"sha384": sha512.New384,
+		"sha512": sha512.New,
+	}
+)
+
+// Verifier computes the digests of a tarball while it is written, the expected digests are
+// read from the integrity and shasum fields of the dist object.
+type Verifier struct {
+	expected map[string]string // base64 digest indexed by algorithm
+	hashes   map[string]hash.Hash
+}
+
+func NewVerifier(dist DistDefinition) *Verifier {
+	v := &Verifier{
+		expected: map[string]string{},
+		hashes:   map[string]hash.Hash{},
+	}
+
+	// ie: sha512-BASE64 sha1-BASE64?option
+	for _, value := range strings.Fields(dist.Integrity) {
+		if i := strings.Index(value, "?"); i > 0 {
+			value = value[:i]
+		}
+
+		i := strings.Index(value, "-")
+
+		if i <= 0 {
+			continue
+		}
+
+		if _, ok := INTEGRITY_ALGORITHMS[value[:i]]; ok {
+			v.expected[value[:i]] = value[i+1:]
+		}
+	}
+
+	if _, ok := v.expected["sha1"]; !ok && len(dist.Shasum) > 0 {
+		if sum, err := hex.DecodeString(dist.Shasum); err == nil {
+			v.expected["sha1"] = base64.StdEncoding.EncodeToString(sum)
+		}
+	}
+
+	for algorithm := range v.expected {
+		v.hashes[algorithm] = INTEGRITY_ALGORITHMS[algorithm]()
+	}
+
+	return v
+}
+
+// HasDigests returns true if the dist object publishes a digest.
+func (v *Verifier) HasDigests() bool {
+	return len(v.expected) > 0
+}
+
+func (v *Verifier) Write(p []byte) (int, error) {
+	for _, h := range v.hashes {
+		h.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// Verify checks the written data against all published digests.
+func (v *Verifier) Verify() error {
+	for algorithm, expected := range v.expected {
+		if base64.StdEncoding.EncodeToString(v.hashes[algorithm].Sum(nil)) != expected {
+			return pkgmirror.ChecksumMismatchError
+		}
+	}
+
+	return nil
+}
@@ -66,3 +66,54 @@ func (m packagePatMatch) Value(key interface{}) interface{} {
 
 	return m.Context.Value(key)
 }
+
+// NewDistTagsPat matches the dist-tags urls used by the npm dist-tag command, ie:
+// /npm/npm/-/package/@types%2freact/dist-tags and /npm/npm/-/package/react/dist-tags/stable
+func NewDistTagsPat(code, method string) goji.Pattern {
+	return &DistTagsPat{
+		Method:  method,
+		Pattern: regexp.MustCompile(fmt.Sprintf(`^\/npm\/%s\/-\/package\/((@[\w\d.-]+\/|)[\w\d.-]+)\/dist-tags(\/([\w\d.-]+)|)$`, code)),
+	}
+}
+
+type DistTagsPat struct {
+	Method  string
+	Pattern *regexp.Regexp
+}
+
+func (dp *DistTagsPat) Match(ctx context.Context, r *http.Request) context.Context {
+	var results []string
+
+	if r.Method != dp.Method {
+		return nil
+	}
+
+	if results = dp.Pattern.FindStringSubmatch(r.URL.Path); len(results) == 0 {
+		return nil
+	}
+
+	return &distTagsPatMatch{ctx, strings.Replace(results[1], "/", "%2f", -1), results[4]}
+}
+
+type distTagsPatMatch struct {
+	context.Context
+	Package string
+	Tag     string
+}
+
+func (m distTagsPatMatch) Value(key interface{}) interface{} {
+
+	switch key {
+	case pattern.AllVariables:
+		return map[pattern.Variable]string{
+			"package": m.Package,
+			"tag":     m.Tag,
+		}
+	case pattern.Variable("package"):
+		return m.Package
+	case pattern.Variable("tag"):
+		return m.Tag
+	}
+
+	return m.Context.Value(key)
+}
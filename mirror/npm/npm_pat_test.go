@@ -81,3 +81,28 @@ func Test_Npm_Pat_OtherVariable(t *testing.T) {
 
 	assert.Nil(t, result.Value(pattern.Variable("foo")))
 }
+
+func Test_Npm_DistTags_Pat(t *testing.T) {
+
+	cases := []struct{ Method, Url, Package, Tag string }{
+		{"GET", "/npm/npm/-/package/aspace/dist-tags", "aspace", ""},
+		{"GET", "/npm/npm/-/package/@types%2freact/dist-tags", "@types%2freact", ""},
+		{"PUT", "/npm/npm/-/package/aspace/dist-tags/stable", "aspace", "stable"},
+		{"DELETE", "/npm/npm/-/package/@types%2freact/dist-tags/stable", "@types%2freact", "stable"},
+	}
+
+	for _, p := range cases {
+		c, r := mustReq(p.Method, p.Url)
+
+		result := NewDistTagsPat("npm", p.Method).Match(c, r)
+
+		assert.NotNil(t, result)
+		assert.Equal(t, p.Package, result.Value(pattern.Variable("package")))
+		assert.Equal(t, p.Tag, result.Value(pattern.Variable("tag")))
+	}
+
+	c, r := mustReq("GET", "/npm/npm/-/package/aspace/dist-tags")
+
+	assert.Nil(t, NewDistTagsPat("npm", "PUT").Match(c, r))
+	assert.Nil(t, NewDistTagsPat("other", "GET").Match(c, r))
+}
@@ -0,0 +1,465 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package npm
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/gonode/core/vault"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	UNPUBLISHED_BUCKET = []byte("_unpublished")
+)
+
+const (
+	PUBLISH_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+)
+
+// GetVaultKey returns the key of a tarball, the scoped names are escaped, ie: @acme%2fui/1.0.0
+func GetVaultKey(name, version string) string {
+	return fmt.Sprintf("%s/%s", strings.Replace(name, "/", "%2f", -1), version)
+}
+
+// GetPrivateTarball returns the public url of a tarball published on the mirror, the url
+// uses the format of the urls generated by the rewrite rules.
+func (ns *NpmService) GetPrivateTarball(name, version string) string {
+	basename := name[strings.LastIndex(name, "/")+1:]
+
+	return fmt.Sprintf("%s/npm/%s/%s/-/%s-%s.tgz", ns.Config.PublicServer, ns.Config.Code, name, basename, version)
+}
+
+// Publish adds the versions of the publish document to a private package, the tarballs are
+// checked against the published digests and stored in the vault. A version cannot be published
+// twice, even once unpublished.
+func (ns *NpmService) Publish(name string, doc *PublishDocument) (*ShortPackageDefinition, error) {
+	name = strings.Replace(name, "%2f", "/", -1)
+
+	logger := ns.Logger.WithFields(log.Fields{
+		"action":  "Publish",
+		"package": name,
+	})
+
+	if !ns.Config.IsPrivate(name) {
+		return nil, pkgmirror.ForbiddenScopeError
+	}
+
+	if doc.Name != name || len(doc.Versions) == 0 {
+		return nil, pkgmirror.InvalidPackageError
+	}
+
+	tarballs := map[string][]byte{}
+
+	for version, definition := range doc.Versions {
+		attachment, ok := doc.Attachments[fmt.Sprintf("%s-%s.tgz", name, version)]
+
+		if !ok {
+			return nil, pkgmirror.InvalidPackageError
+		}
+
+		data, err := base64.StdEncoding.DecodeString(attachment.Data)
+
+		if err != nil {
+			return nil, pkgmirror.InvalidPackageError
+		}
+
+		verifier := NewVerifier(definition.Dist)
+		verifier.Write(data)
+
+		if err := verifier.Verify(); err != nil {
+			return nil, err
+		}
+
+		sha1sum := sha1.Sum(data)
+		sha512sum := sha512.Sum512(data)
+
+		definition.Dist.Shasum = fmt.Sprintf("%x", sha1sum)
+		definition.Dist.Integrity = fmt.Sprintf("sha512-%s", base64.StdEncoding.EncodeToString(sha512sum[:]))
+		definition.Dist.Tarball = ns.GetPrivateTarball(name, version)
+
+		tarballs[version] = data
+	}
+
+	published := getTags(doc.DistTags)
+	stored := []string{}
+
+	// the transaction locks the database, so the versions are checked and the tarballs are
+	// stored before another publish request reads the package
+	err := ns.DB.Update(func(tx *bolt.Tx) error {
+		pkg, err := ns.loadPrivate(tx, name)
+
+		if err == pkgmirror.EmptyKeyError {
+			pkg = &FullPackageDefinition{
+				ID:       name,
+				Name:     name,
+				Versions: map[string]*PackageVersionDefinition{},
+			}
+		} else if err != nil {
+			return err
+		}
+
+		unpublished := getUnpublished(tx, name)
+
+		for version := range doc.Versions {
+			if _, ok := pkg.Versions[version]; ok {
+				return pkgmirror.VersionExistsError
+			}
+
+			if _, ok := unpublished[version]; ok {
+				return pkgmirror.VersionExistsError
+			}
+		}
+
+		for version, data := range tarballs {
+			meta := vault.NewVaultMetadata()
+			meta["path"] = name
+			meta["version"] = version
+
+			stored = append(stored, GetVaultKey(name, version))
+
+			if _, err := ns.Vault.Put(GetVaultKey(name, version), meta, bytes.NewReader(data)); err != nil {
+				logger.WithError(err).WithField("version", version).Error("Unable to store the tarball")
+
+				return err
+			}
+		}
+
+		now := time.Now().UTC().Format(PUBLISH_TIME_FORMAT)
+		times := map[string]string{}
+
+		if pkg.Time != nil {
+			json.Unmarshal(*pkg.Time, &times)
+		}
+
+		if _, ok := times["created"]; !ok {
+			times["created"] = now
+		}
+
+		times["modified"] = now
+
+		for version, definition := range doc.Versions {
+			pkg.Versions[version] = definition
+			times[version] = now
+		}
+
+		if data, err := json.Marshal(times); err != nil {
+			return err
+		} else {
+			raw := json.RawMessage(data)
+			pkg.Time = &raw
+		}
+
+		tags := getTags(pkg.DistTags)
+
+		for tag, version := range published {
+			tags[tag] = version
+		}
+
+		if err := setTags(pkg, tags); err != nil {
+			return err
+		}
+
+		pkg.Description = doc.Description
+		pkg.Maintainers = doc.Maintainers
+		pkg.Author = doc.Author
+		pkg.Repository = doc.Repository
+		pkg.License = doc.License
+
+		// the published tags replace the local tags
+		local := getLocalTags(tx, name)
+
+		for tag := range published {
+			delete(local, tag)
+		}
+
+		if err := putLocalTags(tx, name, local); err != nil {
+			return err
+		}
+
+		if err := ns.mergeDistTags(tx, pkg); err != nil {
+			return err
+		}
+
+		return ns.storePrivate(tx, pkg)
+	})
+
+	if err != nil {
+		// the transaction is rolled back, so the tarballs are not referenced
+		for _, key := range stored {
+			ns.Vault.Remove(key)
+		}
+
+		return nil, err
+	}
+
+	logger.WithField("versions", len(doc.Versions)).Info("Package published")
+
+	return ns.getMeta(name)
+}
+
+// UpdatePrivate removes the versions missing from the document, this is the request sent by the
+// npm unpublish command for a single version. The package is deleted if no version remains.
+func (ns *NpmService) UpdatePrivate(name string, doc *PublishDocument) (*ShortPackageDefinition, error) {
+	name = strings.Replace(name, "%2f", "/", -1)
+
+	removed := []string{}
+	deleted := false
+
+	err := ns.DB.Update(func(tx *bolt.Tx) error {
+		pkg, err := ns.loadPrivate(tx, name)
+
+		if err != nil {
+			return err
+		}
+
+		for version := range pkg.Versions {
+			if _, ok := doc.Versions[version]; !ok {
+				removed = append(removed, version)
+			}
+		}
+
+		if len(removed) == len(pkg.Versions) {
+			deleted = true
+
+			return ns.deletePrivate(tx, pkg)
+		}
+
+		if err := ns.unpublish(tx, name, removed); err != nil {
+			return err
+		}
+
+		for _, version := range removed {
+			delete(pkg.Versions, version)
+		}
+
+		// the tags pointing to a removed version are dropped
+		tags := map[string]string{}
+
+		for tag, version := range getTags(doc.DistTags) {
+			if _, ok := pkg.Versions[version]; ok {
+				tags[tag] = version
+			}
+		}
+
+		if err := setTags(pkg, tags); err != nil {
+			return err
+		}
+
+		if err := putLocalTags(tx, name, map[string]string{}); err != nil {
+			return err
+		}
+
+		return ns.storePrivate(tx, pkg)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range removed {
+		ns.Vault.Remove(GetVaultKey(name, version))
+	}
+
+	if deleted {
+		return nil, nil
+	}
+
+	return ns.getMeta(name)
+}
+
+// DeletePrivate removes a private package and its tarballs, the version numbers cannot be
+// published again.
+func (ns *NpmService) DeletePrivate(name string) error {
+	name = strings.Replace(name, "%2f", "/", -1)
+
+	var pkg *FullPackageDefinition
+
+	err := ns.DB.Update(func(tx *bolt.Tx) (err error) {
+		if pkg, err = ns.loadPrivate(tx, name); err != nil {
+			return err
+		}
+
+		return ns.deletePrivate(tx, pkg)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for version := range pkg.Versions {
+		ns.Vault.Remove(GetVaultKey(name, version))
+	}
+
+	return nil
+}
+
+func (ns *NpmService) deletePrivate(tx *bolt.Tx, pkg *FullPackageDefinition) error {
+	b := tx.Bucket(ns.Config.Code)
+
+	for _, key := range []string{pkg.Name, fmt.Sprintf("%s.meta", pkg.Name), GetAbbreviatedKey(pkg.Name)} {
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	for _, bucket := range [][]byte{SEARCH_BUCKET, DIST_TAGS_BUCKET, DOWNLOADS_BUCKET} {
+		if err := tx.Bucket(bucket).Delete([]byte(pkg.Name)); err != nil {
+			return err
+		}
+	}
+
+	versions := []string{}
+
+	for version := range pkg.Versions {
+		versions = append(versions, version)
+	}
+
+	ns.Logger.WithFields(log.Fields{
+		"action":  "DeletePrivate",
+		"package": pkg.Name,
+	}).Info("Package deleted")
+
+	return ns.unpublish(tx, pkg.Name, versions)
+}
+
+// unpublish records the removed versions, the unpublished versions are kept when the package
+// is deleted.
+func (ns *NpmService) unpublish(tx *bolt.Tx, name string, versions []string) error {
+	if len(versions) == 0 {
+		return nil
+	}
+
+	unpublished := getUnpublished(tx, name)
+	now := time.Now().UTC().Format(PUBLISH_TIME_FORMAT)
+
+	for _, version := range versions {
+		unpublished[version] = now
+	}
+
+	data, err := json.Marshal(unpublished)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(UNPUBLISHED_BUCKET).Put([]byte(name), data)
+}
+
+// getUnpublished returns the versions removed from a private package with the removal time.
+func getUnpublished(tx *bolt.Tx, name string) map[string]string {
+	versions := map[string]string{}
+
+	if data := tx.Bucket(UNPUBLISHED_BUCKET).Get([]byte(name)); len(data) > 0 {
+		json.Unmarshal(data, &versions)
+	}
+
+	return versions
+}
+
+// DeletePrivateTarball removes the tarball of a version removed from a private package.
+func (ns *NpmService) DeletePrivateTarball(name, version string) error {
+	name = strings.Replace(name, "%2f", "/", -1)
+
+	if !ns.Config.IsPrivate(name) {
+		return pkgmirror.ForbiddenScopeError
+	}
+
+	if pkg, err := ns.getPrivate(name); err == nil {
+		if _, ok := pkg.Versions[version]; ok {
+			return pkgmirror.InvalidReferenceError
+		}
+	} else if err != pkgmirror.EmptyKeyError {
+		return err
+	}
+
+	if ns.Vault.Has(GetVaultKey(name, version)) {
+		return ns.Vault.Remove(GetVaultKey(name, version))
+	}
+
+	return nil
+}
+
+// getPrivate returns the definition of a package published on the mirror, EmptyKeyError is
+// returned if the package does not exist.
+func (ns *NpmService) getPrivate(name string) (pkg *FullPackageDefinition, err error) {
+	err = ns.DB.View(func(tx *bolt.Tx) error {
+		pkg, err = ns.loadPrivate(tx, name)
+
+		return err
+	})
+
+	return pkg, err
+}
+
+func (ns *NpmService) loadPrivate(tx *bolt.Tx, name string) (*FullPackageDefinition, error) {
+	b := tx.Bucket(ns.Config.Code)
+	meta := &ShortPackageDefinition{}
+
+	if data := b.Get([]byte(fmt.Sprintf("%s.meta", name))); len(data) == 0 {
+		return nil, pkgmirror.EmptyKeyError
+	} else if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+
+	if !meta.Private {
+		return nil, pkgmirror.ForbiddenScopeError
+	}
+
+	pkg := &FullPackageDefinition{}
+
+	if err := pkgmirror.Unmarshal(b.Get([]byte(name)), pkg); err != nil {
+		return nil, err
+	}
+
+	return pkg, nil
+}
+
+// storePrivate stores the package without rewriting the tarball urls, a new revision is generated.
+func (ns *NpmService) storePrivate(tx *bolt.Tx, pkg *FullPackageDefinition) error {
+	pkg.Rev = nextRev(pkg.Rev)
+	pkg.Attachments = nil
+
+	meta, err := json.Marshal(&ShortPackageDefinition{
+		ID:                pkg.ID,
+		Rev:               pkg.Rev,
+		Name:              pkg.Name,
+		ReleasesAvailable: len(pkg.Versions),
+		Private:           true,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(ns.Config.Code).Put([]byte(fmt.Sprintf("%s.meta", pkg.Name)), meta); err != nil {
+		return err
+	}
+
+	return ns.putDefinition(tx, pkg)
+}
+
+// nextRev increments a CouchDB like revision, ie: 3-5a9cd12c5e7b5d16645f4896326d29c8
+func nextRev(rev string) string {
+	n := 0
+
+	if i := strings.Index(rev, "-"); i > 0 {
+		n, _ = strconv.Atoi(rev[:i])
+	}
+
+	return fmt.Sprintf("%d-%x", n+1, md5.Sum([]byte(fmt.Sprintf("%s%d", rev, time.Now().UnixNano()))))
+}
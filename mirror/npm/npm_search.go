@@ -0,0 +1,361 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package npm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/pkgmirror"
+)
+
+var (
+	SEARCH_BUCKET = []byte("_search")
+)
+
+const (
+	SEARCH_SIZE     = 20
+	SEARCH_MAX_SIZE = 250
+
+	// weights of the final score, the popularity is computed from the local downloads
+	SEARCH_QUALITY_WEIGHT     = 0.3
+	SEARCH_POPULARITY_WEIGHT  = 0.5
+	SEARCH_MAINTENANCE_WEIGHT = 0.2
+
+	// a package without release during this period is not maintained
+	SEARCH_MAINTENANCE_PERIOD = 2 * 365 * 24 * time.Hour
+)
+
+// NewSearchEntry creates the index entry from the version tagged as latest.
+func NewSearchEntry(pkg *FullPackageDefinition) *SearchEntry {
+	entry := &SearchEntry{
+		Name:        pkg.Name,
+		Description: getString(pkg.Description),
+		Keywords:    []string{},
+		Maintainers: []*SearchMaintainer{},
+	}
+
+	entry.Version = getTags(pkg.DistTags)["latest"]
+
+	if version, ok := pkg.Versions[entry.Version]; ok {
+		if description := getString(version.Description); len(description) > 0 {
+			entry.Description = description
+		}
+
+		if version.Keywords != nil {
+			// the old packages use a string
+			if err := json.Unmarshal(*version.Keywords, &entry.Keywords); err != nil {
+				entry.Keywords = strings.FieldsFunc(getString(version.Keywords), func(r rune) bool {
+					return r == ',' || r == ' '
+				})
+			}
+		}
+	}
+
+	if pkg.Maintainers != nil {
+		maintainers := []struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		}{}
+
+		json.Unmarshal(*pkg.Maintainers, &maintainers)
+
+		for _, m := range maintainers {
+			entry.Maintainers = append(entry.Maintainers, &SearchMaintainer{Username: m.Name, Email: m.Email})
+		}
+	}
+
+	if pkg.Time != nil {
+		times := map[string]time.Time{}
+
+		json.Unmarshal(*pkg.Time, &times)
+
+		if date, ok := times[entry.Version]; ok {
+			entry.Date = date
+		} else {
+			entry.Date = times["modified"]
+		}
+	}
+
+	return entry
+}
+
+// Score returns the relevance of the entry for the provided terms, 0 means the entry does not
+// match. The keywords:, maintainer: and scope: qualifiers are supported.
+func (e *SearchEntry) Score(terms []string) int {
+	name := strings.ToLower(e.Name)
+
+	hasKeyword := func(term string) bool {
+		for _, keyword := range e.Keywords {
+			if strings.ToLower(keyword) == term {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	score := 1
+
+	for _, term := range terms {
+		switch {
+		case strings.HasPrefix(term, "keywords:"):
+			for _, keyword := range strings.Split(term[9:], ",") {
+				if !hasKeyword(keyword) {
+					return 0
+				}
+
+				score += 5
+			}
+
+		case strings.HasPrefix(term, "maintainer:"):
+			matched := false
+
+			for _, m := range e.Maintainers {
+				if strings.ToLower(m.Username) == term[11:] {
+					matched = true
+				}
+			}
+
+			if !matched {
+				return 0
+			}
+
+			score += 5
+
+		case strings.HasPrefix(term, "scope:"):
+			if !strings.HasPrefix(name, fmt.Sprintf("@%s/", strings.TrimPrefix(term[6:], "@"))) {
+				return 0
+			}
+
+			score += 5
+
+		default:
+			matched := pkgmirror.ScoreTerm(term, e.Name, e.Description, e.Keywords)
+
+			if matched == 0 {
+				return 0
+			}
+
+			score += matched
+		}
+	}
+
+	return score
+}
+
+// Quality returns the share of the metadata fields filled by the package.
+func (e *SearchEntry) Quality() float64 {
+	quality := 0.0
+
+	for _, filled := range []bool{len(e.Description) > 0, len(e.Keywords) > 0, len(e.Maintainers) > 0} {
+		if filled {
+			quality += 1.0 / 3
+		}
+	}
+
+	return quality
+}
+
+// Maintenance decreases with the age of the latest release.
+func (e *SearchEntry) Maintenance(now time.Time) float64 {
+	if e.Date.IsZero() {
+		return 0
+	}
+
+	return math.Max(0, math.Min(1, 1-float64(now.Sub(e.Date))/float64(SEARCH_MAINTENANCE_PERIOD)))
+}
+
+func (ns *NpmService) indexPackage(tx *bolt.Tx, pkg *FullPackageDefinition) error {
+	if data, err := json.Marshal(NewSearchEntry(pkg)); err != nil {
+		return err
+	} else {
+		return tx.Bucket(SEARCH_BUCKET).Put([]byte(pkg.Name), data)
+	}
+}
+
+// rebuildSearchIndex indexes the packages stored by the versions of the mirror released
+// without the npm search, the packages are found with their ".meta" entry.
+func (ns *NpmService) rebuildSearchIndex() error {
+	logger := ns.Logger.WithFields(log.Fields{
+		"action": "rebuildSearchIndex",
+	})
+
+	return pkgmirror.RebuildIndex(ns.DB, SEARCH_BUCKET, logger, func(tx *bolt.Tx) error {
+		b := tx.Bucket(ns.Config.Code)
+
+		return b.ForEach(func(k, v []byte) error {
+			if !strings.HasSuffix(string(k), ".meta") {
+				return nil
+			}
+
+			name := string(k[:len(k)-5])
+			pkg := &FullPackageDefinition{}
+
+			if err := pkgmirror.Unmarshal(b.Get([]byte(name)), pkg); err != nil {
+				logger.WithError(err).WithField("package", name).Debug("Unable to load package definition")
+
+				return nil
+			}
+
+			return ns.indexPackage(tx, pkg)
+		})
+	})
+}
+
+// Search returns registry compatible search results, the results are sorted by relevance
+// weighted by the quality, popularity and maintenance scores.
+func (ns *NpmService) Search(text string, size, from int) (*SearchResult, error) {
+	if size < 1 {
+		size = SEARCH_SIZE
+	} else if size > SEARCH_MAX_SIZE {
+		size = SEARCH_MAX_SIZE
+	}
+
+	if from < 0 {
+		from = 0
+	}
+
+	now := time.Now()
+	terms := strings.Fields(strings.ToLower(text))
+
+	type match struct {
+		entry     *SearchEntry
+		relevance int
+		downloads int
+	}
+
+	matches := []*match{}
+	maxDownloads := 0
+
+	err := ns.DB.View(func(tx *bolt.Tx) error {
+		db := tx.Bucket(DOWNLOADS_BUCKET)
+
+		return tx.Bucket(SEARCH_BUCKET).ForEach(func(k, v []byte) error {
+			entry := &SearchEntry{}
+
+			if err := json.Unmarshal(v, entry); err != nil {
+				return nil
+			}
+
+			relevance := entry.Score(terms)
+
+			if relevance == 0 {
+				return nil
+			}
+
+			m := &match{entry: entry, relevance: relevance}
+			stat := &DownloadStat{}
+
+			json.Unmarshal(db.Get(k), stat)
+
+			// the downloads not stored yet are included
+			if counter := ns.getPendingDownloads(string(k)); counter != nil {
+				stat.Merge(counter, now, DOWNLOADS_HISTORY_DAYS)
+			}
+
+			m.downloads = stat.Since(DOWNLOADS_HISTORY_DAYS, now)
+
+			if m.downloads > maxDownloads {
+				maxDownloads = m.downloads
+			}
+
+			matches = append(matches, m)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []*SearchObject{}
+
+	for _, m := range matches {
+		score := &SearchScore{}
+		score.Detail.Quality = m.entry.Quality()
+		score.Detail.Maintenance = m.entry.Maintenance(now)
+
+		// the popularity is relative to the most downloaded package matching the query
+		if maxDownloads > 0 {
+			score.Detail.Popularity = math.Log1p(float64(m.downloads)) / math.Log1p(float64(maxDownloads))
+		}
+
+		score.Final = SEARCH_QUALITY_WEIGHT*score.Detail.Quality +
+			SEARCH_POPULARITY_WEIGHT*score.Detail.Popularity +
+			SEARCH_MAINTENANCE_WEIGHT*score.Detail.Maintenance
+
+		objects = append(objects, &SearchObject{
+			Package:     ns.newSearchPackage(m.entry),
+			Score:       score,
+			SearchScore: float64(m.relevance) * (1 + score.Final),
+		})
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].SearchScore != objects[j].SearchScore {
+			return objects[i].SearchScore > objects[j].SearchScore
+		}
+
+		return objects[i].Package.Name < objects[j].Package.Name
+	})
+
+	result := &SearchResult{
+		Objects: []*SearchObject{},
+		Total:   len(objects),
+		Time:    now.UTC().Format(time.RFC1123),
+	}
+
+	if from < len(objects) {
+		end := from + size
+
+		if end > len(objects) {
+			end = len(objects)
+		}
+
+		result.Objects = objects[from:end]
+	}
+
+	return result, nil
+}
+
+func (ns *NpmService) newSearchPackage(entry *SearchEntry) *SearchPackage {
+	scope := "unscoped"
+
+	if i := strings.Index(entry.Name, "/"); strings.HasPrefix(entry.Name, "@") && i > 0 {
+		scope = entry.Name[1:i]
+	}
+
+	return &SearchPackage{
+		Name:        entry.Name,
+		Scope:       scope,
+		Version:     entry.Version,
+		Description: entry.Description,
+		Keywords:    entry.Keywords,
+		Date:        entry.Date,
+		Maintainers: entry.Maintainers,
+		Links: map[string]string{
+			"npm": fmt.Sprintf("%s/npm/%s/%s", ns.Config.PublicServer, ns.Config.Code, entry.Name),
+		},
+	}
+}
+
+func getString(raw *json.RawMessage) string {
+	value := ""
+
+	if raw != nil {
+		json.Unmarshal(*raw, &value)
+	}
+
+	return value
+}
@@ -7,6 +7,9 @@ package npm
 
 import (
 	"encoding/json"
+	"time"
+
+	"github.com/rande/pkgmirror"
 )
 
 type PackageVersionDefinition struct {
@@ -48,19 +51,28 @@ type PackageVersionDefinition struct {
 	//NodeVersion          *json.RawMessage `json:"_nodeVersion,omitempty"`
 	//NpmUser              *json.RawMessage `json:"_npmUser,omitempty"`
 	//Maintainers          *json.RawMessage `json:"maintainers,omitempty"`
-	Dist struct {
-		Shasum  string `json:"shasum,omitempty"`
-		Tarball string `json:"tarball,omitempty"`
-	} `json:"dist,omitempty"`
+	Dist DistDefinition `json:"dist,omitempty"`
 	//NpmOperationalInternal *json.RawMessage `json:"_npmOperationalInternal,omitempty"`
 	Directories *json.RawMessage `json:"directories,omitempty"`
 }
 
+type DistDefinition struct {
+	Shasum       string           `json:"shasum,omitempty"`
+	Tarball      string           `json:"tarball,omitempty"`
+	Integrity    string           `json:"integrity,omitempty"` // subresource integrity, ie: sha512-BASE64
+	FileCount    int              `json:"fileCount,omitempty"`
+	UnpackedSize int              `json:"unpackedSize,omitempty"`
+	Signatures   *json.RawMessage `json:"signatures,omitempty"`
+	NpmSignature string           `json:"npm-signature,omitempty"`
+}
+
 type ShortPackageDefinition struct {
 	ID                string `json:"_id,omitempty"`
 	Rev               string `json:"_rev,omitempty"`
 	Name              string `json:"name,omitempty"`
 	ReleasesAvailable int    `json:"releases_available,omitempty"`
+	Server            string `json:"server,omitempty"`  // registry providing the package
+	Private           bool   `json:"private,omitempty"` // published on the mirror
 }
 
 type FullPackageDefinition struct {
@@ -71,14 +83,118 @@ type FullPackageDefinition struct {
 	DistTags    *json.RawMessage                     `json:"dist-tags"`
 	Versions    map[string]*PackageVersionDefinition `json:"versions,omitempty"`
 	//Readme         *json.RawMessage                     `json:"readme,omitempty"`
-	//Maintainers    *json.RawMessage                     `json:"maintainers,omitempty"`
-	Time       *json.RawMessage `json:"time,omitempty"`
-	Author     *json.RawMessage `json:"author,omitempty"`
-	Repository *json.RawMessage `json:"repository,omitempty"`
+	Maintainers *json.RawMessage `json:"maintainers,omitempty"`
+	Time        *json.RawMessage `json:"time,omitempty"`
+	Author      *json.RawMessage `json:"author,omitempty"`
+	Repository  *json.RawMessage `json:"repository,omitempty"`
 	//Users          *json.RawMessage                     `json:"users,omitempty"`
 	//ReadmeFilename *json.RawMessage                     `json:"readmeFilename,omitempty"`
 	//Homepage       *json.RawMessage                     `json:"homepage,omitempty"`
 	//Bugs           *json.RawMessage                     `json:"bugs,omitempty"`
 	License     *json.RawMessage `json:"license,omitempty"`
 	Attachments *json.RawMessage `json:"_attachments,omitempty"`
+	Server      string           `json:"-"` // registry providing the package
+}
+
+// abbreviated metadata requested by the install commands, ie: application/vnd.npm.install-v1+json
+type AbbreviatedPackageDefinition struct {
+	Name     string                                   `json:"name"`
+	Modified string                                   `json:"modified,omitempty"`
+	DistTags *json.RawMessage                         `json:"dist-tags"`
+	Versions map[string]*AbbreviatedVersionDefinition `json:"versions"`
+}
+
+type AbbreviatedVersionDefinition struct {
+	Name                 string           `json:"name"`
+	Version              string           `json:"version"`
+	Dependencies         *json.RawMessage `json:"dependencies,omitempty"`
+	DevDependencies      *json.RawMessage `json:"devDependencies,omitempty"`
+	PeerDependencies     *json.RawMessage `json:"peerDependencies,omitempty"`
+	OptionalDependencies *json.RawMessage `json:"optionalDependencies,omitempty"`
+	BundleDependencies   *json.RawMessage `json:"bundleDependencies,omitempty"`
+	Bin                  *json.RawMessage `json:"bin,omitempty"`
+	Engines              *json.RawMessage `json:"engines,omitempty"`
+	Os                   *json.RawMessage `json:"os,omitempty"`
+	Cpu                  *json.RawMessage `json:"cpu,omitempty"`
+	Dist                 DistDefinition   `json:"dist"`
+}
+
+// used to read a batch of the _changes feed
+type ChangesResult struct {
+	Results []*Change       `json:"results"`
+	LastSeq json.RawMessage `json:"last_seq"` // a number or a string depending on the registry
+}
+
+type Change struct {
+	ID      string          `json:"id"`
+	Seq     json.RawMessage `json:"seq"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Changes []*struct {
+		Rev string `json:"rev"`
+	} `json:"changes"`
+}
+
+// entry stored in the search index, the fields are read from the latest version
+type SearchEntry struct {
+	Name        string              `json:"name"`
+	Version     string              `json:"version"`
+	Description string              `json:"description"`
+	Keywords    []string            `json:"keywords"`
+	Maintainers []*SearchMaintainer `json:"maintainers"`
+	Date        time.Time           `json:"date"`
+}
+
+type SearchMaintainer struct {
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+}
+
+// used to generate the /-/v1/search response, the format is compatible with registry.npmjs.org
+type SearchResult struct {
+	Objects []*SearchObject `json:"objects"`
+	Total   int             `json:"total"`
+	Time    string          `json:"time"`
+}
+
+type SearchObject struct {
+	Package     *SearchPackage `json:"package"`
+	Score       *SearchScore   `json:"score"`
+	SearchScore float64        `json:"searchScore"`
+}
+
+type SearchPackage struct {
+	Name        string              `json:"name"`
+	Scope       string              `json:"scope"`
+	Version     string              `json:"version"`
+	Description string              `json:"description"`
+	Keywords    []string            `json:"keywords"`
+	Date        time.Time           `json:"date"`
+	Links       map[string]string   `json:"links"`
+	Maintainers []*SearchMaintainer `json:"maintainers"`
+}
+
+type SearchScore struct {
+	Final  float64 `json:"final"`
+	Detail struct {
+		Quality     float64 `json:"quality"`
+		Popularity  float64 `json:"popularity"`
+		Maintenance float64 `json:"maintenance"`
+	} `json:"detail"`
+}
+
+// used to count the tarballs served by the mirror
+type DownloadStat struct {
+	pkgmirror.DownloadCounter
+}
+
+// body sent by the npm publish command, the tarballs are base64 encoded
+type PublishDocument struct {
+	FullPackageDefinition
+	Attachments map[string]*PublishAttachment `json:"_attachments"`
+}
+
+type PublishAttachment struct {
+	ContentType string `json:"content_type"`
+	Data        string `json:"data"`
+	Length      int    `json:"length"`
 }
@@ -32,3 +32,25 @@ func Test_Load_Package(t *testing.T) {
 		assert.Equal(t, f.Name, p.Name, fmt.Sprintf("Package %s", f.File))
 	}
 }
+
+func Test_NewAbbreviatedPackage(t *testing.T) {
+	p := &FullPackageDefinition{}
+
+	assert.NoError(t, pkgmirror.LoadStruct("../../fixtures/npm/qs.json", p))
+
+	a := NewAbbreviatedPackage(p)
+
+	assert.Equal(t, "qs", a.Name)
+	assert.Equal(t, "2016-05-08T23:15:52.801Z", a.Modified)
+	assert.JSONEq(t, `{"latest":"6.2.0"}`, string(*a.DistTags))
+	assert.Equal(t, len(p.Versions), len(a.Versions))
+	assert.Equal(t, "6.2.0", a.Versions["6.2.0"].Version)
+	assert.JSONEq(t, `{"node":">=0.6"}`, string(*a.Versions["6.2.0"].Engines))
+	assert.Equal(t, "3b7848c03c2dece69a9522b0fae8c4126d745f3b", a.Versions["6.2.0"].Dist.Shasum)
+}
+
+func Test_IsAbbreviatedRequest(t *testing.T) {
+	assert.True(t, IsAbbreviatedRequest("application/vnd.npm.install-v1+json; q=1.0, application/json; q=0.8, */*"))
+	assert.False(t, IsAbbreviatedRequest("application/json"))
+	assert.False(t, IsAbbreviatedRequest(""))
+}
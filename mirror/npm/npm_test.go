@@ -0,0 +1,466 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package npm
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/rande/gonode/core/vault"
+	"github.com/rande/pkgmirror"
+	"github.com/rande/pkgmirror/mirror/git"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NpmService_GetServers(t *testing.T) {
+	ns := NewNpmService()
+	ns.Config.FallbackServers = []string{"https://registry.example.com", "https://registry.yarnpkg.com"}
+
+	assert.Equal(t, []string{"https://registry.npmjs.org", "https://registry.example.com", "https://registry.yarnpkg.com"}, ns.getServers(""))
+	assert.Equal(t, []string{"https://registry.example.com", "https://registry.npmjs.org", "https://registry.yarnpkg.com"}, ns.getServers("https://registry.example.com"))
+
+	// a registry removed from the configuration is not contacted
+	assert.Equal(t, []string{"https://registry.npmjs.org", "https://registry.example.com", "https://registry.yarnpkg.com"}, ns.getServers("https://npm.example.org"))
+}
+
+func Test_Verifier(t *testing.T) {
+	data := []byte("tarball")
+
+	// sha1 and sha512 digests of "tarball"
+	dist := DistDefinition{
+		Shasum:    fmt.Sprintf("%x", sha1.Sum(data)),
+		Integrity: fmt.Sprintf("sha512-%s", base64.StdEncoding.EncodeToString(sha512Sum(data))),
+	}
+
+	v := NewVerifier(dist)
+	v.Write(data)
+
+	assert.True(t, v.HasDigests())
+	assert.NoError(t, v.Verify())
+
+	v = NewVerifier(dist)
+	v.Write([]byte("corrupted"))
+
+	assert.Equal(t, pkgmirror.ChecksumMismatchError, v.Verify())
+
+	// the shasum is checked if no integrity is published
+	v = NewVerifier(DistDefinition{Shasum: dist.Shasum})
+	v.Write([]byte("corrupted"))
+
+	assert.Equal(t, pkgmirror.ChecksumMismatchError, v.Verify())
+
+	v = NewVerifier(DistDefinition{Integrity: "md5-unsupported"})
+
+	assert.False(t, v.HasDigests())
+	assert.NoError(t, v.Verify())
+}
+
+func sha512Sum(data []byte) []byte {
+	sum := sha512.Sum512(data)
+
+	return sum[:]
+}
+
+func Test_GetSeq(t *testing.T) {
+	assert.Equal(t, "1234-g1AAAAB", GetSeq([]byte(`"1234-g1AAAAB"`)))
+	assert.Equal(t, "1234", GetSeq([]byte(`1234`)))
+}
+
+func Test_NpmConfig_IsIncluded(t *testing.T) {
+	c := &NpmConfig{
+		Include: []string{"@types/*", "angular-*"},
+	}
+
+	assert.True(t, c.IsIncluded("@types/react"))
+	assert.True(t, c.IsIncluded("angular-oauth"))
+	assert.False(t, c.IsIncluded("left-pad"))
+	assert.False(t, (&NpmConfig{}).IsIncluded("left-pad"))
+}
+
+func Test_NpmConfig_IsPrivate(t *testing.T) {
+	c := &NpmConfig{
+		Scopes: []string{"@acme", "corp"},
+	}
+
+	assert.True(t, c.IsPrivate("@acme/ui"))
+	assert.True(t, c.IsPrivate("@acme%2fui"))
+	assert.True(t, c.IsPrivate("@corp/ui"))
+	assert.False(t, c.IsPrivate("@acme-ui/ui"))
+	assert.False(t, c.IsPrivate("acme"))
+}
+
+func Test_NpmConfig_IsAuthorized(t *testing.T) {
+	c := &NpmConfig{}
+
+	// publishing is disabled without token
+	assert.False(t, c.IsAuthorized(""))
+	assert.False(t, c.IsAuthorized("Bearer "))
+
+	c.PublishToken = "secret"
+
+	assert.True(t, c.IsAuthorized("Bearer secret"))
+	assert.False(t, c.IsAuthorized("Bearer other"))
+	assert.False(t, c.IsAuthorized("secret"))
+	assert.False(t, c.IsAuthorized(""))
+}
+
+func Test_NpmService_DistTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgmirror-npm-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNpmService()
+	ns.Logger = log.NewEntry(log.New())
+	ns.StateChan = make(chan pkgmirror.State, 10)
+	ns.Rewriter = git.NewRewriter("http://localhost:8000", nil)
+	ns.Config.Path = dir
+	ns.Config.Scopes = []string{"@acme"}
+
+	go func() {
+		for range ns.StateChan {
+		}
+	}()
+
+	assert.NoError(t, ns.openDatabase())
+	defer ns.DB.Close()
+
+	newPackage := func(name string) *FullPackageDefinition {
+		pkg := &FullPackageDefinition{
+			ID:   name,
+			Name: name,
+			Versions: map[string]*PackageVersionDefinition{
+				"1.0.0": {Name: name, Version: "1.0.0"},
+				"1.1.0": {Name: name, Version: "1.1.0"},
+			},
+		}
+
+		setTags(pkg, map[string]string{"latest": "1.1.0"})
+
+		return pkg
+	}
+
+	assert.NoError(t, ns.savePackage(newPackage("@acme/ui")))
+	assert.NoError(t, ns.savePackage(newPackage("left-pad")))
+
+	tags, err := ns.SetDistTag("@acme%2fui", "stable", "1.0.0")
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"latest": "1.1.0", "stable": "1.0.0"}, tags)
+
+	// the local tags are kept when the package is updated
+	assert.NoError(t, ns.savePackage(newPackage("@acme/ui")))
+
+	tags, err = ns.GetDistTags("@acme%2fui")
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"latest": "1.1.0", "stable": "1.0.0"}, tags)
+
+	// the tags of the public packages cannot be changed
+	_, err = ns.SetDistTag("left-pad", "latest", "1.0.0")
+
+	assert.Equal(t, pkgmirror.ForbiddenScopeError, err)
+
+	_, err = ns.DeleteDistTag("left-pad", "latest")
+
+	assert.Equal(t, pkgmirror.ForbiddenScopeError, err)
+
+	// the local tags only apply on the private packages
+	ns.DB.Update(func(tx *bolt.Tx) error {
+		return putLocalTags(tx, "left-pad", map[string]string{"latest": "1.0.0"})
+	})
+
+	assert.NoError(t, ns.savePackage(newPackage("left-pad")))
+
+	tags, err = ns.GetDistTags("left-pad")
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"latest": "1.1.0"}, tags)
+}
+
+func Test_NewSearchEntry(t *testing.T) {
+	p := &FullPackageDefinition{}
+
+	assert.NoError(t, pkgmirror.LoadStruct("../../fixtures/mock/npm/angular-nvd3-nb/index.html", p))
+
+	entry := NewSearchEntry(p)
+
+	assert.Equal(t, "angular-nvd3-nb", entry.Name)
+	assert.Equal(t, "1.0.5-dash20160130", entry.Version)
+	assert.Equal(t, "An AngularJS directive for NVD3.js reusable charting library", entry.Description)
+	assert.Contains(t, entry.Keywords, "charts")
+	assert.Equal(t, "nickbenes", entry.Maintainers[0].Username)
+	assert.Equal(t, 2016, entry.Date.Year())
+	assert.Equal(t, 1.0, entry.Quality())
+}
+
+func Test_SearchEntry_Score(t *testing.T) {
+	entry := &SearchEntry{
+		Name:        "@types/react",
+		Description: "TypeScript definitions for React",
+		Keywords:    []string{"react"},
+		Maintainers: []*SearchMaintainer{{Username: "types"}},
+	}
+
+	assert.True(t, entry.Score([]string{"react"}) > 0)
+	assert.True(t, entry.Score([]string{"typescript", "definitions"}) > 0)
+	assert.True(t, entry.Score([]string{"keywords:react", "scope:types", "maintainer:types"}) > 0)
+	assert.Equal(t, 0, entry.Score([]string{"react", "angular"}))
+	assert.Equal(t, 0, entry.Score([]string{"keywords:angular"}))
+	assert.Equal(t, 0, entry.Score([]string{"scope:angular"}))
+	assert.True(t, entry.Score([]string{"@types/react"}) > entry.Score([]string{"react"}))
+}
+
+func Test_SearchEntry_Maintenance(t *testing.T) {
+	now := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 1.0, (&SearchEntry{Date: now}).Maintenance(now))
+	assert.Equal(t, 0.5, (&SearchEntry{Date: now.Add(-SEARCH_MAINTENANCE_PERIOD / 2)}).Maintenance(now))
+	assert.Equal(t, 0.0, (&SearchEntry{Date: now.AddDate(-5, 0, 0)}).Maintenance(now))
+	assert.Equal(t, 0.0, (&SearchEntry{}).Maintenance(now))
+}
+
+func Test_NpmService_Downloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgmirror-npm-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNpmService()
+	ns.Logger = log.NewEntry(log.New())
+	ns.Config.Path = dir
+
+	assert.NoError(t, ns.openDatabase())
+	defer ns.DB.Close()
+
+	ns.recordDownload("left-pad")
+	ns.recordDownload("left-pad")
+
+	// the downloads not stored yet are included
+	stat, err := ns.GetDownloads("left-pad")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stat.Total)
+
+	assert.NoError(t, ns.flushDownloads())
+
+	ns.recordDownload("left-pad")
+
+	assert.NoError(t, ns.flushDownloads())
+
+	stat, err = ns.GetDownloads("left-pad")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stat.Total)
+	assert.Equal(t, 3, stat.Since(DOWNLOADS_HISTORY_DAYS, time.Now()))
+
+	_, err = ns.GetDownloads("right-pad")
+
+	assert.Equal(t, pkgmirror.EmptyKeyError, err)
+}
+
+func Test_GetVaultKey(t *testing.T) {
+	assert.Equal(t, "@acme%2fui/1.0.0", GetVaultKey("@acme/ui", "1.0.0"))
+	assert.Equal(t, "left-pad/1.0.0", GetVaultKey("left-pad", "1.0.0"))
+}
+
+func Test_NextRev(t *testing.T) {
+	assert.Regexp(t, "^1-[0-9a-f]{32}$", nextRev(""))
+	assert.Regexp(t, "^4-[0-9a-f]{32}$", nextRev("3-5a9cd12c5e7b5d16645f4896326d29c8"))
+}
+
+func Test_NpmService_LoadPackage_Failover(t *testing.T) {
+	primaryCode := http.StatusNotFound
+
+	primary := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if primaryCode != http.StatusOK {
+			res.WriteHeader(primaryCode)
+
+			return
+		}
+
+		res.Write([]byte(`{"_id": "left-pad", "name": "left-pad"}`))
+	}))
+	defer primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(`{"_id": "left-pad", "name": "left-pad"}`))
+	}))
+	defer fallback.Close()
+
+	ns := NewNpmService()
+	ns.Logger = log.NewEntry(log.New())
+	ns.Config.SourceServer = primary.URL
+	ns.Config.FallbackServers = []string{fallback.URL}
+
+	// the package does not exist on the main registry
+	pkg, err := ns.loadPackage("left-pad", "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, fallback.URL, pkg.Server)
+
+	// the registry failing is skipped
+	primaryCode = http.StatusBadGateway
+
+	pkg, err = ns.loadPackage("left-pad", "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, fallback.URL, pkg.Server)
+
+	// the recorded registry is contacted first
+	primaryCode = http.StatusOK
+
+	pkg, err = ns.loadPackage("left-pad", fallback.URL)
+
+	assert.NoError(t, err)
+	assert.Equal(t, fallback.URL, pkg.Server)
+
+	pkg, err = ns.loadPackage("left-pad", "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, primary.URL, pkg.Server)
+
+	// the error is reported if no registry provides the package
+	fallback.Close()
+	primaryCode = http.StatusBadGateway
+
+	_, err = ns.loadPackage("left-pad", "")
+
+	assert.Error(t, err)
+	assert.NotEqual(t, pkgmirror.ResourceNotFoundError, err)
+
+	primaryCode = http.StatusNotFound
+
+	_, err = ns.loadPackage("left-pad", primary.URL)
+
+	assert.Error(t, err)
+	assert.NotEqual(t, pkgmirror.ResourceNotFoundError, err)
+}
+
+func Test_NpmService_SyncChanges_Retry(t *testing.T) {
+	var available int32
+
+	ms := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/_changes":
+			res.Write([]byte(`{"results": [{"seq": 2, "id": "left-pad", "changes": [{"rev": "1-a"}]}], "last_seq": 2}`))
+		case "/left-pad":
+			if atomic.LoadInt32(&available) == 0 {
+				res.WriteHeader(http.StatusInternalServerError)
+
+				return
+			}
+
+			res.Write([]byte(`{"_id": "left-pad", "_rev": "1-a", "name": "left-pad"}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ms.Close()
+
+	dir, err := ioutil.TempDir("", "pkgmirror-npm-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNpmService()
+	ns.Logger = log.NewEntry(log.New())
+	ns.StateChan = make(chan pkgmirror.State, 10)
+	ns.Rewriter = git.NewRewriter("http://localhost:8000", nil)
+	ns.Config.Path = dir
+	ns.Config.SourceServer = ms.URL
+	ns.Config.ChangesFeed = ms.URL + "/_changes"
+	ns.Config.Include = []string{"left-*"}
+
+	go func() {
+		for range ns.StateChan {
+		}
+	}()
+
+	assert.NoError(t, ns.openDatabase())
+	defer ns.DB.Close()
+
+	// the package cannot be loaded, the sequence moves forward but the package is kept
+	assert.NoError(t, ns.SyncChanges())
+	assert.Equal(t, "2", ns.GetChangesSeq())
+	assert.Equal(t, []string{"left-pad"}, ns.GetChangesRetry())
+
+	_, err = ns.getMeta("left-pad")
+	assert.Equal(t, pkgmirror.EmptyKeyError, err)
+
+	// the next sync updates the package
+	atomic.StoreInt32(&available, 1)
+
+	assert.NoError(t, ns.SyncChanges())
+	assert.Equal(t, []string{}, ns.GetChangesRetry())
+
+	meta, err := ns.getMeta("left-pad")
+	assert.NoError(t, err)
+	assert.Equal(t, "1-a", meta.Rev)
+}
+
+func Test_NpmService_WriteArchive_Without_Digest(t *testing.T) {
+	var downloads int32
+
+	ms := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/left-pad":
+			res.Write([]byte(`{"_id": "left-pad", "_rev": "1-a", "name": "left-pad", "versions": {"1.0.0": {"name": "left-pad", "version": "1.0.0", "dist": {}}}}`))
+		case "/left-pad/-/left-pad-1.0.0.tgz":
+			atomic.AddInt32(&downloads, 1)
+
+			res.Write([]byte("tarball"))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ms.Close()
+
+	dir, err := ioutil.TempDir("", "pkgmirror-npm-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ns := NewNpmService()
+	ns.Logger = log.NewEntry(log.New())
+	ns.StateChan = make(chan pkgmirror.State, 10)
+	ns.Rewriter = git.NewRewriter("http://localhost:8000", nil)
+	ns.Config.Path = dir
+	ns.Config.SourceServer = ms.URL
+	ns.Vault = &vault.Vault{
+		Algo: "no_op",
+		Driver: &vault.DriverFs{
+			Root: fmt.Sprintf("%s/packages", dir),
+		},
+	}
+
+	go func() {
+		for range ns.StateChan {
+		}
+	}()
+
+	assert.NoError(t, ns.openDatabase())
+	defer ns.DB.Close()
+
+	// the tarball cannot be verified, it is stored as downloaded
+	for i := 0; i < 2; i++ {
+		buf := bytes.NewBuffer(nil)
+
+		assert.NoError(t, ns.WriteArchive(buf, "left-pad", "1.0.0"))
+		assert.Equal(t, "tarball", buf.String())
+	}
+
+	assert.True(t, ns.Vault.Has(GetVaultKey("left-pad", "1.0.0")))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+}
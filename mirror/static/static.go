@@ -98,6 +98,11 @@ func (gs *StaticService) Serve(state *goapp.GoroutineState) error {
 	return nil
 }
 
+// Has returns true if the file is stored in the vault.
+func (gs *StaticService) Has(path string) bool {
+	return gs.Vault.Has(path)
+}
+
 func (gs *StaticService) WriteArchive(w io.Writer, path string) (*StaticFile, error) {
 	vaultKey := fmt.Sprintf("%s", path)
 	bucketKey := vaultKey
@@ -0,0 +1,60 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pkgmirror
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// ScoreTerm returns the relevance of a package for one lowercased search term, 0 means the
+// package does not match the term.
+func ScoreTerm(term, name, description string, keywords []string) int {
+	name = strings.ToLower(name)
+	score := 0
+
+	if name == term {
+		score += 100
+	} else if strings.Contains(name, term) {
+		score += 10
+	}
+
+	for _, keyword := range keywords {
+		if strings.ToLower(keyword) == term {
+			score += 5
+
+			break
+		}
+	}
+
+	if strings.Contains(strings.ToLower(description), term) {
+		score += 1
+	}
+
+	return score
+}
+
+// RebuildIndex fills the index bucket with the build function if the bucket is empty, the
+// mirrors index the packages when they are saved so this only happens once per database.
+func RebuildIndex(db *bolt.DB, bucket []byte, logger *log.Entry, build func(tx *bolt.Tx) error) error {
+	empty := true
+	db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(bucket).Cursor().First()
+		empty = k == nil
+
+		return nil
+	})
+
+	if !empty {
+		return nil
+	}
+
+	logger.WithField("bucket", string(bucket)).Info("Build search index")
+
+	return db.Update(build)
+}
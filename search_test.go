@@ -0,0 +1,21 @@
+// Copyright © 2016-present Thomas Rabaix <thomas.rabaix@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package pkgmirror
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ScoreTerm(t *testing.T) {
+	keywords := []string{"Framework", "php"}
+
+	assert.Equal(t, 106, ScoreTerm("symfony", "Symfony", "the symfony framework", []string{"symfony"}))
+	assert.Equal(t, 10, ScoreTerm("symfony", "symfony/console", "", keywords))
+	assert.Equal(t, 6, ScoreTerm("framework", "laravel/laravel", "The Laravel framework", keywords))
+	assert.Equal(t, 0, ScoreTerm("orm", "laravel/laravel", "The Laravel framework", keywords))
+}
@@ -6,8 +6,14 @@
 package mirror
 
 import (
+	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -111,3 +117,696 @@ func Test_Update_Unknown_Package(t *testing.T) {
 		assert.Equal(t, "No value available", v["message"])
 	})
 }
+
+func Test_Composer_Get_Metadata(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/packages.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		p := &composer.PackagesResult{}
+		err = json.Unmarshal(res.GetBody(), p)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "/composer/packagist/p2/%package%.json", p.MetadataURL)
+		assert.Equal(t, []string{"0n3s3c/baselibrary", "symfony/framework-standard-edition"}, p.AvailablePackages)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/p2/symfony/framework-standard-edition.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := &composer.MetadataResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "composer/2.0", v.Minified)
+		assert.True(t, len(v.Packages["symfony/framework-standard-edition"]) > 0)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/p2/symfony/framework-standard-edition~dev.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+	})
+}
+
+func Test_Composer_Search(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/search.json?q=symfony", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := &composer.SearchResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, v.Total)
+		assert.Equal(t, "symfony/framework-standard-edition", v.Results[0].Name)
+		assert.Equal(t, "http://localhost:8000/composer/packagist/p/symfony/framework-standard-edition.html", v.Results[0].Url)
+
+		// the url leads to the package
+		res, err = test.RunRequest("GET", strings.Replace(v.Results[0].Url, "http://localhost:8000", args.TestServer.URL, 1))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/search.json?q=library&per_page=1", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		v = &composer.SearchResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(v.Results))
+	})
+}
+
+func Test_Composer_Downloads(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		body := strings.NewReader(`{"downloads": [{"name": "symfony/framework-standard-edition", "version": "2.8.9.0"}, {"name": "foo/unknown", "version": "1.0.0.0"}]}`)
+		res, err := test.RunRequest("POST", fmt.Sprintf("%s/composer/packagist/downloads/", args.TestServer.URL), body)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/composer/packagist/downloads/symfony/framework-standard-edition", args.TestServer.URL), url.Values{"version": {"2.8.9.0"}})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/composer/packagist/downloads/symfony/framework-standard-edition", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		stat := &composer.DownloadStat{}
+		err = json.Unmarshal(res.GetBody(), stat)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, stat.Total)
+		assert.Equal(t, 2, stat.Versions["2.8.9.0"])
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/composer/packagist/downloads/foo/unknown", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/composer/packagist/downloads?limit=5&days=30", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		summaries := []*composer.DownloadSummary{}
+		err = json.Unmarshal(res.GetBody(), &summaries)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(summaries))
+		assert.Equal(t, 2, summaries[0].Downloads)
+	})
+}
+
+var privateHeaders = map[string]string{"Authorization": "Bearer composer-token"}
+
+func Test_Composer_Private_Archive(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		buf := bytes.NewBuffer(nil)
+		w := zip.NewWriter(buf)
+		f, _ := w.Create("composer.json")
+		f.Write([]byte(`{"name": "symfony/framework-standard-edition", "description": "Internal fork", "type": "project"}`))
+		w.Close()
+
+		// the uploads require a token
+		res, err := test.RunRequest("POST", fmt.Sprintf("%s/composer/packagist/private?version=9.0.0", args.TestServer.URL), bytes.NewReader(buf.Bytes()))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/composer/packagist/private?version=9.0.0", args.TestServer.URL), bytes.NewReader(buf.Bytes()), map[string]string{"Authorization": "Bearer invalid"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		// the upstream package is still served
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/p2/symfony/framework-standard-edition.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.NotContains(t, string(res.GetBody()), "Internal fork")
+
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/composer/packagist/private?version=9.0.0", args.TestServer.URL), bytes.NewReader(buf.Bytes()), privateHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+
+		pkg := &composer.Package{}
+		err = json.Unmarshal(res.GetBody(), pkg)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "9.0.0.0", pkg.VersionNormalized)
+		assert.True(t, strings.HasSuffix(pkg.Dist.URL, "/composer/packagist/private/symfony/framework-standard-edition/9.0.0.zip"))
+
+		// the private package replaces the upstream one
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/p2/symfony/framework-standard-edition.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := &composer.MetadataResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(v.Packages["symfony/framework-standard-edition"]))
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/packages.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		p := &composer.PackagesResult{}
+		err = json.Unmarshal(res.GetBody(), p)
+
+		assert.NoError(t, err)
+		assert.Contains(t, p.ProviderIncludes, "p/provider-private$%hash%.json")
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/private/symfony/framework-standard-edition/9.0.0.zip", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, buf.Bytes(), res.GetBody())
+
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/composer/packagist/private", args.TestServer.URL), strings.NewReader("invalid"), privateHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 400, res.StatusCode)
+	})
+}
+
+func Test_Composer_Private_Vcs_Invalid_Url(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		marker := fmt.Sprintf("%s/pkgmirror-upload-pack-%d", os.TempDir(), time.Now().UnixNano())
+
+		defer os.Remove(marker)
+
+		headers := map[string]string{"Content-Type": "application/json", "Authorization": privateHeaders["Authorization"]}
+
+		for _, url := range []string{
+			fmt.Sprintf("--upload-pack=touch %s", marker),
+			"file:///etc",
+			"/var/lib/repositories/foo.git",
+		} {
+			body, _ := json.Marshal(&composer.PrivateVcsRequest{Url: url, Reference: "master"})
+
+			res, err := test.RunRequest("POST", fmt.Sprintf("%s/composer/packagist/private", args.TestServer.URL), bytes.NewReader(body), headers)
+
+			assert.NoError(t, err)
+			assert.Equal(t, 400, res.StatusCode, url)
+		}
+
+		_, err := os.Stat(marker)
+
+		assert.True(t, os.IsNotExist(err), "the git option must not be executed")
+	})
+}
+
+func Test_Composer_Security_Advisories(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/packages.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		p := &composer.PackagesResult{}
+		err = json.Unmarshal(res.GetBody(), p)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "/composer/packagist/api/security-advisories/", p.SecurityAdvisories.ApiURL)
+
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/composer/packagist/api/security-advisories/", args.TestServer.URL), url.Values{"packages[]": {"symfony/framework-standard-edition", "0n3s3c/baselibrary"}})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := &composer.SecurityAdvisoriesResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(v.Advisories))
+		assert.Equal(t, "CVE-2016-0001", v.Advisories["symfony/framework-standard-edition"][0].CVE)
+
+		// the advisories are stored before the package is mirrored
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/api/security-advisories/?packages[]=foo/not-mirrored", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		v = &composer.SecurityAdvisoriesResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(v.Advisories))
+		assert.Equal(t, "CVE-2016-0002", v.Advisories["foo/not-mirrored"][0].CVE)
+	})
+}
+
+func Test_Composer_Security_Advisories_Lazy_Package(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		// the package is mirrored after the advisories synchronization
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/composer/lazy/lazy/symfony/framework-standard-edition.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/lazy/api/security-advisories/?packages[]=symfony/framework-standard-edition", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := &composer.SecurityAdvisoriesResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(v.Advisories))
+		assert.Equal(t, "CVE-2016-0001", v.Advisories["symfony/framework-standard-edition"][0].CVE)
+	})
+}
+
+func Test_Composer_Warm(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		lock := strings.NewReader(`{
+			"packages": [{
+				"name": "foo/bar",
+				"version": "1.0.0",
+				"source": {"type": "git", "url": "https://example.org/foo/bar.git", "reference": "master"},
+				"dist": {"type": "zip", "url": "https://example.org/foo/bar.zip", "reference": "master"}
+			}],
+			"packages-dev": []
+		}`)
+
+		res, err := test.RunRequest("POST", fmt.Sprintf("%s/api/composer/warm", args.TestServer.URL), lock)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 202, res.StatusCode)
+
+		job := &composer.WarmJob{}
+		err = json.Unmarshal(res.GetBody(), job)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, job.Packages)
+		assert.Equal(t, fmt.Sprintf("/api/composer/warm/%s", job.Id), res.Header.Get("Location"))
+
+		// the warm operation runs in the background
+		for i := 0; i < 50 && job.Status != composer.WARM_JOB_COMPLETED; i++ {
+			time.Sleep(100 * time.Millisecond)
+
+			res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/composer/warm/%s", args.TestServer.URL, job.Id))
+
+			assert.NoError(t, err)
+			assert.Equal(t, 200, res.StatusCode)
+
+			err = json.Unmarshal(res.GetBody(), job)
+
+			assert.NoError(t, err)
+		}
+
+		assert.Equal(t, composer.WARM_JOB_COMPLETED, job.Status)
+
+		report := job.Report
+
+		assert.Equal(t, 1, len(report.Results))
+		assert.Equal(t, 1, report.Skipped)
+		assert.Equal(t, "foo/bar", report.Results[0].Package)
+		assert.Equal(t, "skipped", report.Results[0].Status)
+
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/api/composer/warm", args.TestServer.URL), strings.NewReader("invalid"))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 400, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/composer/warm/unknown", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+	})
+}
+
+func Test_Composer_Lazy(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/composer/lazy/packages.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := &composer.PackagesResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "/composer/lazy/lazy/%package%.json", v.ProvidersLazyURL)
+		assert.Equal(t, 0, len(v.AvailablePackages))
+		assert.Equal(t, 0, len(v.ProviderIncludes))
+		assert.Equal(t, 0, len(v.Mirrors))
+
+		// the first request loads the package from the upstream
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/lazy/lazy/symfony/framework-standard-edition.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		p := &composer.PackageResult{}
+		err = json.Unmarshal(res.GetBody(), p)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "symfony/framework-standard-edition", p.Packages["symfony/framework-standard-edition"]["2.1.x-dev"].Name)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/lazy/p2/symfony/framework-standard-edition~dev.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		// the metadata-url also loads the package on demand
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/lazy/p2/0n3s3c/baselibrary.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/lazy/lazy/foo/bar.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+
+		// the eager mirror does not expose the lazy entry point
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/packages.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		v = &composer.PackagesResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Empty(t, v.ProvidersLazyURL)
+		assert.Equal(t, 2, len(v.AvailablePackages))
+	})
+}
+
+func Test_Composer_Mirrors(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/composer/mirrors/packages.json", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		v := &composer.PackagesResult{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(v.Mirrors))
+		assert.Equal(t, "http://localhost:8000/composer/mirrors/dists/%package%/%version%/%reference%.%type%", v.Mirrors[0].DistURL)
+		assert.True(t, v.Mirrors[0].Preferred)
+
+		// the upstream urls are not rewritten
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/mirrors/p/symfony/framework-standard-edition", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		p := &composer.PackageResult{}
+		err = json.Unmarshal(res.GetBody(), p)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "https://github.com/symfony/symfony-standard.git", p.Packages["symfony/framework-standard-edition"]["2.1.x-dev"].Source.URL)
+
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		resp, err := client.Get(fmt.Sprintf("%s/composer/mirrors/dists/symfony/framework-standard-edition/2.1.9999999.9999999-dev/d188f8926162ae1870df40047e0f3ddee5c133e0.zip", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Equal(t, "http://localhost:8000/git/github.com/symfony/symfony-standard/d188f8926162ae1870df40047e0f3ddee5c133e0.zip", resp.Header.Get("Location"))
+
+		resp, err = client.Get(fmt.Sprintf("%s/composer/mirrors/git/symfony/framework-standard-edition/https---github.com-symfony-symfony-standard.git/info/refs?service=git-upload-pack", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Equal(t, "http://localhost:8000/git/github.com/symfony/symfony-standard.git/info/refs?service=git-upload-pack", resp.Header.Get("Location"))
+
+		resp, err = client.Get(fmt.Sprintf("%s/composer/mirrors/dists/symfony/framework-standard-edition/1.0.0.0/unknown.zip", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func Test_Composer_Generations(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/api/composer/packagist/generations", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		generations := []*composer.Generation{}
+		err = json.Unmarshal(res.GetBody(), &generations)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(generations))
+		assert.Equal(t, 1, len(generations[0].Providers))
+
+		// the provider of the current generation is available
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/%s", args.TestServer.URL, url.PathEscape(generations[0].Providers[0])))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+	})
+}
+
+func Test_Composer_Package_Detail(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/api/composer/packagist/packages/symfony/framework-standard-edition", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		detail := &composer.PackageDetail{}
+		err = json.Unmarshal(res.GetBody(), detail)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "symfony/framework-standard-edition", detail.Package)
+		assert.NotEmpty(t, detail.HashSource)
+		assert.NotEmpty(t, detail.HashTarget)
+		assert.True(t, len(detail.Versions) > 0)
+
+		var version *composer.VersionDetail
+		for _, v := range detail.Versions {
+			if v.Version == "2.1.x-dev" {
+				version = v
+			}
+		}
+
+		if !assert.NotNil(t, version) {
+			return
+		}
+
+		assert.NotNil(t, version.FirstSeen)
+		assert.Equal(t, "https://github.com/symfony/symfony-standard.git", version.Source.Original)
+		assert.Equal(t, "http://localhost:8000/git/github.com/symfony/symfony-standard.git", version.Source.URL)
+		assert.Equal(t, "https://api.github.com/repos/symfony/symfony-standard/zipball/d188f8926162ae1870df40047e0f3ddee5c133e0", version.Dist.Original)
+		assert.Equal(t, "d188f8926162ae1870df40047e0f3ddee5c133e0", version.Dist.Reference)
+		assert.False(t, version.Dist.Cached)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/composer/packagist/packages/foo/bar", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+	})
+}
+
+func Test_Composer_Garbage_Collection(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		for method, applied := range map[string]bool{"GET": false, "POST": true} {
+			res, err := test.RunRequest(method, fmt.Sprintf("%s/api/composer/packagist/gc", args.TestServer.URL))
+
+			assert.NoError(t, err)
+			assert.Equal(t, 200, res.StatusCode)
+
+			report := &composer.GCReport{}
+			err = json.Unmarshal(res.GetBody(), report)
+
+			assert.NoError(t, err)
+			assert.Equal(t, applied, report.Applied)
+			assert.Equal(t, 0, report.Generations)
+			assert.Equal(t, 0, len(report.Orphans))
+			assert.Equal(t, 0, len(report.Providers))
+		}
+
+		// the current generation is still available
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/composer/packagist/p/symfony/framework-standard-edition", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+	})
+}
+
+func Test_Composer_Quarantine(t *testing.T) {
+	optin := &test.TestOptin{Composer: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		time.Sleep(1 * time.Second)
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/api/composer/reviewed/quarantine", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		entries := []*composer.QuarantineEntry{}
+		err = json.Unmarshal(res.GetBody(), &entries)
+
+		assert.NoError(t, err)
+		assert.True(t, len(entries) > 0)
+
+		pending := map[string]bool{}
+		for _, entry := range entries {
+			assert.Equal(t, composer.QUARANTINE_PENDING, entry.Status)
+			assert.NotNil(t, entry.Definition)
+
+			pending[entry.Package+"@"+entry.Version] = true
+		}
+
+		assert.True(t, pending["symfony/framework-standard-edition@2.1.x-dev"])
+
+		// the new versions are not published
+		getVersions := func(name string) map[string]*composer.Package {
+			res, err := test.RunRequest("GET", fmt.Sprintf("%s/composer/reviewed/p/%s", args.TestServer.URL, name))
+
+			assert.NoError(t, err)
+			assert.Equal(t, 200, res.StatusCode)
+
+			v := &composer.PackageResult{}
+			assert.NoError(t, json.Unmarshal(res.GetBody(), v))
+
+			return v.Packages[name]
+		}
+
+		assert.Equal(t, 0, len(getVersions("symfony/framework-standard-edition")))
+
+		// the approvals require a token
+		reviewer := map[string]string{"Authorization": "Bearer reviewer-token"}
+
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/api/composer/reviewed/quarantine/symfony/framework-standard-edition?version=2.1.x-dev", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/api/composer/reviewed/quarantine/rules", args.TestServer.URL), strings.NewReader(`{"pattern": "*"}`), map[string]string{"Authorization": "Bearer composer-token"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		res, err = test.RunRequest("DELETE", fmt.Sprintf("%s/api/composer/reviewed/quarantine/rules?pattern=0n3s3c/*", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		assert.Equal(t, 0, len(getVersions("symfony/framework-standard-edition")))
+
+		// approve one version, the identity of the token is recorded
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/api/composer/reviewed/quarantine/symfony/framework-standard-edition?version=2.1.x-dev", args.TestServer.URL), nil, reviewer)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		approved := []*composer.QuarantineEntry{}
+		assert.NoError(t, json.Unmarshal(res.GetBody(), &approved))
+		assert.Equal(t, 1, len(approved))
+		assert.Equal(t, "alice", approved[0].ApprovedBy)
+
+		versions := getVersions("symfony/framework-standard-edition")
+
+		assert.Equal(t, 1, len(versions))
+		assert.Equal(t, "symfony/framework-standard-edition", versions["2.1.x-dev"].Name)
+		assert.True(t, strings.HasPrefix(versions["2.1.x-dev"].Dist.URL, "http://localhost:8000/"))
+
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/api/composer/reviewed/quarantine/symfony/framework-standard-edition?version=2.1.x-dev", args.TestServer.URL), nil, reviewer)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+
+		// approve the vendor
+		res, err = test.RunRequest("POST", fmt.Sprintf("%s/api/composer/reviewed/quarantine/rules", args.TestServer.URL), strings.NewReader(`{"pattern": "0n3s3c/*"}`), reviewer)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+		assert.True(t, len(getVersions("0n3s3c/baselibrary")) > 0)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/composer/reviewed/quarantine", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		entries = []*composer.QuarantineEntry{}
+		assert.NoError(t, json.Unmarshal(res.GetBody(), &entries))
+
+		for _, entry := range entries {
+			assert.Equal(t, "symfony/framework-standard-edition", entry.Package)
+		}
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/composer/reviewed/quarantine/rules", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		body := string(res.GetBody())
+
+		assert.Contains(t, body, `"pattern":"0n3s3c/*"`)
+		assert.Contains(t, body, `"created_by":"alice"`)
+
+		// the mirrors without quarantine publish all versions
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/composer/packagist/quarantine", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+	})
+}
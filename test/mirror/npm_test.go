@@ -6,11 +6,14 @@
 package mirror
 
 import (
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"strings"
 	"testing"
 
+	"github.com/boltdb/bolt"
 	"github.com/rande/pkgmirror/mirror/npm"
 	"github.com/rande/pkgmirror/test"
 	"github.com/stretchr/testify/assert"
@@ -64,3 +67,455 @@ func Test_Npm_Download_Scoped_Package_Archive(t *testing.T) {
 		assert.Equal(t, 25276, len(res.GetBody()))
 	})
 }
+
+func Test_Npm_Fallback_Package(t *testing.T) {
+
+	optin := &test.TestOptin{Npm: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		// the package is only available on the fallback registry
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/npm/left-pad", args.MockedServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/left-pad", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := &npm.FullPackageDefinition{}
+		err = json.Unmarshal(res.GetBody(), v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "left-pad", v.Name)
+		assert.Equal(t, "http://localhost:8000/npm/npm/left-pad/-/left-pad-1.0.0.tgz", v.Versions["1.0.0"].Dist.Tarball)
+		assert.Equal(t, "sha512-+I6+oSsLbXIRb6BoBZxiq/Ro8DN+ocsgvq1vdq67eTcVax4yCROma11LhtdnH9M47QOrT6KUFisJertiIphxZQ==", v.Versions["1.0.0"].Dist.Integrity)
+		assert.Equal(t, 2, v.Versions["1.0.0"].Dist.FileCount)
+		assert.Equal(t, 300, v.Versions["1.0.0"].Dist.UnpackedSize)
+
+		// the tarball is downloaded from the registry providing the package
+		url := strings.Replace(v.Versions["1.0.0"].Dist.Tarball, "http://localhost:8000", args.TestServer.URL, -1)
+
+		res, err = test.RunRequest("GET", url)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, 327, len(res.GetBody()))
+	})
+}
+
+func Test_Npm_Abbreviated_Package(t *testing.T) {
+
+	optin := &test.TestOptin{Npm: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		headers := map[string]string{"Accept": "application/vnd.npm.install-v1+json; q=1.0, application/json; q=0.8, */*"}
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/angular-nvd3-nb", args.TestServer.URL), nil, headers)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "application/vnd.npm.install-v1+json", res.Header.Get("Content-Type"))
+		assert.Equal(t, "Accept", res.Header.Get("Vary"))
+
+		body := res.GetBody()
+
+		assert.NotContains(t, string(body), "readme")
+		assert.NotContains(t, string(body), "description")
+
+		v := &npm.AbbreviatedPackageDefinition{}
+		err = json.Unmarshal(body, v)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "angular-nvd3-nb", v.Name)
+		assert.Equal(t, "http://localhost:8000/npm/npm/angular-nvd3-nb/-/angular-nvd3-nb-1.0.5-nb.tgz", v.Versions["1.0.5-nb"].Dist.Tarball)
+
+		// the full document is returned by default
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/angular-nvd3-nb", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		assert.Contains(t, string(res.GetBody()), "description")
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/non-existant-package", args.TestServer.URL), nil, headers)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+	})
+}
+
+func Test_Npm_Corrupted_Archive(t *testing.T) {
+
+	optin := &test.TestOptin{Npm: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/corrupted-pad", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		// the tarball does not match the published integrity, so it is not stored
+		for i := 0; i < 2; i++ {
+			res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/corrupted-pad/-/corrupted-pad-1.0.0.tgz", args.TestServer.URL))
+
+			assert.NoError(t, err)
+			assert.Equal(t, 502, res.StatusCode)
+		}
+	})
+}
+
+func Test_Npm_Corrupted_Archive_Without_Metadata(t *testing.T) {
+
+	optin := &test.TestOptin{Npm: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		// the metadata are loaded to verify the tarball, so it is not stored
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/corrupted-pad/-/corrupted-pad-1.0.0.tgz", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 502, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/corrupted-pad/-/corrupted-pad-1.0.0.tgz", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 502, res.StatusCode)
+	})
+}
+
+func Test_Npm_Changes_Feed(t *testing.T) {
+
+	optin := &test.TestOptin{Npm: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		res, err := test.RunRequest("POST", fmt.Sprintf("%s/api/npm/feed/changes", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := map[string]string{}
+
+		assert.NoError(t, json.Unmarshal(res.GetBody(), &v))
+		assert.Equal(t, "4-g1AAAAD", v["since"])
+
+		ns := args.App.Get("pkgmirror.npm.feed").(*npm.NpmService)
+
+		ns.DB.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("feed"))
+
+			// included by the angular-* pattern
+			assert.NotEmpty(t, b.Get([]byte("angular-nvd3-nb.meta")))
+
+			// not tracked and not included
+			assert.Empty(t, b.Get([]byte("left-pad.meta")))
+			assert.Empty(t, b.Get([]byte("_design/app.meta")))
+
+			return nil
+		})
+
+		// the feed is not available on the standard mirror
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/api/npm/npm/changes", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+	})
+}
+
+var publishHeaders = map[string]string{"Authorization": "Bearer publish-token"}
+
+func Test_Npm_DistTags(t *testing.T) {
+
+	optin := &test.TestOptin{Npm: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		for _, version := range []string{"1.0.0", "1.1.0"} {
+			res, err := test.RunRequest("PUT", fmt.Sprintf("%s/npm/npm/@acme%%2fui", args.TestServer.URL), newPublishDocument(version, []byte("tarball "+version)), publishHeaders)
+
+			assert.NoError(t, err)
+			assert.Equal(t, 201, res.StatusCode)
+		}
+
+		url := fmt.Sprintf("%s/npm/npm/-/package/@acme%%2fui/dist-tags", args.TestServer.URL)
+
+		res, err := test.RunRequest("GET", url)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.JSONEq(t, `{"latest": "1.1.0"}`, string(res.GetBody()))
+
+		res, err = test.RunRequest("PUT", url+"/stable", strings.NewReader(`"1.0.0"`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		res, err = test.RunRequest("PUT", url+"/stable", strings.NewReader(`"1.0.0"`), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.JSONEq(t, `{"latest": "1.1.0", "stable": "1.0.0"}`, string(res.GetBody()))
+
+		res, err = test.RunRequest("PUT", url+"/stable", strings.NewReader(`"9.9.9"`), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 400, res.StatusCode)
+
+		// the local tag is kept when a new version is published
+		res, err = test.RunRequest("PUT", fmt.Sprintf("%s/npm/npm/@acme%%2fui", args.TestServer.URL), newPublishDocument("1.2.0", []byte("tarball 1.2.0")), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/@acme%%2fui", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		v := &npm.FullPackageDefinition{}
+
+		assert.NoError(t, json.Unmarshal(res.GetBody(), v))
+		assert.JSONEq(t, `{"latest": "1.2.0", "stable": "1.0.0"}`, string(*v.DistTags))
+
+		res, err = test.RunRequest("DELETE", url+"/latest", nil, publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 400, res.StatusCode)
+
+		res, err = test.RunRequest("DELETE", url+"/stable", nil, publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.JSONEq(t, `{"latest": "1.2.0"}`, string(res.GetBody()))
+
+		res, err = test.RunRequest("DELETE", url+"/stable", nil, publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+	})
+}
+
+func Test_Npm_DistTags_Public_Package(t *testing.T) {
+
+	optin := &test.TestOptin{Npm: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		url := fmt.Sprintf("%s/npm/npm/-/package/angular-nvd3-nb/dist-tags", args.TestServer.URL)
+
+		res, err := test.RunRequest("GET", url)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.JSONEq(t, `{"latest": "1.0.5-dash20160130"}`, string(res.GetBody()))
+
+		// the write requests require the publish token
+		res, err = test.RunRequest("PUT", url+"/stable", strings.NewReader(`"1.0.5-nb"`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		res, err = test.RunRequest("DELETE", url+"/stable", nil, map[string]string{"Authorization": "Bearer invalid"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		// the tags of the mirrored packages cannot be changed
+		res, err = test.RunRequest("PUT", url+"/latest", strings.NewReader(`"1.0.5-nb"`), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 403, res.StatusCode)
+
+		res, err = test.RunRequest("PUT", url+"/stable", strings.NewReader(`"1.0.5-nb"`), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 403, res.StatusCode)
+
+		res, err = test.RunRequest("DELETE", url+"/latest", nil, publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 403, res.StatusCode)
+
+		res, err = test.RunRequest("GET", url)
+
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"latest": "1.0.5-dash20160130"}`, string(res.GetBody()))
+	})
+}
+
+func Test_Npm_Search(t *testing.T) {
+
+	optin := &test.TestOptin{Npm: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		for _, name := range []string{"angular-nvd3-nb", "left-pad"} {
+			res, err := test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/%s", args.TestServer.URL, name))
+
+			assert.NoError(t, err)
+			assert.Equal(t, 200, res.StatusCode)
+		}
+
+		res, err := test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/angular-nvd3-nb/-/angular-nvd3-nb-1.0.5-nb.tgz", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/-/v1/search?text=nvd3", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := &npm.SearchResult{}
+
+		assert.NoError(t, json.Unmarshal(res.GetBody(), v))
+		assert.Equal(t, 1, v.Total)
+		assert.Equal(t, "angular-nvd3-nb", v.Objects[0].Package.Name)
+		assert.Equal(t, "unscoped", v.Objects[0].Package.Scope)
+		assert.Equal(t, "http://localhost:8000/npm/npm/angular-nvd3-nb", v.Objects[0].Package.Links["npm"])
+		assert.Equal(t, 1.0, v.Objects[0].Score.Detail.Popularity)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/-/v1/search?text=keywords:charts", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		v = &npm.SearchResult{}
+
+		assert.NoError(t, json.Unmarshal(res.GetBody(), v))
+		assert.Equal(t, 1, v.Total)
+
+		// the downloaded package comes first
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/-/v1/search?text=&size=1&from=1", args.TestServer.URL))
+
+		assert.NoError(t, err)
+
+		v = &npm.SearchResult{}
+
+		assert.NoError(t, json.Unmarshal(res.GetBody(), v))
+		assert.Equal(t, 2, v.Total)
+		assert.Equal(t, 1, len(v.Objects))
+		assert.Equal(t, "left-pad", v.Objects[0].Package.Name)
+	})
+}
+
+func newPublishDocument(version string, data []byte) *strings.Reader {
+	return strings.NewReader(fmt.Sprintf(`{
+		"_id": "@acme/ui",
+		"name": "@acme/ui",
+		"dist-tags": {"latest": "%s"},
+		"versions": {"%s": {"name": "@acme/ui", "version": "%s", "dist": {"shasum": "%x"}}},
+		"_attachments": {"@acme/ui-%s.tgz": {"content_type": "application/octet-stream", "data": "%s", "length": %d}}
+	}`, version, version, version, sha1.Sum(data), version, base64.StdEncoding.EncodeToString(data), len(data)))
+}
+
+func Test_Npm_Publish_Private_Package(t *testing.T) {
+
+	optin := &test.TestOptin{Npm: true}
+
+	test.RunHttpTest(t, optin, func(args *test.Arguments) {
+		url := fmt.Sprintf("%s/npm/npm/@acme%%2fui", args.TestServer.URL)
+
+		// the write requests require the publish token
+		res, err := test.RunRequest("PUT", url, newPublishDocument("1.0.0", []byte("tarball 1.0.0")))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		res, err = test.RunRequest("PUT", url, newPublishDocument("1.0.0", []byte("tarball 1.0.0")), map[string]string{"Authorization": "Bearer invalid"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		res, err = test.RunRequest("PUT", url, newPublishDocument("1.0.0", []byte("tarball 1.0.0")), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+
+		// a version cannot be published twice
+		res, err = test.RunRequest("PUT", url, newPublishDocument("1.0.0", []byte("another tarball")), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 409, res.StatusCode)
+
+		// the scope is not allowed
+		res, err = test.RunRequest("PUT", fmt.Sprintf("%s/npm/npm/left-pad", args.TestServer.URL), strings.NewReader(`{"name": "left-pad"}`), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 403, res.StatusCode)
+
+		res, err = test.RunRequest("PUT", url, newPublishDocument("1.1.0", []byte("tarball 1.1.0")), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+
+		res, err = test.RunRequest("GET", url)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		v := &npm.FullPackageDefinition{}
+
+		assert.NoError(t, json.Unmarshal(res.GetBody(), v))
+		assert.Equal(t, 2, len(v.Versions))
+		assert.JSONEq(t, `{"latest": "1.1.0"}`, string(*v.DistTags))
+		assert.Equal(t, "http://localhost:8000/npm/npm/@acme/ui/-/ui-1.0.0.tgz", v.Versions["1.0.0"].Dist.Tarball)
+		assert.Equal(t, fmt.Sprintf("%x", sha1.Sum([]byte("tarball 1.0.0"))), v.Versions["1.0.0"].Dist.Shasum)
+
+		res, err = test.RunRequest("GET", strings.Replace(v.Versions["1.0.0"].Dist.Tarball, "http://localhost:8000", args.TestServer.URL, -1))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "tarball 1.0.0", string(res.GetBody()))
+
+		// the delete requests require the publish token too
+		res, err = test.RunRequest("DELETE", fmt.Sprintf("%s/-rev/%s", url, v.Rev))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 401, res.StatusCode)
+
+		// the private packages are not loaded from the registries
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/@acme%%2funknown", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+
+		// unpublish a version, like the npm client
+		res, err = test.RunRequest("PUT", fmt.Sprintf("%s/-rev/%s", url, v.Rev), newPublishDocument("1.1.0", []byte("tarball 1.1.0")), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+
+		res, err = test.RunRequest("DELETE", fmt.Sprintf("%s/npm/npm/@acme/ui/-/ui-1.0.0.tgz/-rev/%s", args.TestServer.URL, v.Rev), nil, publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		res, err = test.RunRequest("GET", fmt.Sprintf("%s/npm/npm/@acme/ui/-/ui-1.0.0.tgz", args.TestServer.URL))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+
+		// an unpublished version cannot be published again
+		res, err = test.RunRequest("PUT", url, newPublishDocument("1.0.0", []byte("tarball 1.0.0")), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 409, res.StatusCode)
+
+		// unpublish the package
+		res, err = test.RunRequest("DELETE", fmt.Sprintf("%s/-rev/%s", url, v.Rev), nil, publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+
+		res, err = test.RunRequest("GET", url)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 404, res.StatusCode)
+
+		// the versions of a deleted package are not reused
+		res, err = test.RunRequest("PUT", url, newPublishDocument("1.1.0", []byte("tarball 1.1.0")), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 409, res.StatusCode)
+
+		res, err = test.RunRequest("PUT", url, newPublishDocument("2.0.0", []byte("tarball 2.0.0")), publishHeaders)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+	})
+}
@@ -209,9 +209,22 @@ func RunHttpTest(t *testing.T, optin *TestOptin, f func(args *Arguments)) {
 		},
 		Npm: map[string]*pkgmirror.NpmConfig{
 			"npm": {
-				Server:  ms.URL + "/npm",
-				Enabled: optin.Npm,
-				Icon:    "https://cldup.com/Rg6WLgqccB.svg",
+				Server:       ms.URL + "/npm",
+				Enabled:      optin.Npm,
+				Icon:         "https://cldup.com/Rg6WLgqccB.svg",
+				Scopes:       []string{"@acme"},
+				PublishToken: "publish-token",
+				Fallbacks: []*struct {
+					Server string
+				}{
+					{Server: ms.URL + "/npm-fallback"},
+				},
+			},
+			"feed": {
+				Server:      ms.URL + "/npm",
+				Enabled:     optin.Npm,
+				ChangesFeed: ms.URL + "/npm-changes/_changes",
+				Include:     []string{"angular-*"},
 			},
 		},
 		Composer: map[string]*pkgmirror.ComposerConfig{
@@ -219,6 +232,23 @@ func RunHttpTest(t *testing.T, optin *TestOptin, f func(args *Arguments)) {
 				Server:  ms.URL + "/composer",
 				Enabled: optin.Composer,
 				Icon:    "https://getcomposer.org/img/logo-composer-transparent.png",
+				Tokens:  map[string]string{"ci": "composer-token"},
+			},
+			"lazy": {
+				Server:  ms.URL + "/composer",
+				Enabled: optin.Composer,
+				Lazy:    true,
+			},
+			"mirrors": {
+				Server:  ms.URL + "/composer",
+				Enabled: optin.Composer,
+				Mirrors: true,
+			},
+			"reviewed": {
+				Server:     ms.URL + "/composer",
+				Enabled:    optin.Composer,
+				Quarantine: true,
+				Tokens:     map[string]string{"alice": "reviewer-token"},
 			},
 		},
 		Bower: map[string]*pkgmirror.BowerConfig{
@@ -36,12 +36,17 @@ func LoadStruct(file string, v interface{}) error {
 }
 
 func LoadRemoteStruct(url string, v interface{}) error {
+	return LoadRemoteStructWithAuth(url, v, nil)
+}
+
+// LoadRemoteStructWithAuth loads the url with the credentials of the authenticator.
+func LoadRemoteStructWithAuth(url string, v interface{}, auth *Authenticator) error {
 	cpt := 0
 	for {
-		if err := loadRemoteStruct(url, v); err != nil {
+		if err := loadRemoteStruct(url, v, auth); err != nil {
 			cpt++
 
-			if cpt > 5 {
+			if cpt > 5 || err == ResourceNotFoundError {
 				return err
 			}
 		} else {
@@ -50,8 +55,14 @@ func LoadRemoteStruct(url string, v interface{}) error {
 	}
 }
 
-func loadRemoteStruct(url string, v interface{}) error {
-	resp, err := http.Get(url)
+func loadRemoteStruct(url string, v interface{}, auth *Authenticator) error {
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := auth.Do(req)
 
 	if err != nil {
 		return err
@@ -59,6 +70,11 @@ func loadRemoteStruct(url string, v interface{}) error {
 
 	defer resp.Body.Close()
 
+	// a missing resource is not retried
+	if resp.StatusCode == http.StatusNotFound {
+		return ResourceNotFoundError
+	}
+
 	buf := bytes.NewBuffer([]byte(""))
 
 	_, err = io.Copy(buf, resp.Body)